@@ -0,0 +1,31 @@
+package plugin
+
+import (
+	"net/http"
+)
+
+// ActionResolver derives the action and the resource targeted by a request.
+// Custom resolvers can be plugged in as Caddy modules in the
+// http.handlers.simple_rest_rbac.action_resolvers namespace.
+type ActionResolver interface {
+	// Resolve returns the action and the resource of the request. An empty
+	// resource lets the request through, an empty action denies it.
+	Resolve(r *http.Request) (action, resource string)
+}
+
+// defaultActionResolver is the built-in ActionResolver, which derives the
+// action from the HTTP method and the resource from the URL path, according
+// to the middleware configuration
+type defaultActionResolver struct {
+	m *Middleware
+}
+
+// Resolve implements ActionResolver.
+func (res defaultActionResolver) Resolve(r *http.Request) (string, string) {
+	return res.m.getActionFromRequest(r), res.m.extractResource(r.URL.Path)
+}
+
+// Interface guards
+var (
+	_ ActionResolver = defaultActionResolver{}
+)
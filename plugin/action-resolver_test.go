@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+)
+
+// headerActionResolver is an action resolver taking the action and the
+// resource from request headers
+type headerActionResolver struct{}
+
+// Resolve implements ActionResolver.
+func (headerActionResolver) Resolve(r *http.Request) (string, string) {
+	return r.Header.Get("X-Action"), r.Header.Get("X-Resource")
+}
+
+func TestCustomActionResolver(t *testing.T) {
+	m := provision(t, &Middleware{CustomActions: []string{"search"}}, `{
+		"reader": [{ "action": "search", "resource": "posts" }]
+	}`)
+	m.resolver = headerActionResolver{}
+	expectStatuses(t, m, []request{
+		{"POST", "/graphql", []string{"X-Role", "reader", "X-Action", "search", "X-Resource", "posts"}, http.StatusOK},
+		{"POST", "/graphql", []string{"X-Role", "reader", "X-Action", "delete", "X-Resource", "posts"}, http.StatusForbidden},
+		{"POST", "/graphql", []string{"X-Role", "reader", "X-Action", "search", "X-Resource", "users"}, http.StatusForbidden},
+		{"POST", "/graphql", []string{"X-Role", "reader", "X-Action", "delete"}, http.StatusOK},
+		{"POST", "/graphql", []string{"X-Role", "reader", "X-Resource", "posts"}, http.StatusMethodNotAllowed},
+	})
+}
+
+func TestDefaultActionResolver(t *testing.T) {
+	m := &Middleware{}
+	tests := []struct {
+		method, path     string
+		action, resource string
+	}{
+		{"GET", "/posts", "list", "posts"},
+		{"GET", "/posts/1", "show", "posts"},
+		{"POST", "/posts", "create", "posts"},
+		{"PUT", "/posts/1", "edit", "posts"},
+		{"DELETE", "/posts/1", "delete", "posts"},
+	}
+	for _, test := range tests {
+		action, resource := defaultActionResolver{m}.Resolve(newRequest(test.method, test.path))
+		if action != test.action || resource != test.resource {
+			t.Errorf("%s %s: got %q on %q, want %q on %q", test.method, test.path, action, resource, test.action, test.resource)
+		}
+	}
+}
+
+func TestActionVocabulary(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		action_vocabulary {
+			list read
+			show read
+			edit update
+		}
+		rate_limit editor 1 1h
+	}`)
+	provision(t, m, `{
+		"reader": [{ "action": "read", "resource": "posts" }],
+		"editor": [{ "action": ["read", "update", "create"], "resource": "posts" }]
+	}`)
+	tests := []struct {
+		method, path, action string
+	}{
+		{"GET", "/posts", "read"},
+		{"GET", "/posts/1", "read"},
+		{"PUT", "/posts/1", "update"},
+		{"POST", "/posts", "create"},
+		{"DELETE", "/posts/1", "delete"},
+	}
+	for _, test := range tests {
+		if action := m.getActionFromRequest(newRequest(test.method, test.path)); action != test.action {
+			t.Errorf("%s %s: got action %q, want %q", test.method, test.path, action, test.action)
+		}
+	}
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+		// Rate limits apply to the renamed write actions
+		{"PUT", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Role", "editor"}, http.StatusTooManyRequests},
+	})
+	if err := tryProvision(t, &Middleware{}, `{"reader": [{ "action": "read", "resource": "posts" }]}`); err == nil {
+		t.Error("expected actions outside the vocabulary to be rejected")
+	}
+}
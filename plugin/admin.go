@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+var (
+	// instances are the provisioned middlewares, inspected by the admin API
+	instances   = make(map[*Middleware]struct{})
+	instancesMu sync.RWMutex
+)
+
+// registerInstance makes a provisioned middleware visible to the admin API
+func registerInstance(m *Middleware) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	instances[m] = struct{}{}
+}
+
+// unregisterInstance hides a cleaned up middleware from the admin API
+func unregisterInstance(m *Middleware) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	delete(instances, m)
+}
+
+// findInstance returns the middleware whose roles come from the given
+// source. The source can be omitted when there is a single middleware.
+func findInstance(source string) (*Middleware, error) {
+	instancesMu.RLock()
+	defer instancesMu.RUnlock()
+
+	var found *Middleware
+	for m := range instances {
+		if source != "" && m.sourceName() != source {
+			continue
+		}
+		if found != nil && found.sourceName() != m.sourceName() {
+			return nil, fmt.Errorf("several simple_rest_rbac handlers are configured, use the source parameter to pick one")
+		}
+		found = m
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no simple_rest_rbac handler found")
+	}
+	return found, nil
+}
+
+// adminAPI exposes debugging endpoints on the Caddy admin API
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.simple_rest_rbac",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/rbac/check", Handler: caddy.AdminHandlerFunc(a.handleCheck)},
+		{Pattern: "/rbac/status", Handler: caddy.AdminHandlerFunc(a.handleStatus)},
+	}
+}
+
+// handleCheck tells whether a role can perform an action on a resource, e.g.
+// GET /rbac/check?role=writer&action=edit&resource=posts
+func (adminAPI) handleCheck(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	query := r.URL.Query()
+	role, action, resource := query.Get("role"), query.Get("action"), query.Get("resource")
+	if role == "" || action == "" || resource == "" {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("role, action and resource are required")}
+	}
+	m, err := findInstance(query.Get("source"))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	decision := m.check(role, action, resource)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(decision)
+}
+
+// rolesStatus tracks the loading of the roles of a middleware, safe for
+// concurrent use
+type rolesStatus struct {
+	mu       sync.Mutex
+	loadedAt time.Time
+	// err is the error of the last load, nil if it succeeded
+	err      error
+	failedAt time.Time
+}
+
+// loaded records a successful load of the roles
+func (s *rolesStatus) loaded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadedAt, s.err = time.Now(), nil
+}
+
+// failed records a failed load of the roles, the previous ones being kept
+func (s *rolesStatus) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err, s.failedAt = err, time.Now()
+}
+
+// statusResponse is the body of /rbac/status responses
+type statusResponse struct {
+	Source    string     `json:"source"`
+	Roles     int        `json:"roles"`
+	LoadedAt  time.Time  `json:"loaded_at"`
+	LastError string     `json:"last_error,omitempty"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+}
+
+// handleStatus reports the roles loaded by a middleware, and the error of
+// the last reload if it failed, in which case the status is 503, e.g.
+// GET /rbac/status
+func (adminAPI) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	m, err := findInstance(r.URL.Query().Get("source"))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	m.status.mu.Lock()
+	status := statusResponse{Source: m.sourceName(), Roles: len(m.getRoles()), LoadedAt: m.status.loadedAt}
+	if m.status.err != nil {
+		failedAt := m.status.failedAt
+		status.LastError, status.FailedAt = m.status.err.Error(), &failedAt
+	}
+	m.status.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.LastError != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(status)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
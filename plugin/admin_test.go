@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const adminRoles = `{
+	"reader": [{ "action": "list", "resource": "*" }],
+	"writer": [
+		{ "action": "*", "resource": "posts" },
+		{ "action": "delete", "resource": "posts", "type": "deny" }
+	]
+}`
+
+// callAdmin calls an admin API handler, returning the recorded response and
+// the status of the returned API error, if any
+func callAdmin(handler caddy.AdminHandlerFunc, method, target string) (*httptest.ResponseRecorder, int) {
+	rec := httptest.NewRecorder()
+	err := handler(rec, httptest.NewRequest(method, target, nil))
+	var apiErr caddy.APIError
+	if errors.As(err, &apiErr) {
+		return rec, apiErr.HTTPStatus
+	}
+	return rec, rec.Code
+}
+
+func TestAdminCheck(t *testing.T) {
+	provision(t, &Middleware{
+		RolesFilePath: "admin-check.json",
+		GlobalDeny:    []Permission{{Type: "deny", Action: parseAction("*"), Resource: "secrets"}},
+	}, adminRoles)
+
+	tests := []struct {
+		name    string
+		method  string
+		query   url.Values
+		status  int
+		allowed bool
+	}{
+		{"allowed", "GET", url.Values{"role": {"reader"}, "action": {"list"}, "resource": {"posts"}}, http.StatusOK, true},
+		{"not allowed", "GET", url.Values{"role": {"reader"}, "action": {"edit"}, "resource": {"posts"}}, http.StatusOK, false},
+		{"denied", "GET", url.Values{"role": {"writer"}, "action": {"delete"}, "resource": {"posts"}}, http.StatusOK, false},
+		{"global deny", "GET", url.Values{"role": {"reader"}, "action": {"list"}, "resource": {"secrets"}}, http.StatusOK, false},
+		{"unknown role", "GET", url.Values{"role": {"guest"}, "action": {"list"}, "resource": {"posts"}}, http.StatusOK, false},
+		{"source", "GET", url.Values{"role": {"writer"}, "action": {"edit"}, "resource": {"posts"}, "source": {"admin-check.json"}}, http.StatusOK, true},
+		{"unknown source", "GET", url.Values{"role": {"writer"}, "action": {"edit"}, "resource": {"posts"}, "source": {"other.json"}}, http.StatusBadRequest, false},
+		{"missing resource", "GET", url.Values{"role": {"reader"}, "action": {"list"}}, http.StatusBadRequest, false},
+		{"not a GET", "POST", url.Values{"role": {"reader"}, "action": {"list"}, "resource": {"posts"}}, http.StatusMethodNotAllowed, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec, status := callAdmin(adminAPI{}.handleCheck, test.method, "/rbac/check?"+test.query.Encode())
+			if status != test.status {
+				t.Fatalf("got status %d, want %d", status, test.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			var decision Decision
+			if err := json.NewDecoder(rec.Body).Decode(&decision); err != nil {
+				t.Fatalf("decoding decision: %v", err)
+			}
+			if decision.Allowed != test.allowed {
+				t.Errorf("got allowed %v, want %v (%s)", decision.Allowed, test.allowed, decision.Reason)
+			}
+		})
+	}
+}
+
+func TestAdminCheckSeveralHandlers(t *testing.T) {
+	provision(t, &Middleware{RolesFilePath: "first.json"}, adminRoles)
+	provision(t, &Middleware{RolesFilePath: "second.json"}, `{"reader": []}`)
+
+	query := "/rbac/check?role=reader&action=list&resource=posts"
+	if _, status := callAdmin(adminAPI{}.handleCheck, "GET", query); status != http.StatusBadRequest {
+		t.Errorf("without source: got status %d, want %d", status, http.StatusBadRequest)
+	}
+	for source, allowed := range map[string]bool{"first.json": true, "second.json": false} {
+		rec, status := callAdmin(adminAPI{}.handleCheck, "GET", query+"&source="+source)
+		if status != http.StatusOK {
+			t.Fatalf("source %s: got status %d", source, status)
+		}
+		var decision Decision
+		if err := json.NewDecoder(rec.Body).Decode(&decision); err != nil {
+			t.Fatalf("decoding decision: %v", err)
+		}
+		if decision.Allowed != allowed {
+			t.Errorf("source %s: got allowed %v, want %v", source, decision.Allowed, allowed)
+		}
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	path := writeRolesFile(t, "status.json", []byte(adminRoles))
+	provision(t, &Middleware{RolesFilePath: path, RolesRefresh: caddy.Duration(10 * time.Millisecond)}, "")
+
+	// status waits for the status of the middleware to have the wanted HTTP
+	// status, as the roles are reloaded in the background
+	status := func(want int) statusResponse {
+		t.Helper()
+		var res statusResponse
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			rec, code := callAdmin(adminAPI{}.handleStatus, "GET", "/rbac/status?source="+url.QueryEscape(path))
+			if code == want {
+				if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+					t.Fatalf("decoding status: %v", err)
+				}
+				return res
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got status %d, want %d", code, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	loaded := status(http.StatusOK)
+	if loaded.Source != path || loaded.Roles != 2 || loaded.LoadedAt.IsZero() || loaded.LastError != "" || loaded.FailedAt != nil {
+		t.Errorf("got status %+v after a successful load", loaded)
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	failed := status(http.StatusServiceUnavailable)
+	if failed.Roles != 2 || failed.LastError == "" || failed.FailedAt == nil {
+		t.Errorf("got status %+v after a failed reload", failed)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"reader": []}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := status(http.StatusOK)
+	if reloaded.Roles != 1 || !reloaded.LoadedAt.After(loaded.LoadedAt) || reloaded.LastError != "" {
+		t.Errorf("got status %+v after a successful reload", reloaded)
+	}
+
+	if _, code := callAdmin(adminAPI{}.handleStatus, "POST", "/rbac/status?source="+url.QueryEscape(path)); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if _, code := callAdmin(adminAPI{}.handleStatus, "GET", "/rbac/status?source=other.json"); code != http.StatusBadRequest {
+		t.Errorf("unknown source: got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
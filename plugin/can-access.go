@@ -1,62 +1,599 @@
 package plugin
 
 import (
+	"cmp"
+	"net/http"
+	"slices"
 	"strings"
+
+	"github.com/caddyserver/caddy/v2"
 )
 
-// canAccessWithPermissions checks if permissions allow the given action on the given resource
-func canAccessWithPermissions(permissions []Permission, action, resource string) bool {
+// target describes what a request is trying to access
+type target struct {
+	action string
+	// method is the HTTP method of the request, e.g. "DELETE"
+	method   string
+	resource string
+	// record is the record ID, empty for collection requests
+	record string
+	// tenant is the tenant ID, empty unless tenants are configured
+	tenant string
+	// host is the host of the request, without its port
+	host string
+	// path is the normalized request path, e.g. "/rpc/reindexSearch"
+	path string
+	// request is the evaluated request, for conditions on its headers
+	request *http.Request
+	// body gives access to the JSON request body, for body conditions
+	body *requestBody
+	// scope narrows the action: the field referencing the parent record in
+	// reference requests, e.g. "post_id" for /comments?post_id=1, or the
+	// verb of invocations, e.g. "refund" for POST /orders/5/refund
+	scope string
+	// repl resolves the placeholders of resource patterns, nil if there is
+	// no request
+	repl *caddy.Replacer
+}
+
+// Decision is the outcome of the evaluation of permissions against a target
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// MatchedPermission is the permission which decided, nil if none matched
+	MatchedPermission *Permission `json:"matched_permission,omitempty"`
+	// Reason explains the decision, using the permission reason if any
+	Reason string `json:"reason,omitempty"`
+}
+
+// Can decides whether a role can perform an action on a resource, according
+// to the role definitions as read from a roles file, with the default
+// options and evaluation order. Conditions on the request (e.g. on its body
+// or headers) are evaluated as if the request had none.
+func Can(roles RoleDefinitions, role, action, resource string) Decision {
+	return CanWithOrder(roles, role, action, resource, DenyWins)
+}
+
+// CanWithOrder is Can with an evaluation order. The roles are prepared as
+// when the middleware loads them (action groups, for_each templates,
+// environment variables), then evaluated like requests are, so it is meant
+// for tests and tools rather than for deciding many requests.
+func CanWithOrder(roles RoleDefinitions, role, action, resource string, order EvaluationOrder) Decision {
+	prepared, err := (&Middleware{}).prepareRoles(roles)
+	if err != nil {
+		return Decision{Allowed: false, Reason: err.Error()}
+	}
+	p := &rolePolicy{roles: prepared, order: order}
+	decision, exists := p.decide(role, target{action: action, resource: resource, path: "/" + resource})
+	if !exists {
+		return Decision{Allowed: false, Reason: "role not found"}
+	}
+	return decision
+}
+
+// Decide tells whether a role can perform an action on a resource, according
+// to the role definitions, and which permission decided, nil if none
+// matched. It is the decision of Can, for callers which don't need the reason.
+func Decide(roles RoleDefinitions, role, action, resource string) (allowed bool, matched *Permission) {
+	decision := Can(roles, role, action, resource)
+	return decision.Allowed, decision.MatchedPermission
+}
+
+// newDecision builds the decision made by a matched permission
+func newDecision(permission *Permission) Decision {
+	d := Decision{Allowed: permission.Type != "deny", MatchedPermission: permission, Reason: permission.Reason}
+	if d.Reason == "" && !d.Allowed {
+		d.Reason = "matched a deny rule"
+	}
+	return d
+}
+
+// defaultDeny is the decision made when no permission matches
+var defaultDeny = Decision{Allowed: false, Reason: "no permission matches"}
+
+// EvaluationOrder tells how conflicts between matching allow and deny
+// permissions are resolved
+type EvaluationOrder string
+
+const (
+	// DenyWins denies access when any deny permission matches (default)
+	DenyWins EvaluationOrder = "deny_wins"
+	// MostSpecificWins lets the matching permission with the most specific
+	// resource pattern, then record pattern, decide, deny permissions winning
+	// ties
+	MostSpecificWins EvaluationOrder = "most_specific_wins"
+	// Ordered lets the first matching permission decide, whether it allows
+	// or denies, like firewall rules
+	Ordered EvaluationOrder = "ordered"
+	// Sequential is another name of Ordered, familiar to nginx and Apache
+	// users
+	Sequential EvaluationOrder = "sequential"
+)
+
+// valid checks if an evaluation order is known, empty being the default
+func (o EvaluationOrder) valid() bool {
+	switch o {
+	case "", DenyWins, MostSpecificWins, Ordered, Sequential:
+		return true
+	}
+	return false
+}
+
+// canAccessWithPermissions checks if permissions allow the target action on the target resource
+func canAccessWithPermissions(permissions []Permission, t target) bool {
+	return evaluatePermissions(permissions, t, DenyWins).Allowed
+}
+
+// evaluatePermissions decides whether permissions allow the target action on
+// the target resource, and which permission made the decision. Permissions
+// are evaluated by decreasing priority: the permissions of a priority are
+// only considered when no permission of a higher priority matches.
+func evaluatePermissions(permissions []Permission, t target, order EvaluationOrder) Decision {
 	if len(permissions) == 0 {
-		return false
+		return defaultDeny
 	}
-	
-	// If one deny permission matches, return false
-	for _, permission := range permissions {
-		if permission.Type == "deny" && matchTarget(permission, resource, action) {
-			return false
+
+	// Evaluate the priorities from the highest down
+	highest := slices.MaxFunc(permissions, func(a, b Permission) int { return cmp.Compare(a.Priority, b.Priority) }).Priority
+	for priority, ok := highest, true; ok; priority, ok = nextPriority(permissions, priority) {
+		if decision, ok := evaluatePriority(permissions, t, order, priority); ok {
+			return decision
 		}
 	}
-	
-	// If one allow permission matches, return true
+
+	return defaultDeny
+}
+
+// evaluatePriority decides whether the permissions of a priority allow the
+// target action on the target resource, and returns false if none matches
+func evaluatePriority(permissions []Permission, t target, order EvaluationOrder, priority int) (Decision, bool) {
+	if order == Ordered || order == Sequential {
+		for i, permission := range permissions {
+			if permission.Priority == priority && !permission.isAudit() && matchTarget(permission, t) {
+				return newDecision(&permissions[i]), true
+			}
+		}
+		return Decision{}, false
+	}
+
+	deny, denySpecificity := mostSpecificMatch(permissions, t, true, priority)
+	if order == MostSpecificWins {
+		allow, allowSpecificity := mostSpecificMatch(permissions, t, false, priority)
+		if allow >= 0 && allowSpecificity.compare(denySpecificity) > 0 {
+			return newDecision(&permissions[allow]), true
+		}
+	}
+
+	// If one deny permission matches, deny access
+	if deny >= 0 {
+		return newDecision(&permissions[deny]), true
+	}
+
+	// If one allow permission matches, allow access
+	if allow, _ := mostSpecificMatch(permissions, t, false, priority); allow >= 0 {
+		return newDecision(&permissions[allow]), true
+	}
+
+	return Decision{}, false
+}
+
+// nextPriority returns the highest priority of permissions below a
+// priority, or false if there is none. Priorities are found by scanning the
+// permissions rather than collected in a slice, so that evaluating them
+// allocates nothing.
+func nextPriority(permissions []Permission, below int) (int, bool) {
+	next, found := 0, false
 	for _, permission := range permissions {
-		if permission.Type != "deny" && matchTarget(permission, resource, action) {
-			return true
+		if permission.Priority < below && (!found || permission.Priority > next) {
+			next, found = permission.Priority, true
 		}
 	}
-	
-	return false
+	return next, found
+}
+
+// mostSpecificMatch returns the index and the specificity of the deny (or
+// allow) permission of a priority matching the target with the most specific
+// resource and record patterns, the first one winning ties, or -1 if none
+// matches
+func mostSpecificMatch(permissions []Permission, t target, deny bool, priority int) (int, specificity) {
+	best, bestSpecificity := -1, specificity{-1, -1}
+	for i, permission := range permissions {
+		if permission.Priority != priority || permission.isAudit() || (permission.Type == "deny") != deny || !matchTarget(permission, t) {
+			continue
+		}
+		if s := permission.specificity(t.action); s.compare(bestSpecificity) > 0 {
+			best, bestSpecificity = i, s
+		}
+	}
+	return best, bestSpecificity
+}
+
+// specificity ranks how specific a permission is: by its resource pattern
+// first, then by its record pattern
+type specificity struct {
+	resource int
+	record   int
+}
+
+// compare returns a positive number if s is more specific than other, a
+// negative one if it is less specific, and 0 if they rank the same
+func (s specificity) compare(other specificity) int {
+	if s.resource != other.resource {
+		return cmp.Compare(s.resource, other.resource)
+	}
+	return cmp.Compare(s.record, other.record)
+}
+
+// specificity returns the specificity of a permission for an action,
+// splitting resource patterns with a record part, e.g. "users/me"
+func (p Permission) specificity(action string) specificity {
+	pattern, _ := p.resourcePattern(action)
+	record := p.Record
+	if !strings.HasPrefix(pattern, "!") && !strings.HasPrefix(pattern, "path:") {
+		if resourcePattern, recordPattern, ok := strings.Cut(pattern, "/"); ok {
+			pattern, record = resourcePattern, recordPattern
+		}
+	}
+	return specificity{resourceSpecificity(pattern), recordSpecificity(record)}
+}
+
+// exactSpecificity is the specificity of exact resource patterns, above the
+// specificity of any prefix pattern
+const exactSpecificity = 1 << 20
+
+// recordSpecificity ranks how specific a record pattern is: exact IDs come
+// first, then prefix patterns by decreasing prefix length, then numeric
+// conditions, then "*", and finally no record pattern at all, which also
+// matches collection requests
+func recordSpecificity(pattern string) int {
+	switch {
+	case pattern == "":
+		return 0
+	case pattern == "*":
+		return 1
+	}
+	if _, ok, _ := parseNumericRange(pattern); ok {
+		return 2
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return 3 + len(prefix)
+	}
+	return exactSpecificity + len(pattern)
+}
+
+// resourceSpecificity ranks how specific a resource pattern is: exact names
+// come first, then prefix patterns by decreasing prefix length, then "*".
+// Negated patterns match almost anything, and rank with "*".
+func resourceSpecificity(pattern string) int {
+	if strings.HasPrefix(pattern, "!") {
+		return 0
+	}
+	pattern = strings.TrimPrefix(pattern, "path:")
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return len(prefix)
+	}
+	return exactSpecificity + len(pattern)
 }
 
 // matchTarget checks if a permission matches a target (action, resource)
-func matchTarget(permission Permission, resource, action string) bool {
-	// Check resource match (with wildcard support)
-	if !matchWildcard(permission.Resource, resource) {
+func matchTarget(permission Permission, t target) bool {
+	// Check resource match (with wildcard and negation support)
+	pattern, ok := permission.resourcePattern(t.action)
+	if !ok || !matchResource(pattern, t, permission.ranges) {
+		return false
+	}
+
+	// Check action match, unless the permission only targets a method
+	hasAction := permission.Action.Single != nil || permission.Action.Multiple != nil
+	if (hasAction || permission.Method == "") && !matchAction(permission.Action, t.scopedAction()) {
+		return false
+	}
+
+	// Check method match, if the permission targets a method
+	if permission.Method != "" && permission.Method != "*" && !strings.EqualFold(permission.Method, t.method) {
+		return false
+	}
+
+	// Check record match (with wildcard, placeholder and numeric condition
+	// support), if scoped to records
+	if permission.Record != "" && !matchRecord(permission.Record, t, permission.ranges) {
+		return false
+	}
+
+	// Check tenant match (with wildcard and placeholder support), if scoped
+	// to tenants
+	if permission.Tenant != "" && !matchPattern(permission.Tenant, t.tenant, t) {
+		return false
+	}
+
+	// Check host match (with wildcard and placeholder support), if scoped
+	// to hosts
+	if permission.Host != "" && !matchHost(permission.Host, t) {
+		return false
+	}
+
+	// Check header conditions
+	if permission.When != nil && !matchHeaders(permission.When, t) {
 		return false
 	}
-	
+
+	// Check query conditions
+	if permission.Query != nil && !matchQuery(permission.Query, t) {
+		return false
+	}
+
+	// Check content type condition
+	if permission.ContentType != "" && !matchAccept(permission.ContentType, t.accept()) {
+		return false
+	}
+
+	// Check body condition, which is the most expensive one
+	if permission.BodyMatch != nil && !matchBody(*permission.BodyMatch, t) {
+		return false
+	}
+
+	return true
+}
+
+// scopedAction returns the action, followed by its scope if any, e.g.
+// "get_many_reference:post_id" or "invoke:refund"
+func (t target) scopedAction() string {
+	if t.scope == "" {
+		return t.action
+	}
+	return t.action + ":" + t.scope
+}
+
+// actionMatches checks if an action of a permission matches an action. A
+// scoped action (e.g. "get_many_reference:post_id") is matched both by the
+// same scoped action and by the action alone (e.g. "get_many_reference").
+func actionMatches(a, action string) bool {
+	if a == "*" || a == action {
+		return true
+	}
+	base, _, scoped := strings.Cut(action, ":")
+	return scoped && a == base
+}
+
+// matchAction checks if the actions of a permission match an action
+func matchAction(actions ActionType, action string) bool {
 	// If action is empty or wildcard, always match
 	if action == "" || action == "*" {
 		return true
 	}
-	
-	// Check action match
-	if permission.Action.Multiple != nil {
-		// Multiple actions case
-		for _, a := range permission.Action.Multiple {
-			if a == "*" || a == action {
-				return true
+
+	if actions.Multiple != nil {
+		// Multiple actions case, where negated actions (e.g. "!delete") take
+		// precedence, and a list of negated actions only excludes them from
+		// all actions
+		matched, onlyNegated := false, true
+		for _, a := range actions.Multiple {
+			if negated, ok := strings.CutPrefix(a, "!"); ok {
+				if actionMatches(negated, action) {
+					return false
+				}
+				continue
+			}
+			onlyNegated = false
+			if actionMatches(a, action) {
+				matched = true
 			}
 		}
-		return false
-	} else if permission.Action.Single != nil {
+		return matched || onlyNegated
+	} else if actions.Single != nil {
 		// Single action case
-		return *permission.Action.Single == "*" || *permission.Action.Single == action
+		if negated, ok := strings.CutPrefix(*actions.Single, "!"); ok {
+			return !actionMatches(negated, action)
+		}
+		return actionMatches(*actions.Single, action)
+	}
+
+	return false
+}
+
+// accept returns the Accept header of the target request
+func (t target) accept() string {
+	if t.request == nil {
+		return ""
+	}
+	return t.request.Header.Get("Accept")
+}
+
+// matchAccept checks if an Accept header admits a content type pattern (e.g.
+// "text/csv" or "application/*"). A missing Accept header admits anything.
+func matchAccept(pattern, accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+	pattern = strings.ToLower(pattern)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaRange, _, _ = strings.Cut(mediaRange, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+		if matchWildcard(pattern, mediaRange) || matchMediaRange(mediaRange, pattern) {
+			return true
+		}
 	}
-	
 	return false
 }
 
-// matchWildcard checks if a pattern matches a resource with wildcard support
+// matchMediaRange checks if an Accept media range (e.g. "text/*") covers a
+// content type
+func matchMediaRange(mediaRange, contentType string) bool {
+	if mediaRange == "*/*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(mediaRange, "/*"); ok {
+		return strings.HasPrefix(contentType, prefix+"/")
+	}
+	return mediaRange == contentType
+}
+
+// matchHeaders checks if the request headers match all the header patterns
+// (with wildcard and placeholder support) of a condition. Missing headers
+// never match.
+func matchHeaders(patterns map[string]string, t target) bool {
+	if t.request == nil {
+		return false
+	}
+	for header, pattern := range patterns {
+		values, ok := t.request.Header[http.CanonicalHeaderKey(header)]
+		if !ok || len(values) == 0 || !matchPattern(pattern, values[0], t) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchQuery checks if the query parameters of the request match all the
+// patterns (with wildcard and placeholder support) of a condition. Missing
+// parameters never match, and repeated parameters only match if all their
+// values do, so that a role can't widen its scope by adding values.
+func matchQuery(patterns map[string]string, t target) bool {
+	if t.request == nil {
+		return false
+	}
+	query := t.request.URL.Query()
+	for param, pattern := range patterns {
+		values, ok := query[param]
+		if !ok || len(values) == 0 {
+			return false
+		}
+		for _, value := range values {
+			if !matchPattern(pattern, value, t) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchBody checks if the request body has the expected value at the
+// expected path. Missing, oversized or invalid bodies never match.
+func matchBody(condition BodyMatch, t target) bool {
+	body, ok := t.body.get()
+	if !ok {
+		return false
+	}
+	value, ok := lookupJSONPath(body, condition.Path)
+	if !ok {
+		return false
+	}
+	return matchPattern(condition.Value, value, t)
+}
+
+// patternShorthands maps the shorthands patterns can use to the placeholders
+// of the request they stand for
+var patternShorthands = strings.NewReplacer(
+	"{record}", "{http.rbac.record}",
+	"{resource}", "{http.rbac.resource}",
+	"{tenant}", "{http.rbac.tenant}",
+)
+
+// resolvePattern resolves the placeholders of a pattern for a target,
+// including the {tenant}, {record} and {resource} shorthands, in a single
+// pass, so that placeholders in the values are left as is. It returns false
+// if a placeholder is unknown or empty. As the values of the placeholders
+// come from the request, the result must be matched literally.
+func resolvePattern(pattern string, t target) (string, bool) {
+	if !strings.Contains(pattern, "{") {
+		return pattern, true
+	}
+	// Patterns only referring to the tenant don't need the replacer, e.g.
+	// when deciding outside of a request
+	if rest := strings.ReplaceAll(pattern, "{tenant}", ""); !strings.Contains(rest, "{") {
+		if t.tenant == "" {
+			return "", false
+		}
+		return strings.ReplaceAll(pattern, "{tenant}", t.tenant), true
+	}
+	// Patterns with unknown or empty placeholders match nothing, rather
+	// than matching more than intended
+	if t.repl == nil {
+		return "", false
+	}
+	resolved, err := t.repl.ReplaceOrErr(patternShorthands.Replace(pattern), true, true)
+	return resolved, err == nil
+}
+
+// resolveWildcard resolves the placeholders of a wildcard pattern for a
+// target, without its trailing wildcard, and tells whether the pattern is a
+// prefix one. Only the wildcard written in the pattern counts: the values of
+// the placeholders are matched literally, so that a request can't widen a
+// pattern by sending "*". It returns false if a placeholder is unknown or
+// empty.
+func resolveWildcard(pattern string, t target) (string, bool, bool) {
+	prefix, isPrefix := strings.CutSuffix(pattern, "*")
+	if prefix == "" {
+		return "", isPrefix, isPrefix || pattern == ""
+	}
+	resolved, ok := resolvePattern(prefix, t)
+	return resolved, isPrefix, ok
+}
+
+// matchPattern checks if a pattern, once its placeholders are resolved,
+// matches a value with wildcard support
+func matchPattern(pattern, value string, t target) bool {
+	resolved, isPrefix, ok := resolveWildcard(pattern, t)
+	if !ok {
+		return false
+	}
+	if isPrefix {
+		return strings.HasPrefix(value, resolved)
+	}
+	return value == resolved
+}
+
+// matchHost checks if a host pattern matches the host of the target, case
+// insensitively. Besides the patterns supported by matchWildcard, patterns
+// starting with "*." match any subdomain, e.g. "*.example.com".
+func matchHost(pattern string, t target) bool {
+	host := strings.ToLower(t.host)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		suffix, ok := resolvePattern(suffix, t)
+		return ok && strings.HasSuffix(host, "."+strings.ToLower(suffix))
+	}
+	resolved, isPrefix, ok := resolveWildcard(pattern, t)
+	if !ok {
+		return false
+	}
+	if isPrefix {
+		return strings.HasPrefix(host, strings.ToLower(resolved))
+	}
+	return host == strings.ToLower(resolved)
+}
+
+// matchResource checks if a resource pattern matches the target, supporting
+// negated patterns such as "!audit_logs" or "!internal_*", and patterns
+// prefixed with "path:" which match the whole request path, e.g. "path:/rpc/*".
+// Patterns with a slash, e.g. "posts/5" or "posts/archive_*", match the
+// resource and the record of item requests.
+//
+// The structure of a pattern (negation, path or record part, wildcard) comes
+// from the pattern as written, the values of its placeholders being matched
+// literally.
+func matchResource(pattern string, t target, ranges map[string]numericRange) bool {
+	if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+		// Unresolvable negated patterns match nothing either
+		if _, ok := resolvePattern(negated, t); !ok {
+			return false
+		}
+		return !matchResource(negated, t, ranges)
+	}
+	if pathPattern, ok := strings.CutPrefix(pattern, "path:"); ok {
+		return matchPattern(pathPattern, t.path, t)
+	}
+	if resourcePattern, recordPattern, ok := strings.Cut(pattern, "/"); ok {
+		return t.record != "" && matchPattern(resourcePattern, t.resource, t) && matchRecord(recordPattern, t, ranges)
+	}
+	return matchPattern(pattern, t.resource, t)
+}
+
+// matchWildcard checks if a pattern matches a resource with wildcard support.
+// Like matchPattern, it matches exact names and prefixes without compiling
+// them: only numeric record conditions need parsing, and prepareRoles parses
+// them once. Static patterns are thus matched without allocating, which
+// TestStaticPatternsDontAllocate checks. Should patterns ever need compiling
+// (e.g. regular expressions), they must be compiled in prepareRoles too,
+// rather than for each request.
 func matchWildcard(pattern, resource string) bool {
 	if pattern == "*" {
 		return true
@@ -0,0 +1,642 @@
+package plugin
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestPlaceholderValuesMatchLiterally(t *testing.T) {
+	m := provision(t, &Middleware{TenantSegment: intPtr(1)}, `{
+		"member": [
+			{ "action": ["show", "delete"], "resource": "users", "record": "{http.request.header.X-User}" },
+			{ "action": "list", "resource": "{http.request.header.X-Resource}" },
+			{ "action": "show", "resource": "{tenant}_reports" },
+			{ "action": "edit", "resource": "posts", "record": "<={http.request.header.X-Max}" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"DELETE", "/t/acme/users/42", []string{"X-Role", "member", "X-User", "42"}, http.StatusOK},
+		{"DELETE", "/t/acme/users/42", []string{"X-Role", "member", "X-User", "*"}, http.StatusForbidden},
+		{"DELETE", "/t/acme/users/42", []string{"X-Role", "member", "X-User", "4*"}, http.StatusForbidden},
+		{"GET", "/t/acme/comments", []string{"X-Role", "member", "X-Resource", "comments"}, http.StatusOK},
+		{"GET", "/t/acme/comments", []string{"X-Role", "member", "X-Resource", "*"}, http.StatusForbidden},
+		{"GET", "/t/acme/comments", []string{"X-Role", "member", "X-Resource", "!posts"}, http.StatusForbidden},
+		{"GET", "/t/acme/comments", []string{"X-Role", "member", "X-Resource", "path:/*"}, http.StatusForbidden},
+		{"GET", "/t/acme/acme_reports/1", []string{"X-Role", "member"}, http.StatusOK},
+		{"GET", "/t/*/acme_reports/1", []string{"X-Role", "member"}, http.StatusForbidden},
+		{"GET", "/t/{env.HOME}/acme_reports/1", []string{"X-Role", "member"}, http.StatusForbidden},
+		{"PUT", "/t/acme/posts/5", []string{"X-Role", "member", "X-Max", "10"}, http.StatusOK},
+		{"PUT", "/t/acme/posts/50", []string{"X-Role", "member", "X-Max", "10"}, http.StatusForbidden},
+		{"PUT", "/t/acme/posts/50", []string{"X-Role", "member", "X-Max", "*"}, http.StatusForbidden},
+		{"PUT", "/t/acme/posts/50", []string{"X-Role", "member", "X-Max", "1..100"}, http.StatusForbidden},
+	})
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestMostSpecificWinsRanksRecords(t *testing.T) {
+	m := provision(t, &Middleware{EvaluationOrder: MostSpecificWins}, `{
+		"user": [
+			{ "type": "deny", "action": "show", "resource": "users", "record": "*" },
+			{ "action": "show", "resource": "users", "record": "me" },
+			{ "type": "deny", "action": "show", "resource": "posts/draft*" },
+			{ "action": "show", "resource": "posts/draft_42" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/users/me", []string{"X-Role", "user"}, http.StatusOK},
+		{"GET", "/users/5", []string{"X-Role", "user"}, http.StatusForbidden},
+		{"GET", "/posts/draft_42", []string{"X-Role", "user"}, http.StatusOK},
+		{"GET", "/posts/draft_43", []string{"X-Role", "user"}, http.StatusForbidden},
+	})
+}
+
+func TestDecide(t *testing.T) {
+	roles := parseRoles(t, `{
+		"writer": [
+			{ "action": "crud", "resource": "posts" },
+			{ "type": "deny", "action": "delete", "resource": "posts" },
+			{ "action": "show", "resource": "{{.}}", "for_each": ["tags", "categories"] }
+		],
+		"tenant-*-reader": [{ "action": "list", "resource": "*" }]
+	}`)
+	tests := []struct {
+		role, action, resource string
+		allowed                bool
+	}{
+		{"writer", "edit", "posts", true},
+		{"writer", "list", "posts", true},
+		{"writer", "delete", "posts", false},
+		{"writer", "edit", "comments", false},
+		{"writer", "show", "tags", true},
+		{"writer", "show", "categories", true},
+		{"tenant-42-reader", "list", "comments", true},
+		{"tenant-42-reader", "show", "comments", false},
+		{"guest", "list", "posts", false},
+	}
+	for _, test := range tests {
+		if allowed, _ := Decide(roles, test.role, test.action, test.resource); allowed != test.allowed {
+			t.Errorf("Decide(%s, %s, %s) = %v, want %v", test.role, test.action, test.resource, allowed, test.allowed)
+		}
+	}
+	if _, matched := Decide(roles, "writer", "delete", "posts"); matched == nil || matched.Type != "deny" {
+		t.Errorf("got matched permission %+v, want the deny rule", matched)
+	}
+	if roles["writer"][0].Action.Single == nil || *roles["writer"][0].Action.Single != "crud" {
+		t.Errorf("the roles of the caller were modified: %+v", roles["writer"][0].Action)
+	}
+	if decision := Can(roles, "guest", "list", "posts"); decision.Reason != "role not found" {
+		t.Errorf("got reason %q, want role not found", decision.Reason)
+	}
+}
+
+func TestCanWithOrder(t *testing.T) {
+	roles := parseRoles(t, `{
+		"user": [
+			{ "type": "deny", "action": "show", "resource": "users*" },
+			{ "action": "show", "resource": "users" }
+		]
+	}`)
+	if Can(roles, "user", "show", "users").Allowed {
+		t.Error("deny_wins: got allowed, want denied")
+	}
+	if !CanWithOrder(roles, "user", "show", "users", MostSpecificWins).Allowed {
+		t.Error("most_specific_wins: got denied, want allowed")
+	}
+}
+
+// staticRoles are roles without placeholders, whose patterns are matched
+// without being compiled per request
+const staticRoles = `{
+	"editor": [
+		{ "type": "deny", "action": "*", "resource": "!posts*" },
+		{ "action": ["list", "show"], "resource": "posts" },
+		{ "action": "edit", "resource": "posts_archive*", "record": "archive_*" },
+		{ "action": "edit", "resource": "posts", "record": "1..1000" },
+		{ "action": "delete", "resource": "posts/<100" },
+		{ "action": "show", "resource": "path:/posts/*" }
+	]
+}`
+
+func TestStaticPatternsDontAllocate(t *testing.T) {
+	rd, err := (&Middleware{}).prepareRoles(parseRoles(t, staticRoles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions := rd["editor"]
+	targets := []target{
+		{action: "edit", resource: "posts", record: "500", path: "/posts/500"},
+		{action: "edit", resource: "posts_archive_2020", record: "archive_1", path: "/posts_archive_2020/archive_1"},
+		{action: "delete", resource: "posts", record: "99", path: "/posts/99"},
+		{action: "delete", resource: "comments", record: "1", path: "/comments/1"},
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, target := range targets {
+			evaluatePermissions(permissions, target, DenyWins)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per evaluation, want 0", allocs)
+	}
+}
+
+func BenchmarkEvaluateStaticPermissions(b *testing.B) {
+	rd, err := (&Middleware{}).prepareRoles(parseRoles(b, staticRoles))
+	if err != nil {
+		b.Fatal(err)
+	}
+	permissions := rd["editor"]
+	t := target{action: "edit", resource: "posts", record: "500", path: "/posts/500"}
+	b.ReportAllocs()
+	for b.Loop() {
+		evaluatePermissions(permissions, t, DenyWins)
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	roles := parseRoles(t, `{
+		"editor": [
+			{ "type": "deny", "action": "delete", "resource": "posts" },
+			{ "action": "delete", "resource": "posts", "record": "draft_*", "priority": 10 },
+			{ "type": "deny", "action": "delete", "resource": "posts", "record": "draft_locked", "priority": 20 },
+			{ "action": "delete", "resource": "comments", "priority": -5 }
+		]
+	}`)
+	tests := []struct {
+		action, resource string
+		allowed          bool
+	}{
+		{"delete", "posts", false},
+		{"delete", "comments", true},
+	}
+	for _, test := range tests {
+		if allowed, _ := Decide(roles, "editor", test.action, test.resource); allowed != test.allowed {
+			t.Errorf("Decide(%s, %s) = %v, want %v", test.action, test.resource, allowed, test.allowed)
+		}
+	}
+	m := provision(t, &Middleware{}, `{
+		"editor": [
+			{ "type": "deny", "action": "delete", "resource": "posts" },
+			{ "action": "delete", "resource": "posts", "record": "draft_*", "priority": 10 },
+			{ "type": "deny", "action": "delete", "resource": "posts", "record": "draft_locked", "priority": 20 }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"DELETE", "/posts/draft_1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts/draft_locked", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"DELETE", "/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+	})
+}
+
+func TestNextPriority(t *testing.T) {
+	permissions := []Permission{{Priority: 10}, {}, {Priority: -5}, {Priority: 10}, {Priority: 3}}
+	tests := []struct {
+		below, next int
+		found       bool
+	}{
+		{math.MaxInt, 10, true},
+		{10, 3, true},
+		{3, 0, true},
+		{0, -5, true},
+		{-5, 0, false},
+	}
+	for _, test := range tests {
+		if next, found := nextPriority(permissions, test.below); next != test.next || found != test.found {
+			t.Errorf("below %d: got %d, %v, want %d, %v", test.below, next, found, test.next, test.found)
+		}
+	}
+}
+
+func TestPrioritiesApplyToEveryOrder(t *testing.T) {
+	// The README example: the featured post can be edited, unlike the others
+	roles := parseRoles(t, `{
+		"editor": [
+			{ "type": "deny", "action": "edit", "resource": "posts" },
+			{ "action": "edit", "resource": "posts", "record": "featured", "priority": 10 },
+			{ "action": "*", "resource": "*" }
+		]
+	}`)
+	for _, order := range []EvaluationOrder{DenyWins, MostSpecificWins, Ordered, Sequential} {
+		tests := []struct {
+			record  string
+			allowed bool
+		}{
+			{"featured", true},
+			{"1", false},
+		}
+		for _, test := range tests {
+			req := target{action: "edit", resource: "posts", record: test.record, path: "/posts/" + test.record}
+			if decision, _ := (&rolePolicy{roles: roles, order: order}).decide("editor", req); decision.Allowed != test.allowed {
+				t.Errorf("%s, record %s: got %v, want %v", order, test.record, decision.Allowed, test.allowed)
+			}
+		}
+	}
+}
+
+func TestPreparedRangesMatchLikeParsing(t *testing.T) {
+	for _, pattern := range []string{"<10", "<=10", ">10", ">=10", "5..15", "-3..3"} {
+		ranges := map[string]numericRange{}
+		numeric, _, err := parseNumericRange(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges[pattern] = numeric
+		for _, record := range []string{"-4", "-3", "0", "4", "5", "9", "10", "11", "15", "16", "abc", ""} {
+			tg := target{record: record}
+			if prepared, parsed := matchRecord(pattern, tg, ranges), matchRecord(pattern, tg, nil); prepared != parsed {
+				t.Errorf("matchRecord(%q, %q): got %v with the prepared range, %v when parsing", pattern, record, prepared, parsed)
+			}
+		}
+	}
+}
+
+func TestNegatedResourcePatterns(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"auditor": [{ "action": "list", "resource": "!audit_logs" }],
+		"editor": [
+			{ "action": "*", "resource": "*" },
+			{ "type": "deny", "action": "delete", "resource": "!drafts" },
+			{ "type": "deny", "action": "edit", "resource": "!internal_*" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "auditor"}, http.StatusOK},
+		{"GET", "/audit_logs", []string{"X-Role", "auditor"}, http.StatusForbidden},
+		{"GET", "/posts/1", []string{"X-Role", "auditor"}, http.StatusForbidden},
+		{"DELETE", "/drafts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"PUT", "/internal_notes/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+	})
+}
+
+func TestPathResourcePatterns(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"indexer": [{ "action": "create", "resource": "path:/rpc/reindexSearch" }],
+		"operator": [{ "action": "*", "resource": "path:/rpc/*" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/rpc/reindexSearch", []string{"X-Role", "indexer"}, http.StatusOK},
+		{"POST", "/rpc//reindexSearch/", []string{"X-Role", "indexer"}, http.StatusOK},
+		{"GET", "/rpc/reindexSearch", []string{"X-Role", "indexer"}, http.StatusForbidden},
+		{"POST", "/rpc/purgeCache", []string{"X-Role", "indexer"}, http.StatusForbidden},
+		{"POST", "/rpc/purgeCache", []string{"X-Role", "operator"}, http.StatusOK},
+		{"GET", "/rpc", []string{"X-Role", "operator"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "operator"}, http.StatusForbidden},
+	})
+}
+
+func TestMatchAccept(t *testing.T) {
+	tests := []struct {
+		pattern, accept string
+		match           bool
+	}{
+		{"text/csv", "text/csv", true},
+		{"text/csv", "application/json, text/csv;q=0.5", true},
+		{"text/csv", "application/json", false},
+		{"text/csv", "", true},
+		{"text/csv", "*/*", true},
+		{"text/csv", "text/*", true},
+		{"application/*", "application/json", true},
+		{"application/*", "text/html", false},
+		{"TEXT/CSV", "text/csv", true},
+	}
+	for _, test := range tests {
+		if match := matchAccept(test.pattern, test.accept); match != test.match {
+			t.Errorf("matchAccept(%q, %q) = %v, want %v", test.pattern, test.accept, match, test.match)
+		}
+	}
+}
+
+func TestContentTypeConditions(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"analyst": [{ "action": "list", "resource": "reports", "content_type": "application/json" }],
+		"manager": [
+			{ "action": "list", "resource": "reports", "content_type": "application/json" },
+			{ "action": "list", "resource": "reports", "content_type": "text/csv" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/reports", []string{"X-Role", "analyst", "Accept", "application/json"}, http.StatusOK},
+		{"GET", "/reports", []string{"X-Role", "analyst", "Accept", "text/csv"}, http.StatusForbidden},
+		{"GET", "/reports", []string{"X-Role", "manager", "Accept", "text/csv"}, http.StatusOK},
+	})
+}
+
+func TestAcceptConditions(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"exporter": [{ "action": "list", "resource": "reports", "accept": "text/csv" }]
+	}`)
+	if ct := m.getRoles()["exporter"][0].ContentType; ct != "text/csv" {
+		t.Errorf("got content type %q, want the accept condition", ct)
+	}
+	expectStatuses(t, m, []request{
+		{"GET", "/reports", []string{"X-Role", "exporter", "Accept", "text/csv"}, http.StatusOK},
+		{"GET", "/reports", []string{"X-Role", "exporter", "Accept", "text/*"}, http.StatusOK},
+		{"GET", "/reports", []string{"X-Role", "exporter", "Accept", "*/*"}, http.StatusOK},
+		{"GET", "/reports", []string{"X-Role", "exporter"}, http.StatusOK},
+		{"GET", "/reports", []string{"X-Role", "exporter", "Accept", "application/json"}, http.StatusForbidden},
+	})
+}
+
+func TestMethodRules(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"editor": [
+			{ "action": "*", "resource": "*" },
+			{ "type": "deny", "method": "DELETE", "resource": "*" }
+		],
+		"patcher": [
+			{ "action": "edit", "method": "patch", "resource": "posts" },
+			{ "method": "*", "resource": "comments" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"PATCH", "/posts/1", []string{"X-Role", "patcher"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "patcher"}, http.StatusForbidden},
+		{"GET", "/posts/1", []string{"X-Role", "patcher"}, http.StatusForbidden},
+		{"DELETE", "/comments/1", []string{"X-Role", "patcher"}, http.StatusOK},
+		{"GET", "/comments", []string{"X-Role", "patcher"}, http.StatusOK},
+	})
+}
+
+func TestResourceSpecificity(t *testing.T) {
+	// Patterns from the most specific to the least specific
+	patterns := []string{"reports_archive", "reports", "reports_archive*", "reports*", "r*", "*", "!users"}
+	for i := 0; i+1 < len(patterns); i++ {
+		if a, b := resourceSpecificity(patterns[i]), resourceSpecificity(patterns[i+1]); a < b {
+			t.Errorf("%q (%d) should be at least as specific as %q (%d)", patterns[i], a, patterns[i+1], b)
+		}
+	}
+	if resourceSpecificity("*") != resourceSpecificity("!users") {
+		t.Error("negated patterns should rank with *")
+	}
+}
+
+func TestMostSpecificPermissionIsReported(t *testing.T) {
+	roles := parseRoles(t, `{
+		"analyst": [
+			{ "action": "list", "resource": "*", "reason": "any" },
+			{ "action": "list", "resource": "reports*", "reason": "reports" },
+			{ "action": "list", "resource": "reports_archive*", "reason": "archives" },
+			{ "action": "list", "resource": "reports_archive", "reason": "archive" },
+			{ "type": "deny", "action": "list", "resource": "logs*", "reason": "logs" },
+			{ "type": "deny", "action": "list", "resource": "logs_audit", "reason": "audit" }
+		]
+	}`)
+	tests := []struct {
+		resource, reason string
+	}{
+		{"users", "any"},
+		{"reports_2020", "reports"},
+		{"reports_archive_2020", "archives"},
+		{"reports_archive", "archive"},
+		{"logs_access", "logs"},
+		{"logs_audit", "audit"},
+	}
+	for _, test := range tests {
+		if decision := Can(roles, "analyst", "list", test.resource); decision.Reason != test.reason {
+			t.Errorf("%s: got reason %q, want %q", test.resource, decision.Reason, test.reason)
+		}
+	}
+}
+
+func TestOrderedEvaluation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"evaluation_order", "evaluation_order ordered"},
+		{"shorthand", "ordered_evaluation"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\t"+test.config+"\n}")
+			if m.EvaluationOrder != Ordered {
+				t.Fatalf("got evaluation order %q, want %q", m.EvaluationOrder, Ordered)
+			}
+			provision(t, m, `{
+				"auditor": [
+					{ "type": "deny", "action": "list", "resource": "audit_logs" },
+					{ "action": "list", "resource": "*" },
+					{ "type": "deny", "action": "list", "resource": "users" },
+					{ "action": "list", "resource": "secrets", "priority": 1 },
+					{ "type": "deny", "action": "list", "resource": "secrets" }
+				]
+			}`)
+			expectStatuses(t, m, []request{
+				{"GET", "/audit_logs", []string{"X-Role", "auditor"}, http.StatusForbidden},
+				{"GET", "/posts", []string{"X-Role", "auditor"}, http.StatusOK},
+				// Later deny rules are shadowed by earlier allow rules
+				{"GET", "/users", []string{"X-Role", "auditor"}, http.StatusOK},
+				// Higher priorities come first, wherever they are
+				{"GET", "/secrets", []string{"X-Role", "auditor"}, http.StatusOK},
+			})
+		})
+	}
+}
+
+func TestResourcePlaceholders(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"member": [
+			{ "action": "*", "resource": "tenant_{http.request.header.X-Tenant}" },
+			{ "action": "list", "resource": "{http.request.header.X-Unknown}*" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/tenant_acme", []string{"X-Role", "member", "X-Tenant", "acme"}, http.StatusOK},
+		{"DELETE", "/tenant_acme/1", []string{"X-Role", "member", "X-Tenant", "acme"}, http.StatusOK},
+		{"GET", "/tenant_globex", []string{"X-Role", "member", "X-Tenant", "acme"}, http.StatusForbidden},
+		// Empty placeholders match nothing
+		{"GET", "/tenant_", []string{"X-Role", "member"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "member"}, http.StatusForbidden},
+	})
+	// The check endpoint has no request to resolve placeholders from
+	if decision := m.check("member", "list", "tenant_acme"); decision.Allowed {
+		t.Error("expected placeholders not to be resolved by check")
+	}
+}
+
+func TestNegatedActions(t *testing.T) {
+	tests := []struct {
+		actions ActionType
+		action  string
+		want    bool
+	}{
+		{ActionType{Multiple: []string{"*", "!delete"}}, "edit", true},
+		{ActionType{Multiple: []string{"*", "!delete"}}, "delete", false},
+		{ActionType{Multiple: []string{"!delete", "*"}}, "delete", false},
+		{ActionType{Multiple: []string{"list", "show", "!show"}}, "show", false},
+		{ActionType{Multiple: []string{"list", "!delete"}}, "edit", false},
+		{ActionType{Multiple: []string{"!delete", "!edit"}}, "list", true},
+		{ActionType{Multiple: []string{"!delete", "!edit"}}, "edit", false},
+		{parseAction("!delete"), "list", true},
+		{parseAction("!delete"), "delete", false},
+		{parseAction("*,!delete"), "delete", false},
+	}
+	for _, test := range tests {
+		if got := matchAction(test.actions, test.action); got != test.want {
+			t.Errorf("matchAction(%+v, %s) = %v, want %v", test.actions, test.action, got, test.want)
+		}
+	}
+
+	m := provision(t, &Middleware{}, `{
+		"editor": [{ "action": ["*", "!delete"], "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"PUT", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+	})
+}
+
+func TestEvaluationOrders(t *testing.T) {
+	roles := parseRoles(t, `{
+		"auditor": [
+			{ "action": "list", "resource": "*" },
+			{ "type": "deny", "action": "list", "resource": "audit_logs" },
+			{ "action": "list", "resource": "audit_logs" }
+		]
+	}`)
+	tests := []struct {
+		order   EvaluationOrder
+		allowed bool
+	}{
+		{DenyWins, false},
+		{MostSpecificWins, false},
+		{Ordered, true},
+		{Sequential, true},
+	}
+	for _, test := range tests {
+		if decision := CanWithOrder(roles, "auditor", "list", "audit_logs", test.order); decision.Allowed != test.allowed {
+			t.Errorf("%s: got %v, want %v", test.order, decision.Allowed, test.allowed)
+		}
+		m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tevaluation_order "+string(test.order)+"\n}")
+		if m.EvaluationOrder != test.order {
+			t.Errorf("got evaluation order %q, want %q", m.EvaluationOrder, test.order)
+		}
+	}
+	if err := tryProvision(t, &Middleware{EvaluationOrder: "first_wins"}, `{"auditor": []}`); err == nil {
+		t.Error("expected an unknown evaluation order to be rejected")
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"tenant-a.example.com", "tenant-a.example.com", true},
+		{"tenant-a.example.com", "TENANT-A.example.com", true},
+		{"tenant-a.example.com", "tenant-b.example.com", false},
+		{"*.example.com", "tenant-a.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "tenant-a.example.org", false},
+		{"tenant-*", "tenant-b.example.com", true},
+		{"{http.request.header.X-Tenant}.example.com", "tenant-a.example.com", true},
+	}
+	for _, test := range tests {
+		r := newRequest("GET", "/", "X-Tenant", "tenant-a")
+		if got := matchHost(test.pattern, target{host: test.host, repl: caddyhttp.NewTestReplacer(r)}); got != test.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", test.pattern, test.host, got, test.want)
+		}
+	}
+}
+
+func TestHostScopedPermissions(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"editor": [
+			{ "action": "*", "resource": "posts", "host": "tenant-a.example.com" },
+			{ "type": "deny", "action": "delete", "resource": "posts", "host": "*.example.com" },
+			{ "action": "list", "resource": "posts" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "http://tenant-a.example.com/posts", []string{"X-Role", "editor"}, http.StatusOK},
+		{"POST", "http://tenant-a.example.com:8080/posts", []string{"X-Role", "editor"}, http.StatusOK},
+		{"POST", "http://tenant-b.example.com/posts", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"GET", "http://tenant-b.example.com/posts", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "http://tenant-a.example.com/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"DELETE", "http://tenant-b.example.com/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+	})
+}
+
+func TestHeaderConditions(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"member": [
+			{ "action": "list", "resource": "posts" },
+			{ "action": "list", "resource": "reports", "when": { "X-Plan": "enterprise" } },
+			{ "action": "show", "resource": "reports", "when": { "x-plan": "enterprise*", "X-Beta": "on" } },
+			{ "action": "edit", "resource": "posts", "when": { "X-Owner": "{http.request.header.X-User}" } }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/reports", []string{"X-Role", "member", "X-Plan", "enterprise"}, http.StatusOK},
+		{"GET", "/reports", []string{"X-Role", "member", "X-Plan", "free"}, http.StatusForbidden},
+		{"GET", "/reports", []string{"X-Role", "member"}, http.StatusForbidden},
+		{"GET", "/reports", []string{"X-Role", "member", "X-Plan", ""}, http.StatusForbidden},
+		{"GET", "/reports/1", []string{"X-Role", "member", "X-Plan", "enterprise-plus", "X-Beta", "on"}, http.StatusOK},
+		{"GET", "/reports/1", []string{"X-Role", "member", "X-Plan", "enterprise-plus"}, http.StatusForbidden},
+		{"PUT", "/posts/1", []string{"X-Role", "member", "X-Owner", "jane", "X-User", "jane"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "member", "X-Owner", "jane", "X-User", "john"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "member"}, http.StatusOK},
+	})
+
+	// Without a request, header conditions can't match
+	if decision := Can(parseRoles(t, `{
+		"member": [{ "action": "list", "resource": "reports", "when": { "X-Plan": "*" } }]
+	}`), "member", "list", "reports"); decision.Allowed {
+		t.Error("expected a header condition not to match without a request")
+	}
+}
+
+func TestResourceAndRecordPatterns(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"editor": [
+			{ "action": ["show", "edit"], "resource": "posts/*" },
+			{ "action": "delete", "resource": "posts/42" },
+			{ "action": "delete", "resource": "comments/archive_*" },
+			{ "action": "list", "resource": "tags" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PUT", "/posts/42", []string{"X-Role", "editor"}, http.StatusOK},
+		// A record part never matches collection requests
+		{"GET", "/posts", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"DELETE", "/posts/42", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts/43", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"DELETE", "/comments/archive_2020", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/comments/2020", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"GET", "/tags", []string{"X-Role", "editor"}, http.StatusOK},
+		{"GET", "/tags/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+	})
+}
+
+func TestQueryConditions(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"reviewer": [
+			{ "action": "list", "resource": "posts", "query": { "status": "pending" } },
+			{ "action": "list", "resource": "comments", "query": { "status": "pending*", "author": "{http.request.header.X-User}" } }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts?status=pending", []string{"X-Role", "reviewer"}, http.StatusOK},
+		{"GET", "/posts?status=pending&page=2", []string{"X-Role", "reviewer"}, http.StatusOK},
+		{"GET", "/posts?status=published", []string{"X-Role", "reviewer"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "reviewer"}, http.StatusForbidden},
+		{"GET", "/posts?status=", []string{"X-Role", "reviewer"}, http.StatusForbidden},
+		// Repeated parameters match only if all their values do
+		{"GET", "/posts?status=pending&status=published", []string{"X-Role", "reviewer"}, http.StatusForbidden},
+		{"GET", "/posts?status=pending&status=pending", []string{"X-Role", "reviewer"}, http.StatusOK},
+		{"GET", "/comments?status=pending_review&author=jane", []string{"X-Role", "reviewer", "X-User", "jane"}, http.StatusOK},
+		{"GET", "/comments?status=pending_review&author=john", []string{"X-Role", "reviewer", "X-User", "jane"}, http.StatusForbidden},
+		{"GET", "/comments?status=pending_review", []string{"X-Role", "reviewer", "X-User", "jane"}, http.StatusForbidden},
+	})
+}
@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "rbac-check",
+		Usage: "--roles <path> (--role <role> --action <action> --resource <resource> | --assertions <path>) [--evaluation-order <order>]",
+		Short: "Checks the decisions of a simple_rest_rbac roles file",
+		Long: `
+Loads a simple_rest_rbac roles file, and checks whether a role can perform an
+action on a resource. The command exits with status 0 if the access is
+allowed, and 1 if it is denied, so that roles files can be tested in CI.
+
+With --assertions, the expected decisions are read from a file instead, with
+one assertion per line:
+
+	<role> <action> <resource> allow|deny
+
+Empty lines and lines starting with # are ignored. The command exits with
+status 1 if any assertion fails.
+
+Conditions on the request (e.g. body_match or content_type) are evaluated as
+if the request had none.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().String("roles", "", "The path of the roles file")
+			cmd.Flags().String("role", "", "The role to check")
+			cmd.Flags().String("action", "", "The action to check")
+			cmd.Flags().String("resource", "", "The resource to check")
+			cmd.Flags().String("assertions", "", "The path of a file of assertions to check")
+			cmd.Flags().String("evaluation-order", "", "The evaluation order, as in the evaluation_order option")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdRBACCheck)
+		},
+	})
+}
+
+// cmdRBACCheck implements the rbac-check command
+func cmdRBACCheck(fl caddycmd.Flags) (int, error) {
+	if fl.String("roles") == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--roles is required")
+	}
+	rd, err := fileRoleSource{path: fl.String("roles")}.Load()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	m := &Middleware{EvaluationOrder: EvaluationOrder(fl.String("evaluation-order"))}
+	if !m.EvaluationOrder.valid() {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown evaluation order: %s", m.EvaluationOrder)
+	}
+	if rd, err = m.prepareRoles(rd); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	m.setRoles(rd)
+
+	if path := fl.String("assertions"); path != "" {
+		return checkAssertions(m, path)
+	}
+
+	role, action, resource := fl.String("role"), fl.String("action"), fl.String("resource")
+	if role == "" || action == "" || resource == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--role, --action and --resource are required without --assertions")
+	}
+	decision := m.check(role, action, resource)
+	if !decision.Allowed {
+		return 1, fmt.Errorf("%s cannot %s %s: %s", role, action, resource, decision.Reason)
+	}
+	fmt.Printf("%s can %s %s\n", role, action, resource)
+	return 0, nil
+}
+
+// checkAssertions checks the assertions of a file, reporting every failed
+// assertion
+func checkAssertions(m *Middleware, path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer file.Close()
+
+	var failures []error
+	checked := 0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 || (fields[3] != "allow" && fields[3] != "deny") {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("%s:%d: expected <role> <action> <resource> allow|deny", path, line)
+		}
+		role, action, resource, expected := fields[0], fields[1], fields[2], fields[3] == "allow"
+		checked++
+		if decision := m.check(role, action, resource); decision.Allowed != expected {
+			failures = append(failures, fmt.Errorf("%s:%d: expected %s, got %s", path, line, text, decisionName(decision)))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if len(failures) > 0 {
+		return 1, errors.Join(failures...)
+	}
+	fmt.Printf("%d assertions passed\n", checked)
+	return 0, nil
+}
+
+// decisionName returns "allow" or "deny", with the reason of denials
+func decisionName(decision Decision) string {
+	if decision.Allowed {
+		return "allow"
+	}
+	return "deny (" + decision.Reason + ")"
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+// commandFlags parses the flags of the rbac-check command
+func commandFlags(t *testing.T, args ...string) caddycmd.Flags {
+	t.Helper()
+	cmd := &cobra.Command{}
+	for _, name := range []string{"roles", "role", "action", "resource", "assertions", "evaluation-order"} {
+		cmd.Flags().String(name, "", "")
+	}
+	if err := cmd.Flags().Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return caddycmd.Flags{FlagSet: cmd.Flags()}
+}
+
+func TestRBACCheckCommand(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	roles := write("roles.json", `{
+		"reader": [{ "action": "list", "resource": "*" }],
+		"writer": [
+			{ "action": "crud", "resource": "posts" },
+			{ "type": "deny", "action": "delete", "resource": "posts" },
+			{ "action": "delete", "resource": "posts", "priority": 1 }
+		]
+	}`)
+	passing := write("passing.assertions", "# role action resource decision\nreader list posts allow\n\nreader delete posts deny\nwriter delete posts allow\n")
+	failing := write("failing.assertions", "reader list posts deny\nreader delete posts deny\n")
+	malformed := write("malformed.assertions", "reader list posts\n")
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		err  string
+	}{
+		{"allowed", []string{"--roles", roles, "--role", "reader", "--action", "list", "--resource", "posts"}, 0, ""},
+		{"denied", []string{"--roles", roles, "--role", "reader", "--action", "edit", "--resource", "posts"}, 1, "reader cannot edit posts"},
+		{"unknown role", []string{"--roles", roles, "--role", "guest", "--action", "list", "--resource", "posts"}, 1, "role not found"},
+		{"priorities", []string{"--roles", roles, "--role", "writer", "--action", "delete", "--resource", "posts"}, 0, ""},
+		{"evaluation order", []string{"--roles", roles, "--role", "writer", "--action", "delete", "--resource", "posts", "--evaluation-order", "ordered"}, 0, ""},
+		{"unknown evaluation order", []string{"--roles", roles, "--role", "reader", "--action", "list", "--resource", "posts", "--evaluation-order", "random"}, 1, "unknown evaluation order"},
+		{"missing roles", []string{"--role", "reader", "--action", "list", "--resource", "posts"}, 1, "--roles is required"},
+		{"missing resource", []string{"--roles", roles, "--role", "reader", "--action", "list"}, 1, "--resource are required"},
+		{"passing assertions", []string{"--roles", roles, "--assertions", passing}, 0, ""},
+		{"failing assertions", []string{"--roles", roles, "--assertions", failing}, 1, "failing.assertions:1: expected reader list posts deny, got allow"},
+		{"malformed assertions", []string{"--roles", roles, "--assertions", malformed}, 1, "malformed.assertions:1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, err := cmdRBACCheck(commandFlags(t, test.args...))
+			if code != test.code {
+				t.Errorf("got exit code %d, want %d (%v)", code, test.code, err)
+			}
+			if test.err == "" && err != nil {
+				t.Errorf("got error %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
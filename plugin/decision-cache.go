@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"container/list"
+	"sync"
+)
+
+// decisionCache is a least recently used cache of decisions, keyed by role,
+// action and resource. It is safe for concurrent use.
+type decisionCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// cachedDecision is an entry of the decision cache
+type cachedDecision struct {
+	key      string
+	decision Decision
+}
+
+// newDecisionCache creates a cache holding at most size decisions
+func newDecisionCache(size int) *decisionCache {
+	return &decisionCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// decisionKey builds the cache key of a decision
+func decisionKey(role, action, resource string) string {
+	return role + "|" + action + "|" + resource
+}
+
+// get returns the cached decision for a key, if any
+func (c *decisionCache) get(key string) (Decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return Decision{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cachedDecision).decision, true
+}
+
+// add caches a decision, evicting the least recently used one when full
+func (c *decisionCache) add(key string, decision Decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cachedDecision).decision = decision
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedDecision{key: key, decision: decision})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedDecision).key)
+	}
+}
@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecisionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newDecisionCache(2)
+	c.add("a", Decision{Allowed: true})
+	c.add("b", Decision{Allowed: true})
+	c.get("a")
+	c.add("c", Decision{Allowed: true})
+	c.add("a", Decision{Allowed: false})
+
+	tests := []struct {
+		key     string
+		cached  bool
+		allowed bool
+	}{
+		{"a", true, false},
+		{"b", false, false},
+		{"c", true, true},
+	}
+	for _, test := range tests {
+		decision, ok := c.get(test.key)
+		if ok != test.cached || decision.Allowed != test.allowed {
+			t.Errorf("%s: got %v (cached %v), want %v (cached %v)", test.key, decision.Allowed, ok, test.allowed, test.cached)
+		}
+	}
+}
+
+func TestCachedDecisions(t *testing.T) {
+	m := provision(t, &Middleware{DecisionCacheSize: 10}, `{
+		"reader": [{ "action": "show", "resource": "posts" }],
+		"owner": [{ "action": "show", "resource": "posts", "record": "{http.request.header.X-User}" }]
+	}`)
+	policy := m.getPolicy()
+	if !policy.static["reader"] || policy.static["owner"] {
+		t.Fatalf("got static roles %v, want reader only", policy.static)
+	}
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts/2", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts/1", []string{"X-Role", "owner", "X-User", "1"}, http.StatusOK},
+		{"GET", "/posts/1", []string{"X-Role", "owner", "X-User", "2"}, http.StatusForbidden},
+	})
+	if _, ok := policy.cache.get(decisionKey("reader", "show", "posts")); !ok {
+		t.Error("expected the decision of reader to be cached")
+	}
+	if _, ok := policy.cache.get(decisionKey("owner", "show", "posts")); ok {
+		t.Error("expected the decision of owner not to be cached")
+	}
+
+	// Reloading the roles drops the cached decisions
+	rd, err := m.prepareRoles(parseRoles(t, `{"reader": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setRoles(rd)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+}
+
+// BenchmarkDecisionCache compares the decisions of a role with many
+// permissions, with and without the decision cache
+func BenchmarkDecisionCache(b *testing.B) {
+	var permissions []string
+	for i := range 50 {
+		permissions = append(permissions, fmt.Sprintf(`{ "action": ["list", "show"], "resource": "resource_%d*" }`, i))
+	}
+	rd := parseRoles(b, `{"reader": [`+strings.Join(permissions, ",")+`]}`)
+	t := target{action: "show", resource: "resource_49", record: "1", path: "/resource_49/1"}
+
+	for _, size := range []int{0, 100} {
+		b.Run(fmt.Sprintf("cache size %d", size), func(b *testing.B) {
+			m := &Middleware{DecisionCacheSize: size}
+			prepared, err := m.prepareRoles(rd)
+			if err != nil {
+				b.Fatal(err)
+			}
+			m.setRoles(prepared)
+			policy := m.getPolicy()
+			b.ReportAllocs()
+			for b.Loop() {
+				policy.decide("reader", t)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// traceTokenHeader is the request header carrying the decision trace token
+const traceTokenHeader = "X-RBAC-Trace-Token"
+
+// traceEntry is a permission considered for a request, in a decision trace
+type traceEntry struct {
+	// Source is where the permission comes from: "global_deny", the name
+	// under which its role is defined, or "*" for shared permissions
+	Source     string     `json:"source"`
+	Permission Permission `json:"permission"`
+	Matched    bool       `json:"matched"`
+}
+
+// decisionTrace is the response to traced requests, listing every permission
+// considered in evaluation order, and the final decision
+type decisionTrace struct {
+	Role        string       `json:"role,omitempty"`
+	Action      string       `json:"action"`
+	Resource    string       `json:"resource"`
+	Record      string       `json:"record,omitempty"`
+	Permissions []traceEntry `json:"permissions"`
+	Decision    Decision     `json:"decision"`
+}
+
+// traced checks if a request carries the decision trace token
+func (m *Middleware) traced(r *http.Request) bool {
+	if len(m.traceToken) == 0 {
+		return false
+	}
+	token := r.Header.Get(traceTokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), m.traceToken) == 1
+}
+
+// trace evaluates the permissions of the roles against a target as a request
+// would, recording whether each of them matches
+func (m *Middleware) trace(roles []string, t target) decisionTrace {
+	trace := decisionTrace{Action: t.scopedAction(), Resource: t.resource, Record: t.record, Permissions: []traceEntry{}}
+	record := func(source string, permissions RoleDefinition) {
+		for _, permission := range permissions {
+			trace.Permissions = append(trace.Permissions, traceEntry{Source: source, Permission: permission, Matched: matchTarget(permission, t)})
+		}
+	}
+
+	record("global_deny", m.GlobalDeny)
+	for i, permission := range m.GlobalDeny {
+		if matchTarget(permission, t) {
+			trace.Decision = newDecision(&m.GlobalDeny[i])
+			trace.Decision.Allowed = false
+			return trace
+		}
+	}
+
+	policy := m.getPolicy()
+	for _, role := range roles {
+		if name := policy.roles.roleName(role); name != "" && name != SharedRole {
+			record(name, policy.roles[name])
+		}
+	}
+	record(SharedRole, policy.roles[SharedRole])
+	decision, exists := policy.decideRoles(roles, t)
+	if !exists {
+		decision = Decision{Allowed: false, Reason: "role not found"}
+	}
+	trace.Decision = decision
+	return trace
+}
+
+// writeTrace responds to a traced request with its decision trace, with the
+// 200 status if it would be allowed, or 403 otherwise, so that tracing a
+// request never reaches the next handlers
+func (m *Middleware) writeTrace(w http.ResponseWriter, role string, roles []string, t target) error {
+	trace := m.trace(roles, t)
+	trace.Role = role
+	status := http.StatusOK
+	if !trace.Decision.Allowed {
+		status = http.StatusForbidden
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(trace)
+}
@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const traceRoles = `{
+	"*": [{ "action": "list", "resource": "tags" }],
+	"editor": [
+		{ "action": "list", "resource": "posts" },
+		{ "action": "edit", "resource": "posts" },
+		{ "type": "deny", "action": "edit", "resource": "posts", "record": "1", "reason": "post 1 is locked" }
+	]
+}`
+
+func TestDecisionTrace(t *testing.T) {
+	t.Setenv("RBAC_TRACE_TOKEN", "s3cret")
+	m := provision(t, &Middleware{
+		DecisionTrace: "{env.RBAC_TRACE_TOKEN}",
+		GlobalDeny:    []Permission{{Type: "deny", Action: parseAction("*"), Resource: "secrets"}},
+	}, traceRoles)
+
+	type entry struct {
+		source, resource string
+		matched          bool
+	}
+	tests := []struct {
+		name           string
+		method, target string
+		status         int
+		entries        []entry
+		reason         string
+	}{
+		{"denied", "PUT", "/posts/1", http.StatusForbidden, []entry{
+			{"global_deny", "secrets", false},
+			{"editor", "posts", false},
+			{"editor", "posts", true},
+			{"editor", "posts", true},
+			{"*", "tags", false},
+		}, "post 1 is locked"},
+		{"allowed", "GET", "/posts", http.StatusOK, []entry{
+			{"global_deny", "secrets", false},
+			{"editor", "posts", true},
+			{"editor", "posts", false},
+			{"editor", "posts", false},
+			{"*", "tags", false},
+		}, ""},
+		{"global deny", "GET", "/secrets", http.StatusForbidden, []entry{
+			{"global_deny", "secrets", true},
+		}, "matched a deny rule"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := serve(m, newRequest(test.method, test.target, "X-Role", "editor", traceTokenHeader, "s3cret"))
+			if res.status != test.status || res.next || res.err != nil {
+				t.Fatalf("got status %d (next called %v, %v), want %d", res.status, res.next, res.err, test.status)
+			}
+			if cacheControl := res.rec.Header().Get("Cache-Control"); cacheControl != "no-store" {
+				t.Errorf("got Cache-Control %q, want no-store", cacheControl)
+			}
+			var trace decisionTrace
+			if err := json.NewDecoder(res.rec.Body).Decode(&trace); err != nil {
+				t.Fatalf("decoding trace: %v", err)
+			}
+			if trace.Role != "editor" || trace.Decision.Allowed != (test.status == http.StatusOK) || trace.Decision.Reason != test.reason {
+				t.Errorf("got trace of %s with decision %+v, want reason %q", trace.Role, trace.Decision, test.reason)
+			}
+			if len(trace.Permissions) != len(test.entries) {
+				t.Fatalf("got %d traced permissions, want %d: %+v", len(trace.Permissions), len(test.entries), trace.Permissions)
+			}
+			for i, want := range test.entries {
+				got := trace.Permissions[i]
+				if got.Source != want.source || got.Permission.Resource != want.resource || got.Matched != want.matched {
+					t.Errorf("permission %d: got %s %s matched %v, want %s %s matched %v", i, got.Source, got.Permission.Resource, got.Matched, want.source, want.resource, want.matched)
+				}
+			}
+		})
+	}
+}
+
+func TestDecisionTraceRequiresTheToken(t *testing.T) {
+	m := provision(t, &Middleware{DecisionTrace: "s3cret"}, traceRoles)
+	for _, token := range []string{"", "wrong", "s3cret2"} {
+		res := serve(m, newRequest("GET", "/posts", "X-Role", "editor", traceTokenHeader, token))
+		if !res.next || res.rec.Body.Len() != 0 {
+			t.Errorf("token %q: got a trace %q, want the request to be served", token, res.rec.Body.String())
+		}
+	}
+
+	m = provision(t, &Middleware{}, traceRoles)
+	if res := serve(m, newRequest("GET", "/posts", "X-Role", "editor", traceTokenHeader, "")); !res.next {
+		t.Error("got a trace without decision_trace, want the request to be served")
+	}
+
+	if err := tryProvision(t, &Middleware{DecisionTrace: "{env.RBAC_UNDEFINED_TOKEN}"}, traceRoles); err == nil {
+		t.Error("expected a decision trace token resolving to nothing to be rejected")
+	}
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// errorFormats are the formats of the body of 403 responses
+var errorFormats = []string{"", "text", "json", "ra", "html", "auto"}
+
+// defaultErrorTemplate is the body of 403 responses with the "html" error
+// format, unless an error template is configured
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// errorBody is the body of 403 responses, encoded as JSON or passed to the
+// HTML template. Its message is displayed by react-admin's data providers.
+type errorBody struct {
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+	// Title is the text of the status, e.g. "Forbidden"
+	Title string `json:"-"`
+}
+
+// defaultLocale is the key of the deny message used when no locale of the
+// Accept-Language header has a message
+const defaultLocale = "*"
+
+// denyMessage returns the deny message in the first locale of the
+// Accept-Language header having one, or the default message, along with its
+// locale. A language tag without a message of its own (e.g. "fr-CA") falls
+// back to its primary language (e.g. "fr").
+func (m *Middleware) denyMessage(r *http.Request) (string, string) {
+	if len(m.denyMessages) == 0 {
+		return "", ""
+	}
+	for _, language := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		language, _, _ = strings.Cut(language, ";")
+		language = strings.ToLower(strings.TrimSpace(language))
+		if language == "" || language == "*" {
+			continue
+		}
+		if message, ok := m.denyMessages[language]; ok {
+			return message, language
+		}
+		if primary, _, ok := strings.Cut(language, "-"); ok {
+			if message, ok := m.denyMessages[primary]; ok {
+				return message, primary
+			}
+		}
+	}
+	return m.denyMessages[defaultLocale], ""
+}
+
+// errorFormat returns the format of the body of a 403 response. With the
+// "auto" error format, it is the format of the first media type of the
+// Accept header which is HTML, plain text or JSON, and JSON otherwise.
+func (m *Middleware) errorFormat(r *http.Request) string {
+	switch m.ErrorFormat {
+	case "":
+		return "text"
+	case "auto":
+	default:
+		return m.ErrorFormat
+	}
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaRange, _, _ = strings.Cut(mediaRange, ";")
+		switch mediaType := strings.ToLower(strings.TrimSpace(mediaRange)); {
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			return "html"
+		case mediaType == "text/plain":
+			return "text"
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			return "json"
+		}
+	}
+	return "json"
+}
+
+// writeDenial writes a denial response with a status (403 unless the
+// permission which denied sets another one) and a message, in an error format
+func (m *Middleware) writeDenial(w http.ResponseWriter, format string, status int, message string) error {
+	body := errorBody{Message: message, Status: status, Title: http.StatusText(status)}
+	switch format {
+	case "json", "ra":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		return json.NewEncoder(w).Encode(body)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		return m.errorTemplate.Execute(w, body)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		_, err := w.Write([]byte(message))
+		return err
+	}
+}
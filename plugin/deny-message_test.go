@@ -0,0 +1,308 @@
+package plugin
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const reasonRoles = `{
+	"reader": [
+		{ "action": "*", "resource": "*" },
+		{ "type": "deny", "action": "show", "resource": "views", "reason": "views are only visible to writers" },
+		{ "type": "deny", "action": "delete", "resource": "*" }
+	]
+}`
+
+func TestDenyReasons(t *testing.T) {
+	tests := []struct {
+		name   string
+		expose bool
+		target string
+		method string
+		reason string
+		body   string
+	}{
+		{"reason of the deny rule", false, "/views/1", "GET", "views are only visible to writers", ""},
+		{"deny rule without reason", false, "/posts/1", "DELETE", "matched a deny rule", ""},
+		{"exposed reason", true, "/views/1", "GET", "", "views are only visible to writers"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := provision(t, &Middleware{ExposeReason: test.expose}, reasonRoles)
+			res := serve(m, newRequest(test.method, test.target, "X-Role", "reader"))
+			if res.status != http.StatusForbidden {
+				t.Fatalf("got status %d, want 403", res.status)
+			}
+			if test.reason != "" && (res.err == nil || !strings.Contains(res.err.Error(), test.reason)) {
+				t.Errorf("got error %v, want reason %q", res.err, test.reason)
+			}
+			if body := res.rec.Body.String(); !strings.Contains(body, test.body) {
+				t.Errorf("got body %q, want %q", body, test.body)
+			}
+		})
+	}
+}
+
+func TestCanReportsReasons(t *testing.T) {
+	roles := parseRoles(t, reasonRoles)
+	tests := []struct {
+		action, resource string
+		allowed          bool
+		reason           string
+	}{
+		{"show", "views", false, "views are only visible to writers"},
+		{"delete", "posts", false, "matched a deny rule"},
+		{"show", "posts", true, ""},
+	}
+	for _, test := range tests {
+		decision := Can(roles, "reader", test.action, test.resource)
+		if decision.Allowed != test.allowed || decision.Reason != test.reason {
+			t.Errorf("Can(%s, %s) = %+v, want allowed %v with reason %q", test.action, test.resource, decision, test.allowed, test.reason)
+		}
+	}
+	if decision := Can(parseRoles(t, `{"reader": []}`), "reader", "show", "posts"); decision.Reason != "no permission matches" {
+		t.Errorf("got reason %q, want no permission matches", decision.Reason)
+	}
+}
+
+func TestDecisionPlaceholders(t *testing.T) {
+	m := provision(t, &Middleware{}, reasonRoles)
+	tests := []struct {
+		method, target   string
+		decision, reason string
+	}{
+		{"GET", "/views/1", "deny", "views are only visible to writers"},
+		{"GET", "/posts/1", "allow", ""},
+	}
+	for _, test := range tests {
+		r := newRequest(test.method, test.target, "X-Role", "reader")
+		serve(m, r)
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if decision, _ := repl.GetString("http.rbac.decision"); decision != test.decision {
+			t.Errorf("%s %s: got decision %q, want %q", test.method, test.target, decision, test.decision)
+		}
+		if reason, _ := repl.GetString("http.rbac.reason"); reason != test.reason {
+			t.Errorf("%s %s: got reason %q, want %q", test.method, test.target, reason, test.reason)
+		}
+	}
+}
+
+func TestForbiddenStatus(t *testing.T) {
+	m := provision(t, &Middleware{ForbiddenStatus: http.StatusNotFound, ExposeReason: true, GlobalDeny: []Permission{{Type: "deny", Action: parseAction("*"), Resource: "secrets"}}}, reasonRoles)
+	for _, req := range []request{
+		{"GET", "/views/1", []string{"X-Role", "reader"}, http.StatusNotFound},
+		{"DELETE", "/posts/1", []string{"X-Role", "reader"}, http.StatusNotFound},
+		{"GET", "/secrets", []string{"X-Role", "reader"}, http.StatusNotFound},
+		{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+	} {
+		res := serve(m, newRequest(req.method, req.target, req.headers...))
+		if res.status != req.status {
+			t.Errorf("%s %s: got status %d, want %d", req.method, req.target, res.status, req.status)
+		}
+		if body := res.rec.Body.String(); req.status == http.StatusNotFound && body != "" {
+			t.Errorf("%s %s: got body %q, want none", req.method, req.target, body)
+		}
+	}
+}
+
+func TestDecisionHeader(t *testing.T) {
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tdecision_header X-RBAC-Decision\n}")
+	m.GlobalDeny = []Permission{{Type: "deny", Action: parseAction("*"), Resource: "secrets"}}
+	provision(t, m, reasonRoles)
+	tests := []struct {
+		method, target string
+		header         string
+	}{
+		{"GET", "/posts/1", "allow; role=reader; action=show"},
+		{"DELETE", "/posts/1", "deny; role=reader; action=delete"},
+		{"GET", "/secrets", "deny; action=list"},
+	}
+	for _, test := range tests {
+		res := serve(m, newRequest(test.method, test.target, "X-Role", "reader"))
+		if header := res.rec.Header().Get("X-RBAC-Decision"); header != test.header {
+			t.Errorf("%s %s: got header %q, want %q", test.method, test.target, header, test.header)
+		}
+	}
+
+	m = provision(t, &Middleware{}, reasonRoles)
+	if res := serve(m, newRequest("GET", "/posts/1", "X-Role", "reader")); len(res.rec.Header()) != 0 {
+		t.Errorf("got headers %v without decision_header", res.rec.Header())
+	}
+}
+
+func TestLocalizedDenyMessages(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		error_format json
+		deny_messages {
+			* "Access denied"
+			fr "Accès refusé"
+			pt-BR "Acesso negado"
+		}
+	}`)
+	provision(t, m, reasonRoles)
+	tests := []struct {
+		acceptLanguage string
+		message        string
+		locale         string
+	}{
+		{"", "Access denied", ""},
+		{"fr", "Accès refusé", "fr"},
+		{"fr-CA, en;q=0.8", "Accès refusé", "fr"},
+		{"de, FR;q=0.5", "Accès refusé", "fr"},
+		{"pt-br", "Acesso negado", "pt-br"},
+		{"pt", "Access denied", ""},
+		{"de", "Access denied", ""},
+		{"*", "Access denied", ""},
+	}
+	for _, test := range tests {
+		res := serve(m, newRequest("DELETE", "/posts/1", "X-Role", "reader", "Accept-Language", test.acceptLanguage))
+		if res.status != http.StatusForbidden {
+			t.Fatalf("%q: got status %d, want 403", test.acceptLanguage, res.status)
+		}
+		if body := res.rec.Body.String(); !strings.Contains(body, `"message":"`+test.message+`"`) {
+			t.Errorf("%q: got body %q, want message %q", test.acceptLanguage, body, test.message)
+		}
+		if locale := res.rec.Header().Get("Content-Language"); locale != test.locale {
+			t.Errorf("%q: got Content-Language %q, want %q", test.acceptLanguage, locale, test.locale)
+		}
+	}
+}
+
+func TestReactAdminErrorFormat(t *testing.T) {
+	tests := []struct {
+		name           string
+		m              *Middleware
+		method, target string
+		body           string
+	}{
+		{"denial", &Middleware{ErrorFormat: "ra"}, "DELETE", "/posts/1", `{"message":"access denied","status":403}`},
+		{"exposed reason", &Middleware{ErrorFormat: "ra", ExposeReason: true}, "GET", "/views/1", `{"message":"views are only visible to writers","status":403}`},
+		{"deny message", &Middleware{ErrorFormat: "ra", DenyMessages: map[string]string{"*": "You cannot do that"}}, "DELETE", "/posts/1", `{"message":"You cannot do that","status":403}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provision(t, test.m, reasonRoles)
+			res := serve(test.m, newRequest(test.method, test.target, "X-Role", "reader", "Accept", "text/html"))
+			if res.status != http.StatusForbidden || res.err != nil {
+				t.Fatalf("got status %d (%v), want 403", res.status, res.err)
+			}
+			if contentType := res.rec.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", contentType)
+			}
+			if body := strings.TrimSpace(res.rec.Body.String()); body != test.body {
+				t.Errorf("got body %s, want %s", body, test.body)
+			}
+		})
+	}
+
+	if err := tryProvision(t, &Middleware{ErrorFormat: "xml"}, reasonRoles); err == nil {
+		t.Error("expected an unknown error format to be rejected")
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	tests := []struct {
+		errorFormat string
+		accept      string
+		want        string
+	}{
+		{"", "text/html", "text"},
+		{"json", "text/html", "json"},
+		{"auto", "text/html", "html"},
+		{"auto", "application/xhtml+xml", "html"},
+		{"auto", "text/plain", "text"},
+		{"auto", "application/json", "json"},
+		{"auto", "application/problem+json", "json"},
+		{"auto", "image/png, TEXT/HTML;q=0.9", "html"},
+		{"auto", "application/json, text/html", "json"},
+		{"auto", "*/*", "json"},
+		{"auto", "", "json"},
+	}
+	for _, test := range tests {
+		m := &Middleware{ErrorFormat: test.errorFormat}
+		if got := m.errorFormat(newRequest("GET", "/posts", "Accept", test.accept)); got != test.want {
+			t.Errorf("%s with Accept %q: got %q, want %q", test.errorFormat, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestContentNegotiatedDenials(t *testing.T) {
+	templatePath := filepath.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(templatePath, []byte("<p>{{.Status}}: {{.Message}}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		m           *Middleware
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"json", &Middleware{ErrorFormat: "auto"}, "application/json", "application/json", `{"message":"access denied","status":403}`},
+		{"text", &Middleware{ErrorFormat: "auto"}, "text/plain", "text/plain; charset=utf-8", "access denied"},
+		{"html", &Middleware{ErrorFormat: "auto"}, "text/html", "text/html; charset=utf-8", "<h1>403 Forbidden</h1>"},
+		{"ambiguous", &Middleware{ErrorFormat: "auto"}, "*/*", "application/json", `{"message":"access denied","status":403}`},
+		{"html template", &Middleware{ErrorFormat: "auto", ErrorTemplate: templatePath}, "text/html", "text/html; charset=utf-8", "<p>403: access denied</p>"},
+		{"escaped html", &Middleware{ErrorFormat: "html", DenyMessages: map[string]string{"*": "<b>no</b>"}}, "", "text/html; charset=utf-8", "&lt;b&gt;no&lt;/b&gt;"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provision(t, test.m, reasonRoles)
+			res := serve(test.m, newRequest("DELETE", "/posts/1", "X-Role", "reader", "Accept", test.accept))
+			if res.status != http.StatusForbidden || res.err != nil {
+				t.Fatalf("got status %d (%v), want 403", res.status, res.err)
+			}
+			if contentType := res.rec.Header().Get("Content-Type"); contentType != test.contentType {
+				t.Errorf("got Content-Type %q, want %q", contentType, test.contentType)
+			}
+			if body := res.rec.Body.String(); !strings.Contains(body, test.body) {
+				t.Errorf("got body %q, want %q", body, test.body)
+			}
+		})
+	}
+
+	if err := tryProvision(t, &Middleware{ErrorFormat: "html", ErrorTemplate: filepath.Join(t.TempDir(), "missing.html")}, reasonRoles); err == nil {
+		t.Error("expected a missing error template to be rejected")
+	}
+}
+
+func TestPermissionStatus(t *testing.T) {
+	roles := `{
+		"reader": [
+			{ "action": "*", "resource": "*" },
+			{ "type": "deny", "action": "*", "resource": "videos", "when": { "X-Country": "xx" }, "status": 451, "reason": "unavailable in your country" },
+			{ "type": "deny", "action": "create", "resource": "comments", "when": { "X-Burst": "1" }, "status": 429 },
+			{ "type": "deny", "action": "delete", "resource": "*" }
+		]
+	}`
+	tests := []struct {
+		name    string
+		m       *Middleware
+		request request
+	}{
+		{"legal deny", &Middleware{}, request{"GET", "/videos/1", []string{"X-Role", "reader", "X-Country", "xx"}, http.StatusUnavailableForLegalReasons}},
+		{"condition not met", &Middleware{}, request{"GET", "/videos/1", []string{"X-Role", "reader", "X-Country", "fr"}, http.StatusOK}},
+		{"rate deny", &Middleware{}, request{"POST", "/comments", []string{"X-Role", "reader", "X-Burst", "1"}, http.StatusTooManyRequests}},
+		{"policy deny", &Middleware{}, request{"DELETE", "/videos/1", []string{"X-Role", "reader"}, http.StatusForbidden}},
+		{"unknown role", &Middleware{}, request{"GET", "/videos/1", []string{"X-Role", "guest"}, http.StatusForbidden}},
+		{"forbidden status", &Middleware{ForbiddenStatus: http.StatusNotFound}, request{"POST", "/comments", []string{"X-Role", "reader", "X-Burst", "1"}, http.StatusTooManyRequests}},
+		{"global deny", &Middleware{GlobalDeny: []Permission{{Type: "deny", Action: parseAction("*"), Resource: "secrets", Status: http.StatusGone}}}, request{"GET", "/secrets", []string{"X-Role", "reader"}, http.StatusGone}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provision(t, test.m, roles)
+			expectStatuses(t, test.m, []request{test.request})
+		})
+	}
+
+	if err := tryProvision(t, &Middleware{}, `{
+		"reader": [{ "type": "deny", "action": "*", "resource": "*", "status": 200 }]
+	}`); err == nil {
+		t.Error("expected a permission with a success status to be rejected")
+	}
+}
@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// denyWebhookWorkers is the maximum number of concurrent webhook calls
+	denyWebhookWorkers = 4
+	// denyWebhookQueue is the number of events waiting for a worker, beyond
+	// which events are dropped
+	denyWebhookQueue = 256
+	// denyWebhookTimeout bounds each webhook call
+	denyWebhookTimeout = 5 * time.Second
+)
+
+// denyEvent is the JSON payload posted to the deny webhook
+type denyEvent struct {
+	Role     string    `json:"role,omitempty"`
+	Action   string    `json:"action"`
+	Resource string    `json:"resource"`
+	Reason   string    `json:"reason,omitempty"`
+	IP       string    `json:"ip"`
+	TraceID  string    `json:"trace_id,omitempty"`
+	Time     time.Time `json:"timestamp"`
+}
+
+// denyWebhook posts denial events to a URL in the background, so that
+// requests are never delayed by the webhook. Events are dropped when the
+// webhook can't keep up, and failed calls are not retried.
+type denyWebhook struct {
+	url    string
+	client *http.Client
+	events chan denyEvent
+	wg     sync.WaitGroup
+	logger *zap.Logger
+
+	// mu guards stopped, so that events is only closed once no event can be
+	// sent to it anymore
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newDenyWebhook starts the workers posting events to a URL
+func newDenyWebhook(url string, logger *zap.Logger) *denyWebhook {
+	h := &denyWebhook{
+		url:    url,
+		client: &http.Client{Timeout: denyWebhookTimeout},
+		events: make(chan denyEvent, denyWebhookQueue),
+		logger: logger,
+	}
+	for i := 0; i < denyWebhookWorkers; i++ {
+		h.wg.Add(1)
+		go h.work()
+	}
+	return h
+}
+
+// notify queues an event, dropping it if the queue is full or the webhook is
+// stopped
+func (h *denyWebhook) notify(event denyEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.stopped {
+		return
+	}
+	select {
+	case h.events <- event:
+	default:
+		h.logger.Warn("Dropping deny webhook event, queue is full", zap.String("url", h.url))
+	}
+}
+
+// work posts the queued events until the webhook is stopped
+func (h *denyWebhook) work() {
+	defer h.wg.Done()
+	for event := range h.events {
+		if err := h.post(event); err != nil {
+			h.logger.Error("Failed to call deny webhook", zap.String("url", h.url), zap.Error(err))
+		}
+	}
+}
+
+// post sends an event to the webhook
+func (h *denyWebhook) post(event denyEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// stop posts the queued events and waits for the workers to finish. Events
+// notified afterwards are dropped.
+func (h *denyWebhook) stop() {
+	h.mu.Lock()
+	if !h.stopped {
+		h.stopped = true
+		close(h.events)
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+}
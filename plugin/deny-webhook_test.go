@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+)
+
+func TestDenyWebhookPostsEvents(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event denyEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil || event.Resource != "posts" {
+			t.Errorf("got event %+v (%v), want an event on posts", event, err)
+		}
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	h := newDenyWebhook(server.URL, zap.NewNop())
+	for i := 0; i < 10; i++ {
+		h.notify(denyEvent{Action: "edit", Resource: "posts"})
+	}
+	h.stop()
+	if got := received.Load(); got != 10 {
+		t.Errorf("got %d events, want 10", got)
+	}
+}
+
+func TestDenyWebhookNotifyAfterStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	h := newDenyWebhook(server.URL, zap.NewNop())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.notify(denyEvent{Action: "edit", Resource: "posts"})
+			}
+		}()
+	}
+	h.stop()
+	wg.Wait()
+	// Stopping twice is harmless
+	h.stop()
+}
+
+// eventRecorder is an event handler recording the data of the events
+type eventRecorder struct {
+	events []map[string]any
+}
+
+func (h *eventRecorder) Handle(ctx context.Context, e caddy.Event) error {
+	h.events = append(h.events, e.Data)
+	return nil
+}
+
+func TestDeniedEvents(t *testing.T) {
+	m := provision(t, &Middleware{
+		GlobalDeny: []Permission{{Type: "deny", Action: parseAction("*"), Resource: "secrets"}},
+	}, `{
+		"reader": [{ "action": "list", "resource": "posts", "reason": "readers can list posts" }]
+	}`)
+	// The events app is set up by hand, tests having no Caddy config to
+	// load it from
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	app := new(caddyevents.App)
+	if err := app.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &eventRecorder{}
+	if err := app.On("rbac_denied", recorder); err != nil {
+		t.Fatal(err)
+	}
+	m.events, m.ctx = app, ctx
+
+	for _, req := range []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/secrets", []string{"X-Role", "reader"}, http.StatusForbidden},
+	} {
+		r := newRequest(req.method, req.target, req.headers...)
+		r.RemoteAddr = "192.0.2.1:1234"
+		serve(m, r)
+	}
+
+	want := []map[string]any{
+		{"role": "reader", "action": "delete", "resource": "posts", "reason": "no permission matches", "ip": "192.0.2.1"},
+		{"role": "", "action": "list", "resource": "secrets", "ip": "192.0.2.1"},
+	}
+	if len(recorder.events) != len(want) {
+		t.Fatalf("got events %v, want %v", recorder.events, want)
+	}
+	for i, data := range want {
+		for key, value := range data {
+			if recorder.events[i][key] != value {
+				t.Errorf("event %d: got %s %q, want %q", i, key, recorder.events[i][key], value)
+			}
+		}
+	}
+}
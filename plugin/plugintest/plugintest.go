@@ -0,0 +1,84 @@
+// Package plugintest provides helpers to test simple_rest_rbac configurations
+// and roles, by running requests through a provisioned middleware without
+// starting Caddy.
+package plugintest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/marmelab/caddy-rbac-rest-middleware/plugin"
+)
+
+// Provision provisions and validates a middleware configured by m, with the
+// given role definitions rather than those of a roles file. The test fails
+// if the configuration is invalid, and the middleware is cleaned up when the
+// test ends.
+//
+//	m := plugintest.Provision(t, &plugin.Middleware{Role: "{http.request.header.X-Role}"}, roles)
+func Provision(t testing.TB, m *plugin.Middleware, roles plugin.RoleDefinitions) *plugin.Middleware {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(func() {
+		m.Cleanup()
+		cancel()
+	})
+	if err := m.ProvisionWithRoles(ctx, roles); err != nil {
+		t.Fatalf("provisioning simple_rest_rbac: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("validating simple_rest_rbac: %v", err)
+	}
+	return m
+}
+
+// Result is the outcome of a request served by a middleware
+type Result struct {
+	// Status is the status of the response, or of the error returned by
+	// the middleware, e.g. 403 for denied requests
+	Status int
+	// NextCalled tells whether the request was passed to the next handler,
+	// i.e. whether it was allowed
+	NextCalled bool
+	// Response is the recorded response, with the headers and body written
+	// by the middleware
+	Response *httptest.ResponseRecorder
+	// Err is the error returned by the middleware, if any
+	Err error
+}
+
+// Serve runs a request through a middleware, with a next handler responding
+// with 200 OK. Placeholders of the request (e.g. {http.request.header.X-Role})
+// are resolved as in Caddy.
+//
+//	r := httptest.NewRequest("DELETE", "/posts/1", nil)
+//	r.Header.Set("X-Role", "reader")
+//	if result := plugintest.Serve(m, r); result.NextCalled {
+//		t.Error("readers should not delete posts")
+//	}
+func Serve(m *plugin.Middleware, r *http.Request) Result {
+	r = r.Clone(r.Context())
+	caddyhttp.NewTestReplacer(r)
+
+	result := Result{Response: httptest.NewRecorder()}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		result.NextCalled = true
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	result.Err = m.ServeHTTP(result.Response, r, next)
+	result.Status = result.Response.Code
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(result.Err, &handlerErr) {
+		result.Status = handlerErr.StatusCode
+	} else if result.Err != nil {
+		result.Status = http.StatusInternalServerError
+	}
+	return result
+}
@@ -0,0 +1,81 @@
+package plugintest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/marmelab/caddy-rbac-rest-middleware/plugin"
+	"github.com/marmelab/caddy-rbac-rest-middleware/plugin/plugintest"
+)
+
+func parseRoles(t *testing.T, rolesJSON string) plugin.RoleDefinitions {
+	t.Helper()
+	var roles plugin.RoleDefinitions
+	if err := json.Unmarshal([]byte(rolesJSON), &roles); err != nil {
+		t.Fatalf("parsing roles: %v", err)
+	}
+	return roles
+}
+
+func TestServe(t *testing.T) {
+	m := plugintest.Provision(t, &plugin.Middleware{Role: "{http.request.header.X-Role}"}, parseRoles(t, `{
+		"reader": [{ "action": ["list", "show"], "resource": "posts" }],
+		"writer": [
+			{ "action": "*", "resource": "posts" },
+			{ "type": "deny", "action": "delete", "resource": "posts" }
+		]
+	}`))
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		role       string
+		status     int
+		nextCalled bool
+	}{
+		{"allowed", "GET", "/posts/1", "reader", http.StatusOK, true},
+		{"not allowed", "PUT", "/posts/1", "reader", http.StatusForbidden, false},
+		{"denied", "DELETE", "/posts/1", "writer", http.StatusForbidden, false},
+		{"unknown role", "GET", "/posts", "guest", http.StatusForbidden, false},
+		{"missing role", "GET", "/posts", "", http.StatusMethodNotAllowed, false},
+		{"no resource", "GET", "/", "", http.StatusOK, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, nil)
+			if test.role != "" {
+				r.Header.Set("X-Role", test.role)
+			}
+			result := plugintest.Serve(m, r)
+			if result.Status != test.status || result.NextCalled != test.nextCalled {
+				t.Errorf("got status %d (next called %v), want %d (next called %v): %v", result.Status, result.NextCalled, test.status, test.nextCalled, result.Err)
+			}
+			if test.nextCalled && result.Err != nil {
+				t.Errorf("got error %v", result.Err)
+			}
+		})
+	}
+}
+
+func TestServeRecordsTheResponse(t *testing.T) {
+	m := plugintest.Provision(t, &plugin.Middleware{Role: "{http.request.header.X-Role}", ErrorFormat: "json"}, parseRoles(t, `{
+		"reader": [{ "action": "list", "resource": "posts" }]
+	}`))
+	r := httptest.NewRequest("POST", "/posts", nil)
+	r.Header.Set("X-Role", "reader")
+	result := plugintest.Serve(m, r)
+	if result.Status != http.StatusForbidden || result.Err != nil {
+		t.Fatalf("got status %d (%v), want 403", result.Status, result.Err)
+	}
+	if contentType := result.Response.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", contentType)
+	}
+
+	// Serve works on a copy of the request, which can be served again
+	if result := plugintest.Serve(m, r); result.Status != http.StatusForbidden {
+		t.Errorf("serving again: got status %d, want 403", result.Status)
+	}
+}
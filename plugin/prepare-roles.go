@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// actionGroups are the action tokens expanding to several built-in actions:
+// the actions on a single record, the actions on a collection, and all of
+// them. Groups defined in the configuration take precedence.
+var actionGroups = map[string][]string{
+	"@item":       {"show", "edit", "replace", "patch", "delete", "invoke"},
+	"@collection": {"list", "get_many_reference", "create"},
+	"crud":        {"list", "get_many_reference", "show", "create", "edit", "replace", "patch", "delete"},
+	"readonly":    {"list", "get_many_reference", "show"},
+}
+
+// envPlaceholder matches the environment variable placeholders of roles,
+// e.g. "{env.TENANT}"
+var envPlaceholder = regexp.MustCompile(`\{env\.([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// prepareRoles rewrites freshly loaded role definitions into the form
+// evaluated by requests, before they are validated
+func (m *Middleware) prepareRoles(rd RoleDefinitions) (RoleDefinitions, error) {
+	prepared := make(RoleDefinitions, len(rd))
+	for role, permissions := range rd {
+		name, err := expandEnv(role)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %w", role, err)
+		}
+		// Leave the permissions of the caller untouched
+		permissions, err = expandForEach(slices.Clone(permissions))
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %w", role, err)
+		}
+		for i := range permissions {
+			if err := expandPermissionEnv(&permissions[i]); err != nil {
+				return nil, fmt.Errorf("role %s: %w", role, err)
+			}
+			permissions[i].Action = m.expandActionGroups(permissions[i].Action)
+			if permissions[i].ranges, err = permissions[i].recordRanges(); err != nil {
+				return nil, fmt.Errorf("role %s: %w", role, err)
+			}
+			if err := permissions[i].validateStatus(); err != nil {
+				return nil, fmt.Errorf("role %s: %w", role, err)
+			}
+		}
+		prepared[name] = append(prepared[name], permissions...)
+	}
+	// Evaluate the permissions of a higher priority first, keeping the order
+	// of the roles file otherwise
+	for _, permissions := range prepared {
+		slices.SortStableFunc(permissions, func(a, b Permission) int { return cmp.Compare(b.Priority, a.Priority) })
+	}
+	return prepared, nil
+}
+
+// forEachItem is the token replaced by each item of a permission template
+const forEachItem = "{{.}}"
+
+// expandForEach replaces the permission templates, i.e. the permissions with
+// a for_each list, with one permission per item, in order
+func expandForEach(permissions RoleDefinition) (RoleDefinition, error) {
+	if !slices.ContainsFunc(permissions, func(p Permission) bool { return p.ForEach != nil }) {
+		return permissions, nil
+	}
+	expanded := make(RoleDefinition, 0, len(permissions))
+	for _, permission := range permissions {
+		if permission.ForEach == nil {
+			expanded = append(expanded, permission)
+			continue
+		}
+		if len(permission.ForEach) == 0 {
+			return nil, fmt.Errorf("for_each of resource %s has no items", permission.Resource)
+		}
+		for _, item := range permission.ForEach {
+			expanded = append(expanded, permission.withItem(item))
+		}
+	}
+	return expanded, nil
+}
+
+// withItem returns a copy of a permission template where "{{.}}" is replaced
+// by an item in every pattern, action and reason
+func (p Permission) withItem(item string) Permission {
+	replace := func(s string) string { return strings.ReplaceAll(s, forEachItem, item) }
+	p.ForEach = nil
+	p.Resource, p.Record, p.Tenant, p.Host, p.Reason = replace(p.Resource), replace(p.Record), replace(p.Tenant), replace(p.Host), replace(p.Reason)
+	if p.ResourceByAction != nil {
+		byAction := make(map[string]string, len(p.ResourceByAction))
+		for action, pattern := range p.ResourceByAction {
+			byAction[action] = replace(pattern)
+		}
+		p.ResourceByAction = byAction
+	}
+	if p.Action.Single != nil {
+		action := replace(*p.Action.Single)
+		p.Action.Single = &action
+	}
+	if p.Action.Multiple != nil {
+		actions := make([]string, len(p.Action.Multiple))
+		for i, action := range p.Action.Multiple {
+			actions[i] = replace(action)
+		}
+		p.Action.Multiple = actions
+	}
+	if p.BodyMatch != nil {
+		p.BodyMatch = &BodyMatch{Path: p.BodyMatch.Path, Value: replace(p.BodyMatch.Value)}
+	}
+	return p
+}
+
+// expandEnv replaces the environment variable placeholders of a string with
+// their values, failing if a variable is not defined
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "{env.") {
+		return s, nil
+	}
+	var err error
+	expanded := envPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := envPlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined environment variable %s", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// expandPermissionEnv replaces the environment variable placeholders of the
+// resource and the actions of a permission
+func expandPermissionEnv(permission *Permission) error {
+	var err error
+	if permission.Resource, err = expandEnv(permission.Resource); err != nil {
+		return err
+	}
+	for action, pattern := range permission.ResourceByAction {
+		if permission.ResourceByAction[action], err = expandEnv(pattern); err != nil {
+			return err
+		}
+	}
+	if permission.Action.Single != nil {
+		action, err := expandEnv(*permission.Action.Single)
+		if err != nil {
+			return err
+		}
+		permission.Action.Single = &action
+	}
+	for i, action := range permission.Action.Multiple {
+		if permission.Action.Multiple[i], err = expandEnv(action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandActionGroups replaces the action groups (e.g. "@item") of a
+// permission with the actions they stand for, in the configured vocabulary
+func (m *Middleware) expandActionGroups(actions ActionType) ActionType {
+	list := actions.Multiple
+	if actions.Single != nil {
+		list = []string{*actions.Single}
+	}
+	if !slices.ContainsFunc(list, func(action string) bool { return m.actionGroup(action) != nil }) {
+		return actions
+	}
+
+	var expanded []string
+	for _, action := range list {
+		if group := m.actionGroup(action); group != nil {
+			expanded = append(expanded, group...)
+		} else {
+			expanded = append(expanded, action)
+		}
+	}
+	return ActionType{Multiple: expanded}
+}
+
+// actionGroup returns the actions an action group stands for, or nil if the
+// action is not a group
+func (m *Middleware) actionGroup(name string) []string {
+	if group, ok := m.ActionGroups[name]; ok {
+		return group
+	}
+	var group []string
+	for _, builtin := range actionGroups[name] {
+		if slices.Contains(m.enabledActions(), builtin) {
+			group = append(group, m.actionName(builtin))
+		}
+	}
+	return group
+}
@@ -0,0 +1,215 @@
+package plugin
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestItemAndCollectionGroups(t *testing.T) {
+	split := false
+	tests := []struct {
+		name   string
+		m      *Middleware
+		action ActionType
+		want   []string
+	}{
+		{"item", &Middleware{}, parseAction("@item"), []string{"show", "edit", "delete"}},
+		{"collection", &Middleware{}, parseAction("@collection"), []string{"list", "create"}},
+		{"mixed", &Middleware{}, ActionType{Multiple: []string{"list", "@item"}}, []string{"list", "show", "edit", "delete"}},
+		{"split put and patch", &Middleware{MergePutPatch: &split}, parseAction("@item"), []string{"show", "replace", "patch", "delete"}},
+		{"references", &Middleware{DetectReferences: true}, parseAction("@collection"), []string{"list", "get_many_reference", "create"}},
+		{"vocabulary", &Middleware{ActionVocabulary: map[string]string{"show": "read", "edit": "update"}}, parseAction("@item"), []string{"read", "update", "delete"}},
+		{"no group", &Middleware{}, parseAction("list,show"), []string{"list", "show"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expanded := test.m.expandActionGroups(test.action)
+			got := expanded.Multiple
+			if expanded.Single != nil {
+				got = []string{*expanded.Single}
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestItemGroupPermissions(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"moderator": [{ "action": "@item", "resource": "comments" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/comments/1", []string{"X-Role", "moderator"}, http.StatusOK},
+		{"PUT", "/comments/1", []string{"X-Role", "moderator"}, http.StatusOK},
+		{"DELETE", "/comments/1", []string{"X-Role", "moderator"}, http.StatusOK},
+		{"GET", "/comments", []string{"X-Role", "moderator"}, http.StatusForbidden},
+		{"POST", "/comments", []string{"X-Role", "moderator"}, http.StatusForbidden},
+	})
+}
+
+func TestCrudAndCustomGroups(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		action_group moderate show edit delete
+		action_group readonly list
+	}`)
+	provision(t, m, `{
+		"admin": [{ "action": "crud", "resource": "*" }],
+		"moderator": [{ "action": ["moderate", "list"], "resource": "comments" }],
+		"viewer": [{ "action": "readonly", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/posts", []string{"X-Role", "admin"}, http.StatusOK},
+		{"DELETE", "/users/1", []string{"X-Role", "admin"}, http.StatusOK},
+		{"GET", "/comments", []string{"X-Role", "moderator"}, http.StatusOK},
+		{"DELETE", "/comments/1", []string{"X-Role", "moderator"}, http.StatusOK},
+		{"POST", "/comments", []string{"X-Role", "moderator"}, http.StatusForbidden},
+		// The configured readonly group replaces the built-in one
+		{"GET", "/posts", []string{"X-Role", "viewer"}, http.StatusOK},
+		{"GET", "/posts/1", []string{"X-Role", "viewer"}, http.StatusForbidden},
+	})
+}
+
+func TestReadonlyGroup(t *testing.T) {
+	m := provision(t, &Middleware{DetectReferences: true}, `{
+		"viewer": [{ "action": "readonly", "resource": "*" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "viewer"}, http.StatusOK},
+		{"GET", "/posts/1", []string{"X-Role", "viewer"}, http.StatusOK},
+		{"GET", "/comments?post_id=1", []string{"X-Role", "viewer"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "viewer"}, http.StatusForbidden},
+		{"PATCH", "/posts/1", []string{"X-Role", "viewer"}, http.StatusForbidden},
+		{"POST", "/posts", []string{"X-Role", "viewer"}, http.StatusForbidden},
+		{"DELETE", "/posts/1", []string{"X-Role", "viewer"}, http.StatusForbidden},
+	})
+
+	// The group is expanded when the roles are loaded
+	permission := m.getRoles()["viewer"][0]
+	if permission.Action.Single != nil || !slices.Equal(permission.Action.Multiple, []string{"list", "get_many_reference", "show"}) {
+		t.Errorf("got actions %+v, want the read actions", permission.Action)
+	}
+}
+
+func TestExpandForEach(t *testing.T) {
+	expanded, err := expandForEach(parseRoles(t, `{
+		"editor": [
+			{ "action": "list", "resource": "users" },
+			{ "action": ["list", "show"], "resource": "{{.}}", "for_each": ["posts", "comments", "tags"] },
+			{ "type": "deny", "action": "delete", "resource": "{{.}}", "record": "{{.}}_1", "reason": "{{.}} are locked", "for_each": ["posts"] }
+		]
+	}`)["editor"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		resource, record, reason string
+	}{
+		{"users", "", ""},
+		{"posts", "", ""},
+		{"comments", "", ""},
+		{"tags", "", ""},
+		{"posts", "posts_1", "posts are locked"},
+	}
+	if len(expanded) != len(want) {
+		t.Fatalf("got %d permissions, want %d", len(expanded), len(want))
+	}
+	for i, permission := range expanded {
+		if permission.Resource != want[i].resource || permission.Record != want[i].record || permission.Reason != want[i].reason || permission.ForEach != nil {
+			t.Errorf("permission %d: got %+v, want %+v", i, permission, want[i])
+		}
+	}
+
+	if _, err := expandForEach(parseRoles(t, `{
+		"editor": [{ "action": "list", "resource": "{{.}}", "for_each": [] }]
+	}`)["editor"]); err == nil {
+		t.Error("expected a for_each without items to be rejected")
+	}
+}
+
+func TestPermissionTemplates(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"editor": [
+			{ "action": ["list", "show"], "resource": "{{.}}", "for_each": ["posts", "comments", "tags"] },
+			{ "action": "edit", "resource": "{{.}}", "record": "{http.request.header.X-User}", "for_each": ["posts"] }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "editor"}, http.StatusOK},
+		{"GET", "/comments/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"GET", "/tags", []string{"X-Role", "editor"}, http.StatusOK},
+		{"GET", "/users", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"GET", "/{{.}}", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"PUT", "/posts/1", []string{"X-Role", "editor", "X-User", "1"}, http.StatusOK},
+		{"PUT", "/comments/1", []string{"X-Role", "editor", "X-User", "1"}, http.StatusForbidden},
+	})
+
+	if err := tryProvision(t, &Middleware{}, `{
+		"editor": [{ "action": "list", "resource": "{{.}}", "for_each": [] }]
+	}`); err == nil {
+		t.Error("expected a for_each without items to be rejected")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("RBAC_TENANT", "acme")
+	t.Setenv("RBAC_EMPTY", "")
+	tests := []struct {
+		s, want string
+		err     bool
+	}{
+		{"posts", "posts", false},
+		{"{env.RBAC_TENANT}_posts", "acme_posts", false},
+		{"{env.RBAC_TENANT}/{env.RBAC_TENANT}", "acme/acme", false},
+		{"posts{env.RBAC_EMPTY}", "posts", false},
+		{"{env.RBAC_UNDEFINED}_posts", "", true},
+		{"{http.request.header.X-Tenant}", "{http.request.header.X-Tenant}", false},
+	}
+	for _, test := range tests {
+		got, err := expandEnv(test.s)
+		if (err != nil) != test.err || (!test.err && got != test.want) {
+			t.Errorf("expandEnv(%q) = %q, %v, want %q (error %v)", test.s, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestEnvironmentVariablesInRoles(t *testing.T) {
+	t.Setenv("RBAC_TENANT", "acme")
+	m := provision(t, &Middleware{}, `{
+		"{env.RBAC_TENANT}_admin": [{ "action": "*", "resource": "{env.RBAC_TENANT}_posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"DELETE", "/acme_posts/1", []string{"X-Role", "acme_admin"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "acme_admin"}, http.StatusForbidden},
+		{"DELETE", "/acme_posts/1", []string{"X-Role", "{env.RBAC_TENANT}_admin"}, http.StatusForbidden},
+	})
+
+	if err := tryProvision(t, &Middleware{}, `{
+		"admin": [{ "action": "*", "resource": "{env.RBAC_UNDEFINED}_posts" }]
+	}`); err == nil {
+		t.Error("expected roles with an undefined environment variable to be rejected")
+	}
+}
+
+func TestPreparedRolesAreSortedByPriority(t *testing.T) {
+	rd, err := (&Middleware{}).prepareRoles(parseRoles(t, `{
+		"editor": [
+			{ "action": "list", "resource": "a" },
+			{ "action": "list", "resource": "b", "priority": 5 },
+			{ "action": "list", "resource": "c", "priority": -1 },
+			{ "action": "list", "resource": "d" },
+			{ "action": "list", "resource": "e", "priority": 5 }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resources string
+	for _, permission := range rd["editor"] {
+		resources += permission.Resource
+	}
+	if resources != "beadc" {
+		t.Errorf("got permissions %q, want %q", resources, "beadc")
+	}
+}
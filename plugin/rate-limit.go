@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultRateLimitedActions are the built-in actions throttled by a rate limit
+// which doesn't list any action
+var defaultRateLimitedActions = []string{"create", "edit", "replace", "patch", "delete", "invoke", "edit_collection", "delete_collection"}
+
+// maxRateLimitBuckets is the number of buckets above which full buckets,
+// which are equivalent to missing ones, are dropped
+const maxRateLimitBuckets = 10000
+
+// RateLimit throttles some actions of a role
+type RateLimit struct {
+	// Role is the throttled role
+	Role string `json:"role"`
+	// Actions are the throttled actions, defaults to create, edit and delete
+	Actions []string `json:"actions,omitempty"`
+	// Limit is the number of requests allowed per window
+	Limit int `json:"limit"`
+	// Window is the duration over which Limit requests are allowed
+	Window caddy.Duration `json:"window"`
+	// PerIP throttles each client IP separately rather than the whole role
+	PerIP bool `json:"per_ip,omitempty"`
+}
+
+// appliesTo checks if the rate limit throttles the action of the role,
+// which may be defined by a role name pattern, e.g. "tenant-*-editor"
+func (rl RateLimit) appliesTo(rd RoleDefinitions, role, action string) bool {
+	if rl.Role != role && rl.Role != rd.roleName(role) {
+		return false
+	}
+	for _, a := range rl.Actions {
+		if a == "*" || a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the bucket key of the request for this rate limit. Roles
+// defined by the same role name pattern are throttled separately.
+func (rl RateLimit) key(r *http.Request, role string) string {
+	if !rl.PerIP {
+		return role
+	}
+	return role + "|" + clientIP(r)
+}
+
+// clientIP returns the IP of the client, as determined by Caddy
+func clientIP(r *http.Request) string {
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenBucket holds the tokens left for a key
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	// rate is the number of tokens regained per second
+	rate float64
+	last time.Time
+}
+
+// refill adds the tokens regained since the last request
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// rateLimiter implements token buckets refilled continuously, so that
+// limit tokens are regained over a window
+type rateLimiter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a rate limiter using the given clock
+func newRateLimiter(now func() time.Time) *rateLimiter {
+	return &rateLimiter{now: now, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the bucket of the key, and returns false if the
+// bucket is empty
+func (l *rateLimiter) allow(key string, limit int, window time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(now)
+		b = &tokenBucket{tokens: float64(limit), last: now}
+		l.buckets[key] = b
+	}
+	b.capacity = float64(limit)
+	b.rate = float64(limit) / window.Seconds()
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets which would be full by now, when there are too many
+func (l *rateLimiter) prune(now time.Time) {
+	if len(l.buckets) < maxRateLimitBuckets {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRateLimitOfRoleNamePattern(t *testing.T) {
+	m := provision(t, &Middleware{
+		RateLimits: []RateLimit{{Role: "tenant-*-editor", Limit: 1, Window: caddy.Duration(time.Hour)}},
+	}, `{
+		"tenant-*-editor": [{ "action": ["create", "edit"], "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/posts", []string{"X-Role", "tenant-1-editor"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Role", "tenant-1-editor"}, http.StatusTooManyRequests},
+		{"PUT", "/posts/1", []string{"X-Role", "tenant-1-editor"}, http.StatusTooManyRequests},
+		// Each role matching the pattern has its own bucket
+		{"POST", "/posts", []string{"X-Role", "tenant-2-editor"}, http.StatusOK},
+	})
+}
+
+func TestRateLimitOfRoleDefinedByPattern(t *testing.T) {
+	m := provision(t, &Middleware{
+		RateLimits: []RateLimit{{Role: "tenant-1-editor", Limit: 1, Window: caddy.Duration(time.Hour)}},
+	}, `{
+		"tenant-*-editor": [{ "action": "create", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/posts", []string{"X-Role", "tenant-1-editor"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Role", "tenant-1-editor"}, http.StatusTooManyRequests},
+		{"POST", "/posts", []string{"X-Role", "tenant-2-editor"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Role", "tenant-2-editor"}, http.StatusOK},
+	})
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(func() time.Time { return now })
+	steps := []struct {
+		elapsed time.Duration
+		allowed bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		// One token is regained every 30 seconds
+		{29 * time.Second, false},
+		{time.Second, true},
+		{0, false},
+		// The bucket never holds more than the limit
+		{time.Hour, true},
+		{0, true},
+		{0, false},
+	}
+	for i, step := range steps {
+		now = now.Add(step.elapsed)
+		if allowed := l.allow("editor", 2, time.Minute); allowed != step.allowed {
+			t.Errorf("step %d: got allowed %v, want %v", i, allowed, step.allowed)
+		}
+	}
+}
+
+func TestRateLimitOfWrites(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		rate_limit editor 2 1h
+		rate_limit reviewer 1 1h {
+			actions delete
+			per_ip
+		}
+	}`)
+	provision(t, m, `{
+		"editor": [{ "action": "*", "resource": "posts" }],
+		"reviewer": [{ "action": "*", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/posts", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "editor"}, http.StatusTooManyRequests},
+		// Reads are not throttled
+		{"GET", "/posts", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "reviewer"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "reviewer"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "reviewer"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "reviewer"}, http.StatusTooManyRequests},
+	})
+	// Each client IP has its own bucket with per_ip
+	r := newRequest("DELETE", "/posts/1", "X-Role", "reviewer")
+	r.RemoteAddr = "192.0.2.2:1234"
+	if res := serve(m, r); res.status != http.StatusOK {
+		t.Errorf("got status %d for another IP, want 200", res.status)
+	}
+}
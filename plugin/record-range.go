@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// numericRange is an inclusive range of record IDs, for numeric record
+// conditions
+type numericRange struct {
+	min, max int64
+}
+
+// numericOperators are the comparison operators of numeric record
+// conditions, with the range of the IDs they admit, or false if they admit
+// none (e.g. "<" with the smallest number)
+var numericOperators = []struct {
+	prefix string
+	bounds func(n int64) (numericRange, bool)
+}{
+	{"<=", func(n int64) (numericRange, bool) { return numericRange{math.MinInt64, n}, true }},
+	{">=", func(n int64) (numericRange, bool) { return numericRange{n, math.MaxInt64}, true }},
+	{"<", func(n int64) (numericRange, bool) { return numericRange{math.MinInt64, n - 1}, n != math.MinInt64 }},
+	{">", func(n int64) (numericRange, bool) { return numericRange{n + 1, math.MaxInt64}, n != math.MaxInt64 }},
+}
+
+// parseNumericRange parses a numeric record condition: "<N", "<=N", ">N",
+// ">=N" or "N..M" (inclusive). It returns false if the pattern is not a
+// numeric condition, and an error if it is an invalid one.
+func parseNumericRange(pattern string) (numericRange, bool, error) {
+	return parseNumericCondition(pattern, func(operand string) (int64, error) {
+		return strconv.ParseInt(strings.TrimSpace(operand), 10, 64)
+	})
+}
+
+// parseNumericCondition parses a numeric record condition like
+// parseNumericRange, with its operands parsed by a function, e.g. to resolve
+// placeholders. The operator comes from the pattern as written.
+func parseNumericCondition(pattern string, parseOperand func(string) (int64, error)) (numericRange, bool, error) {
+	for _, operator := range numericOperators {
+		if number, ok := strings.CutPrefix(pattern, operator.prefix); ok {
+			n, err := parseOperand(number)
+			if err != nil {
+				return numericRange{}, true, fmt.Errorf("invalid numeric record condition %q", pattern)
+			}
+			bounds, ok := operator.bounds(n)
+			if !ok {
+				return numericRange{}, true, fmt.Errorf("numeric record condition %q matches no record", pattern)
+			}
+			return bounds, true, nil
+		}
+	}
+
+	from, to, ok := strings.Cut(pattern, "..")
+	if !ok {
+		return numericRange{}, false, nil
+	}
+	min, errMin := parseOperand(from)
+	max, errMax := parseOperand(to)
+	if errMin != nil || errMax != nil || min > max {
+		return numericRange{}, true, fmt.Errorf("invalid numeric record range %q", pattern)
+	}
+	return numericRange{min, max}, true, nil
+}
+
+// contains checks if a record ID is a number within the range
+func (r numericRange) contains(record string) bool {
+	n, err := strconv.ParseInt(record, 10, 64)
+	return err == nil && n >= r.min && n <= r.max
+}
+
+// recordRanges parses the numeric conditions of the record patterns of a
+// permission, in its record and in the record part of its resource patterns,
+// by pattern. Conditions with placeholders are left out, as they are only
+// known per request.
+func (p Permission) recordRanges() (map[string]numericRange, error) {
+	patterns := []string{p.Record}
+	for _, resource := range append([]string{p.Resource}, slices.Collect(maps.Values(p.ResourceByAction))...) {
+		resource = strings.TrimPrefix(resource, "!")
+		if _, record, ok := strings.Cut(resource, "/"); ok && !strings.HasPrefix(resource, "path:") {
+			patterns = append(patterns, record)
+		}
+	}
+
+	var ranges map[string]numericRange
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "{") {
+			continue
+		}
+		numeric, ok, err := parseNumericRange(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if ranges == nil {
+				ranges = make(map[string]numericRange)
+			}
+			ranges[pattern] = numeric
+		}
+	}
+	return ranges, nil
+}
+
+// matchRecord checks if a record pattern matches the record of the target,
+// supporting numeric conditions besides wildcards and placeholders.
+// Non-numeric records never match numeric conditions. The ranges are the
+// numeric conditions parsed beforehand by pattern.
+func matchRecord(pattern string, t target, ranges map[string]numericRange) bool {
+	if numeric, ok := ranges[pattern]; ok {
+		return numeric.contains(t.record)
+	}
+	numeric, ok, err := parseNumericCondition(pattern, func(operand string) (int64, error) {
+		// Placeholders in operands must resolve to numbers
+		resolved, ok := resolvePattern(operand, t)
+		if !ok {
+			return 0, fmt.Errorf("unresolved operand %q", operand)
+		}
+		return strconv.ParseInt(strings.TrimSpace(resolved), 10, 64)
+	})
+	if ok {
+		return err == nil && numeric.contains(t.record)
+	}
+	return matchPattern(pattern, t.record, t)
+}
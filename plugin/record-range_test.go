@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseNumericRange(t *testing.T) {
+	tests := []struct {
+		pattern string
+		numeric bool
+		valid   bool
+		want    numericRange
+	}{
+		{"5", false, true, numericRange{}},
+		{"*", false, true, numericRange{}},
+		{"<=10", true, true, numericRange{-9223372036854775808, 10}},
+		{"<10", true, true, numericRange{-9223372036854775808, 9}},
+		{">=10", true, true, numericRange{10, 9223372036854775807}},
+		{">10", true, true, numericRange{11, 9223372036854775807}},
+		{"1..100", true, true, numericRange{1, 100}},
+		{"100..1", true, false, numericRange{}},
+		{"<x", true, false, numericRange{}},
+		{"<-9223372036854775808", true, false, numericRange{}},
+		{">9223372036854775807", true, false, numericRange{}},
+		{"<=-9223372036854775808", true, true, numericRange{-9223372036854775808, -9223372036854775808}},
+	}
+	for _, test := range tests {
+		got, numeric, err := parseNumericRange(test.pattern)
+		if numeric != test.numeric || (err == nil) != test.valid || got != test.want {
+			t.Errorf("parseNumericRange(%q) = %v, %v, %v, want %v, %v, valid %v", test.pattern, got, numeric, err, test.want, test.numeric, test.valid)
+		}
+	}
+}
+
+func TestPrepareRolesParsesNumericRanges(t *testing.T) {
+	m := &Middleware{}
+	rd, err := m.prepareRoles(parseRoles(t, `{
+		"reader": [
+			{ "action": "show", "resource": "posts", "record": "1..100" },
+			{ "action": "show", "resource": { "show": "comments/<10" } },
+			{ "action": "edit", "resource": "posts", "record": "<={http.request.header.X-Max}" }
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("preparing roles: %v", err)
+	}
+	permissions := rd["reader"]
+	if got := permissions[0].ranges["1..100"]; got != (numericRange{1, 100}) {
+		t.Errorf("got record range %v, want 1..100", got)
+	}
+	if got := permissions[1].ranges["<10"]; got.max != 9 {
+		t.Errorf("got resource record range %v, want <10", got)
+	}
+	if permissions[2].ranges != nil {
+		t.Errorf("got ranges %v for a condition with placeholders, want none", permissions[2].ranges)
+	}
+
+	if _, err := m.prepareRoles(parseRoles(t, `{
+		"reader": [{ "action": "show", "resource": "posts", "record": ">9223372036854775807" }]
+	}`)); err == nil {
+		t.Error("expected a condition matching no record to be rejected")
+	}
+}
+
+func TestNumericRecordConditions(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"reader": [
+			{ "action": "show", "resource": "posts", "record": "1..100" },
+			{ "action": "show", "resource": "comments/>=50" },
+			{ "action": "show", "resource": "tags", "record": "<{http.request.header.X-Max}" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts/100", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts/101", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/posts/abc", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/comments/50", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/comments/49", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/tags/9", []string{"X-Role", "reader", "X-Max", "10"}, http.StatusOK},
+		{"GET", "/tags/10", []string{"X-Role", "reader", "X-Max", "10"}, http.StatusForbidden},
+		{"GET", "/tags/1", []string{"X-Role", "reader", "X-Max", "-9223372036854775808"}, http.StatusForbidden},
+	})
+}
+
+func TestRecordPatterns(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"user_manager": [
+			{ "action": ["list", "show", "edit"], "resource": "users" },
+			{ "type": "deny", "action": "edit", "resource": "users", "record": "admin-*" }
+		],
+		"self": [{ "action": ["show", "edit"], "resource": "users", "record": "me" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"PUT", "/users/42", []string{"X-Role", "user_manager"}, http.StatusOK},
+		{"PUT", "/users/admin-1", []string{"X-Role", "user_manager"}, http.StatusForbidden},
+		{"GET", "/users/admin-1", []string{"X-Role", "user_manager"}, http.StatusOK},
+		{"GET", "/users/me", []string{"X-Role", "self"}, http.StatusOK},
+		{"PUT", "/users/me", []string{"X-Role", "self"}, http.StatusOK},
+		{"GET", "/users/42", []string{"X-Role", "self"}, http.StatusForbidden},
+		// Record patterns never match collections
+		{"GET", "/users", []string{"X-Role", "self"}, http.StatusForbidden},
+	})
+}
@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// referenceField returns the field referencing a parent record in a request
+// for the records of a collection, e.g. "post_id" for /comments?post_id=1
+// (as sent by ra-data-json-server) or for /comments?filter={"post_id":1} (as
+// sent by ra-data-simple-rest), or an empty string if there is none. When
+// several fields qualify, the first one in alphabetical order is returned.
+func referenceField(r *http.Request) string {
+	query := r.URL.Query()
+	var fields []string
+	for key, values := range query {
+		if strings.HasSuffix(key, "_id") && len(values) > 0 && values[0] != "" {
+			fields = append(fields, key)
+		}
+	}
+	if filter := query.Get("filter"); filter != "" {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(filter), &filters); err == nil {
+			for key, value := range filters {
+				if strings.HasSuffix(key, "_id") && value != nil {
+					fields = append(fields, key)
+				}
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return slices.Min(fields)
+}
+
+// hasIDFilter checks if a request to a collection targets some of its records
+// by their id, e.g. /posts?id=1&id=2 or /posts?filter={"id":[1,2]}, as sent
+// for react-admin's updateMany and deleteMany
+func hasIDFilter(r *http.Request) bool {
+	query := r.URL.Query()
+	if query.Get("id") != "" {
+		return true
+	}
+	if filter := query.Get("filter"); filter != "" {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(filter), &filters); err == nil && filters["id"] != nil {
+			return true
+		}
+	}
+	return false
+}
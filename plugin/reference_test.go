@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestReferenceField(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"post_id=1", "post_id"},
+		{"post_id=", ""},
+		{"user_id=2&post_id=1", "post_id"},
+		{"id=1", ""},
+		{"filter=" + url.QueryEscape(`{"post_id":1}`), "post_id"},
+		{"filter=" + url.QueryEscape(`{"post_id":null}`), ""},
+		{"filter=" + url.QueryEscape(`{"q":"foo"}`), ""},
+		{"filter=not+json", ""},
+	}
+	for _, test := range tests {
+		if got := referenceField(newRequest("GET", "/comments?"+test.query)); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestGetManyReference(t *testing.T) {
+	m := provision(t, &Middleware{DetectReferences: true}, `{
+		"reader": [{ "action": "list", "resource": "comments" }],
+		"post_reader": [{ "action": "get_many_reference:post_id", "resource": "comments" }],
+		"referencer": [{ "action": "get_many_reference", "resource": "comments" }]
+	}`)
+	byPost, byUser := "/comments?post_id=1", "/comments?filter="+url.QueryEscape(`{"user_id":1}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/comments", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", byPost, []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", byPost, []string{"X-Role", "post_reader"}, http.StatusOK},
+		{"GET", byUser, []string{"X-Role", "post_reader"}, http.StatusForbidden},
+		{"GET", "/comments", []string{"X-Role", "post_reader"}, http.StatusForbidden},
+		{"GET", byPost, []string{"X-Role", "referencer"}, http.StatusOK},
+		{"GET", byUser, []string{"X-Role", "referencer"}, http.StatusOK},
+		// Requests for a record are show actions, whatever their query
+		{"GET", "/comments/1?post_id=1", []string{"X-Role", "referencer"}, http.StatusForbidden},
+	})
+}
+
+func TestHasIDFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", false},
+		{"id=1", true},
+		{"id=", false},
+		{"filter=" + url.QueryEscape(`{"id":[1,2]}`), true},
+		{"filter=" + url.QueryEscape(`{"id":null}`), false},
+		{"filter=" + url.QueryEscape(`{"title":"foo"}`), false},
+		{"filter=not+json", false},
+	}
+	for _, test := range tests {
+		if got := hasIDFilter(newRequest("DELETE", "/posts?"+test.query)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCollectionWrites(t *testing.T) {
+	m := &Middleware{DetectCollectionWrites: true}
+	byID := "?filter=" + url.QueryEscape(`{"id":[1,2]}`)
+	tests := []struct {
+		method, target, action string
+	}{
+		{"DELETE", "/posts", "delete_collection"},
+		{"PUT", "/posts", "edit_collection"},
+		{"PATCH", "/posts", "edit_collection"},
+		{"DELETE", "/posts" + byID, "delete"},
+		{"PUT", "/posts?id=1", "edit"},
+		{"DELETE", "/posts/1", "delete"},
+		{"GET", "/posts", "list"},
+	}
+	for _, test := range tests {
+		if action := m.getActionFromRequest(newRequest(test.method, test.target)); action != test.action {
+			t.Errorf("%s %s: got action %q, want %q", test.method, test.target, action, test.action)
+		}
+	}
+	if action := (&Middleware{}).getActionFromRequest(newRequest("DELETE", "/posts")); action != "delete" {
+		t.Errorf("got action %q without detect_collection_writes, want delete", action)
+	}
+
+	provision(t, m, `{
+		"editor": [{ "action": ["delete", "edit"], "resource": "posts" }],
+		"admin": [{ "action": ["delete", "delete_collection"], "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"DELETE", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts" + byID, []string{"X-Role", "editor"}, http.StatusOK},
+		{"DELETE", "/posts", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"PUT", "/posts", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"DELETE", "/posts", []string{"X-Role", "admin"}, http.StatusOK},
+	})
+}
@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxBodyBytes is the maximum size of a request body read to evaluate
+// body conditions, unless configured otherwise
+const defaultMaxBodyBytes int64 = 1 << 20
+
+// requestBody lazily reads and decodes the JSON body of a request, so that it
+// is read at most once whatever the number of permissions inspecting it
+type requestBody struct {
+	r        *http.Request
+	maxBytes int64
+	read     bool
+	value    interface{}
+	ok       bool
+}
+
+// newRequestBody prepares the lazy decoding of the request body
+func newRequestBody(r *http.Request, maxBytes int64) *requestBody {
+	return &requestBody{r: r, maxBytes: maxBytes}
+}
+
+// get returns the decoded JSON body, and false if the body is missing, too
+// large or not valid JSON. The request body is restored so that the next
+// handlers can still read it.
+func (b *requestBody) get() (interface{}, bool) {
+	if b == nil || b.r == nil {
+		return nil, false
+	}
+	if b.read {
+		return b.value, b.ok
+	}
+	b.read = true
+	if b.r.Body == nil || b.r.Body == http.NoBody {
+		return nil, false
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(b.r.Body, b.maxBytes+1))
+	if err != nil || int64(len(buf)) > b.maxBytes {
+		// Give the next handlers what was read, followed by the unread part
+		b.r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), b.r.Body), b.r.Body}
+		return nil, false
+	}
+	b.r.Body.Close()
+	b.r.Body = io.NopCloser(bytes.NewReader(buf))
+
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	if err := decoder.Decode(&b.value); err != nil {
+		return nil, false
+	}
+	b.ok = true
+	return b.value, b.ok
+}
+
+// readCloser combines a reader with the closer of the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// lookupJSONPath returns the value found at a dot-separated path (e.g.
+// "author.id" or "tags.0") in a decoded JSON value, as a string.
+// Objects and arrays cannot be converted to strings and are not found.
+func lookupJSONPath(value interface{}, path string) (string, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, ok := v[key]
+			if !ok {
+				return "", false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return "", false
+			}
+			value = v[index]
+		default:
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "null", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// newBodyRequest builds a request with a body, and the role in the X-Role
+// header
+func newBodyRequest(method, target, role, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("X-Role", role)
+	return r
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(`{"status": "draft", "author": {"id": 42, "admin": false}, "tags": ["a", "b"], "deleted_at": null, "meta": {}}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		want  string
+		found bool
+	}{
+		{"status", "draft", true},
+		{"author.id", "42", true},
+		{"author.admin", "false", true},
+		{"tags.1", "b", true},
+		{"deleted_at", "null", true},
+		{"tags.2", "", false},
+		{"tags.x", "", false},
+		{"meta", "", false},
+		{"author.name", "", false},
+		{"status.length", "", false},
+	}
+	for _, test := range tests {
+		if got, found := lookupJSONPath(value, test.path); got != test.want || found != test.found {
+			t.Errorf("lookupJSONPath(%q) = %q, %v, want %q, %v", test.path, got, found, test.want, test.found)
+		}
+	}
+}
+
+func TestBodyConditions(t *testing.T) {
+	maxBodyBytes := int64(64)
+	m := provision(t, &Middleware{MaxBodyBytes: maxBodyBytes}, `{
+		"writer": [
+			{ "action": "edit", "resource": "posts" },
+			{ "type": "deny", "action": "edit", "resource": "posts", "body_match": { "path": "status", "value": "published" } }
+		],
+		"moderator": [
+			{ "action": "edit", "resource": "comments", "body_match": { "path": "author.id", "value": "4*" } }
+		]
+	}`)
+	tests := []struct {
+		role, target, body string
+		status             int
+	}{
+		{"writer", "/posts/1", `{"status": "draft"}`, http.StatusOK},
+		{"writer", "/posts/1", `{"status": "published"}`, http.StatusForbidden},
+		{"writer", "/posts/1", `not json`, http.StatusOK},
+		{"moderator", "/comments/1", `{"author": {"id": 42}}`, http.StatusOK},
+		{"moderator", "/comments/1", `{"author": {"id": 52}}`, http.StatusForbidden},
+		{"moderator", "/comments/1", `{"author": {"id": 42}, "text": "` + strings.Repeat("x", int(maxBodyBytes)) + `"}`, http.StatusForbidden},
+		{"moderator", "/comments/1", ``, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := newBodyRequest("PUT", test.target, test.role, test.body)
+		caddyhttp.NewTestReplacer(r)
+		var received string
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			body, _ := io.ReadAll(r.Body)
+			received = string(body)
+			return nil
+		})
+		err := m.ServeHTTP(httptest.NewRecorder(), r, next)
+		status := http.StatusOK
+		if handlerErr, ok := err.(caddyhttp.HandlerError); ok {
+			status = handlerErr.StatusCode
+		}
+		if status != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.role, test.body, status, test.status)
+		}
+		if status == http.StatusOK && received != test.body {
+			t.Errorf("%s %s: the next handler received %q", test.role, test.body, received)
+		}
+	}
+}
+
+func TestBodyResource(t *testing.T) {
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tresource_source body:meta.resource batch*\n}")
+	provision(t, m, `{
+		"writer": [
+			{ "action": "create", "resource": "posts" },
+			{ "action": "create", "resource": "batch_jobs" }
+		]
+	}`)
+	tests := []struct {
+		target, body string
+		status       int
+	}{
+		{"/batch", `{"meta": {"resource": "posts"}}`, http.StatusOK},
+		{"/batch", `{"meta": {"resource": "users"}}`, http.StatusForbidden},
+		{"/batch_jobs", `{"meta": {"resource": "posts"}}`, http.StatusOK},
+		// Without a resource in the body, the resource of the path is used
+		{"/batch", `{"meta": {}}`, http.StatusForbidden},
+		{"/batch_jobs", `not json`, http.StatusOK},
+		// Other endpoints ignore the body
+		{"/posts", `{"meta": {"resource": "users"}}`, http.StatusOK},
+		{"/users", `{"meta": {"resource": "posts"}}`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if res := serve(m, newBodyRequest("POST", test.target, "writer", test.body)); res.status != test.status {
+			t.Errorf("POST %s %s: got status %d, want %d", test.target, test.body, res.status, test.status)
+		}
+	}
+}
+
+func TestBodyResourceRequiresEndpoints(t *testing.T) {
+	for _, source := range []string{"body:resource", "query:resource"} {
+		if err := tryProvision(t, &Middleware{ResourceSource: source}, `{"writer": []}`); err == nil {
+			t.Errorf("expected resource_source %s without endpoints to be rejected", source)
+		}
+	}
+}
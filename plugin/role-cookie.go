@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// roleFromCookie returns the role carried by the role cookie of the request,
+// or an empty role if the cookie is missing or invalid. The cookie value is
+// either the role itself, or a JSON object holding the role in the
+// configured field. With a secret, the value must be signed.
+func (m *Middleware) roleFromCookie(r *http.Request) string {
+	cookie, err := r.Cookie(m.RoleCookie)
+	if err != nil {
+		return ""
+	}
+	value := cookie.Value
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		value = unescaped
+	}
+	if m.cookieSecret != nil {
+		var ok bool
+		if value, ok = verifyCookie(value, m.cookieSecret); !ok {
+			return ""
+		}
+	}
+	if m.RoleCookieField == "" {
+		return strings.TrimSpace(value)
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return ""
+	}
+	role, ok := lookupJSONPath(decoded, m.RoleCookieField)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(role)
+}
+
+// verifyCookie checks the signature of a signed cookie value, i.e. the value
+// followed by a dot and its HMAC-SHA256 in unpadded base64url, and returns
+// the value without its signature, or false if the signature is invalid
+func verifyCookie(signed string, secret []byte) (string, bool) {
+	value, signature, ok := cutLast(signed, ".")
+	if !ok {
+		return "", false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return value, hmac.Equal(decoded, mac.Sum(nil))
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const cookieRoles = `{
+	"reader": [{ "action": "list", "resource": "posts" }]
+}`
+
+func TestRoleCookie(t *testing.T) {
+	m := provision(t, &Middleware{RoleCookie: "role"}, cookieRoles)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"Cookie", "role=reader"}, http.StatusOK},
+		{"GET", "/posts", []string{"Cookie", "other=1; role=reader"}, http.StatusOK},
+		{"GET", "/posts", []string{"Cookie", "role=writer"}, http.StatusForbidden},
+		{"GET", "/posts", nil, http.StatusMethodNotAllowed},
+	})
+}
+
+func TestRoleCookieField(t *testing.T) {
+	m := provision(t, &Middleware{RoleCookie: "session", RoleCookieField: "user.role"}, cookieRoles)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"Cookie", "session=" + url.QueryEscape(`{"user": {"role": "reader"}}`)}, http.StatusOK},
+		{"GET", "/posts", []string{"Cookie", "session=" + url.QueryEscape(`{"user": {"name": "jane"}}`)}, http.StatusMethodNotAllowed},
+		{"GET", "/posts", []string{"Cookie", "session=reader"}, http.StatusMethodNotAllowed},
+	})
+}
+
+// signCookie signs a cookie value the way verifyCookie expects
+func signCookie(value, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		signed string
+		value  string
+		ok     bool
+	}{
+		{"valid", signCookie("reader", "secret"), "reader", true},
+		{"dotted value", signCookie("a.b", "secret"), "a.b", true},
+		{"other secret", signCookie("reader", "other"), "", false},
+		{"tampered value", strings.Replace(signCookie("reader", "secret"), "reader", "writer", 1), "", false},
+		{"unsigned", "reader", "", false},
+		{"invalid signature", "reader.!!!", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, ok := verifyCookie(test.signed, []byte("secret"))
+			if ok != test.ok || (ok && value != test.value) {
+				t.Errorf("got %q, %v, want %q, %v", value, ok, test.value, test.ok)
+			}
+		})
+	}
+}
+
+func TestSignedRoleCookie(t *testing.T) {
+	m := provision(t, &Middleware{RoleCookie: "role", RoleCookieSecret: "secret"}, cookieRoles)
+	tampered := strings.Replace(signCookie("reader", "secret"), "reader", "writer", 1)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"Cookie", "role=" + signCookie("reader", "secret")}, http.StatusOK},
+		{"GET", "/posts", []string{"Cookie", "role=" + url.QueryEscape(signCookie("reader", "secret"))}, http.StatusOK},
+		{"GET", "/posts", nil, http.StatusMethodNotAllowed},
+		{"GET", "/posts", []string{"Cookie", "role=reader"}, http.StatusMethodNotAllowed},
+		{"GET", "/posts", []string{"Cookie", "role=" + tampered}, http.StatusMethodNotAllowed},
+		{"GET", "/posts", []string{"Cookie", "role=" + signCookie("reader", "other")}, http.StatusMethodNotAllowed},
+	})
+
+	m = provision(t, &Middleware{RoleCookie: "session", RoleCookieField: "role", RoleCookieSecret: "secret"}, cookieRoles)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"Cookie", "session=" + url.QueryEscape(signCookie(`{"role":"reader"}`, "secret"))}, http.StatusOK},
+		{"GET", "/posts", []string{"Cookie", "session=" + url.QueryEscape(`{"role":"reader"}`)}, http.StatusMethodNotAllowed},
+	})
+}
@@ -1,20 +1,82 @@
 package plugin
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
 )
 
 // ActionType represents an action that can be either a single string or a slice of strings
 type ActionType struct {
-	Single   *string   `json:"-"`
-	Multiple []string  `json:"-"`
+	Single   *string  `json:"-"`
+	Multiple []string `json:"-"`
+}
+
+// actionDelimiters are the characters separating the actions of a single
+// action string, e.g. "list,show" or "list|show"
+const actionDelimiters = ",|"
+
+// parseAction returns the ActionType of an action string, which is split
+// into multiple actions if it contains delimiters
+func parseAction(action string) ActionType {
+	if !strings.ContainsAny(action, actionDelimiters) {
+		return ActionType{Single: &action}
+	}
+	actions := []string{}
+	for _, a := range strings.FieldsFunc(action, func(r rune) bool { return strings.ContainsRune(actionDelimiters, r) }) {
+		if a = strings.TrimSpace(a); a != "" {
+			actions = append(actions, a)
+		}
+	}
+	return ActionType{Multiple: actions}
+}
+
+// UnmarshalJSON implements json.Unmarshaler for ActionType
+func (a *ActionType) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = parseAction(single)
+		return nil
+	}
+	return json.Unmarshal(data, &a.Multiple)
+}
+
+// MarshalJSON implements json.Marshaler for ActionType
+func (a ActionType) MarshalJSON() ([]byte, error) {
+	if a.Single != nil {
+		return json.Marshal(*a.Single)
+	}
+	return json.Marshal(a.Multiple)
+}
+
+// BodyMatch is a condition on a value of the JSON request body
+type BodyMatch struct {
+	Path  string `json:"path"`  // dot-separated path, e.g. "status" or "author.id"
+	Value string `json:"value"` // expected value, with wildcard support
 }
 
 // Permission represents a single permission rule
 type Permission struct {
-	Type     string     `json:"type,omitempty"`     // "allow" (default) or "deny"
-	Action   ActionType `json:"action"`             // string or []string
-	Resource string     `json:"resource"`           // resource pattern
+	Type             string            `json:"type,omitempty"`               // "allow" (default), "deny" or "audit"
+	Action           ActionType        `json:"action"`                       // string or []string
+	Method           string            `json:"method,omitempty"`             // optional HTTP method, e.g. "DELETE"
+	Resource         string            `json:"resource"`                     // resource pattern
+	ResourceByAction map[string]string `json:"resource_by_action,omitempty"` // resource patterns by action, when "resource" is an object
+	Record           string            `json:"record,omitempty"`             // optional record ID pattern
+	Tenant           string            `json:"tenant,omitempty"`             // optional tenant ID pattern
+	Host             string            `json:"host,omitempty"`               // optional host pattern, e.g. "*.example.com"
+	Reason           string            `json:"reason,omitempty"`             // explains why the rule exists, reported on denial
+	BodyMatch        *BodyMatch        `json:"body_match,omitempty"`         // optional condition on the request body
+	ContentType      string            `json:"content_type,omitempty"`       // optional content type the request must accept
+	When             map[string]string `json:"when,omitempty"`               // optional header patterns the request must match, by header name
+	Query            map[string]string `json:"query,omitempty"`              // optional query parameter patterns the request must match, by parameter name
+	Priority         int               `json:"priority,omitempty"`           // permissions with a higher priority are evaluated first
+	Status           int               `json:"status,omitempty"`             // optional status of the requests it denies, e.g. 429, 403 by default
+	ForEach          []string          `json:"for_each,omitempty"`           // makes the permission a template, expanded once per item
+
+	ranges map[string]numericRange // numeric record conditions, parsed once by prepareRoles
 }
 
 // RoleDefinition represents a list of permissions for a role
@@ -23,49 +85,402 @@ type RoleDefinition []Permission
 // RoleDefinitions represents the mapping of role names to their permissions
 type RoleDefinitions map[string]RoleDefinition
 
-// UnmarshalJSON implements json.Unmarshaler for RoleDefinitions
+// SharedRole is the reserved role name whose permissions are shared by every
+// role, as if they were appended to each role definition
+const SharedRole = "*"
+
+// roleName returns the name under which a role is defined: the role itself,
+// or else the role name pattern matching it, e.g. "tenant-*-editor" for
+// "tenant-123-editor", the longest pattern winning. It is empty if the role
+// is not defined.
+func (rd RoleDefinitions) roleName(role string) string {
+	if _, exists := rd[role]; exists {
+		return role
+	}
+	var name string
+	for pattern := range rd {
+		if pattern == SharedRole || !strings.Contains(pattern, "*") || !matchGlob(pattern, role) {
+			continue
+		}
+		if len(pattern) > len(name) || (len(pattern) == len(name) && pattern < name) {
+			name = pattern
+		}
+	}
+	return name
+}
+
+// matchGlob checks if a role name pattern, where "*" stands for any
+// characters, matches a role
+func matchGlob(pattern, role string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == role
+	}
+	if !strings.HasPrefix(role, parts[0]) {
+		return false
+	}
+	role = role[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(role, part)
+		if i < 0 {
+			return false
+		}
+		role = role[i+len(part):]
+	}
+	return strings.HasSuffix(role, parts[len(parts)-1])
+}
+
+// permissionsFor returns the permissions of a role, followed by the shared
+// permissions, and false if the role is not defined
+func (rd RoleDefinitions) permissionsFor(role string) (RoleDefinition, bool) {
+	role = rd.roleName(role)
+	if role == SharedRole {
+		return nil, false
+	}
+	permissions, exists := rd[role]
+	if !exists {
+		return nil, false
+	}
+	shared := rd[SharedRole]
+	if len(shared) == 0 {
+		return permissions, true
+	}
+	combined := make(RoleDefinition, 0, len(permissions)+len(shared))
+	combined = append(combined, permissions...)
+	return append(combined, shared...), true
+}
+
+// permissionsForRoles returns the permissions of several roles, in order,
+// followed by the shared permissions, and false if none of the roles is
+// defined
+func (rd RoleDefinitions) permissionsForRoles(roles []string) (RoleDefinition, bool) {
+	var combined RoleDefinition
+	exists := false
+	for _, role := range roles {
+		role = rd.roleName(role)
+		if permissions, ok := rd[role]; ok && role != SharedRole {
+			combined = append(combined, permissions...)
+			exists = true
+		}
+	}
+	if !exists {
+		return nil, false
+	}
+	return append(combined, rd[SharedRole]...), true
+}
+
+// permissiveRoles returns the roles allowed to do anything, mapped to the
+// permission allowing it. To be on the safe side, a role is only permissive
+// when all its permissions (including the shared ones) allow any action on
+// any resource without any condition, so that the same one always decides.
+func (rd RoleDefinitions) permissiveRoles() map[string]*Permission {
+	permissive := make(map[string]*Permission)
+	for role := range rd {
+		permissions, exists := rd.permissionsFor(role)
+		if !exists || len(permissions) == 0 {
+			continue
+		}
+		if slices.ContainsFunc(permissions, func(p Permission) bool { return !p.allowsEverything() }) {
+			continue
+		}
+		permissive[role] = evaluatePermissions(permissions, target{}, DenyWins).MatchedPermission
+	}
+	return permissive
+}
+
+// staticRoles tells which roles have decisions depending only on the action
+// and the resource, none of their permissions (including the shared ones)
+// having a condition on the request
+func (rd RoleDefinitions) staticRoles() map[string]bool {
+	static := make(map[string]bool, len(rd))
+	for role := range rd {
+		permissions, _ := rd.permissionsFor(role)
+		static[role] = !slices.ContainsFunc(permissions, func(p Permission) bool { return !p.isStatic() })
+	}
+	return static
+}
+
+// isStatic checks if a permission only depends on the action and the
+// resource of the request
+func (p Permission) isStatic() bool {
+	if p.Method != "" || p.Record != "" || p.Tenant != "" || p.Host != "" || p.BodyMatch != nil || p.ContentType != "" || p.When != nil || p.Query != nil {
+		return false
+	}
+	for _, pattern := range p.ResourceByAction {
+		if !isStaticResource(pattern) {
+			return false
+		}
+	}
+	return isStaticResource(p.Resource)
+}
+
+// isStaticResource checks if a resource pattern only depends on the resource
+// of the request, and not on its path, its record or placeholders
+func isStaticResource(pattern string) bool {
+	return !strings.HasPrefix(strings.TrimPrefix(pattern, "!"), "path:") && !strings.ContainsAny(pattern, "{/")
+}
+
+// resourcePattern returns the resource pattern of a permission for an
+// action, and false if the permission has no pattern for this action
+func (p Permission) resourcePattern(action string) (string, bool) {
+	if p.ResourceByAction == nil {
+		return p.Resource, true
+	}
+	if pattern, ok := p.ResourceByAction[action]; ok {
+		return pattern, true
+	}
+	pattern, ok := p.ResourceByAction["*"]
+	return pattern, ok
+}
+
+// validateStatus checks that the status of the permission, if any, is the
+// status of an error
+func (p Permission) validateStatus() error {
+	if p.Status != 0 && (p.Status < 400 || p.Status > 599) {
+		return fmt.Errorf("permission status must be an error status, got %d", p.Status)
+	}
+	return nil
+}
+
+// isAudit checks if a permission only flags matching requests in logs,
+// without taking part in the decision
+func (p Permission) isAudit() bool {
+	return p.Type == "audit"
+}
+
+// auditPermissions returns the audit permissions of the roles having any,
+// the shared ones being kept under SharedRole
+func (rd RoleDefinitions) auditPermissions() map[string]RoleDefinition {
+	audits := make(map[string]RoleDefinition)
+	for role, permissions := range rd {
+		for _, permission := range permissions {
+			if permission.isAudit() {
+				audits[role] = append(audits[role], permission)
+			}
+		}
+	}
+	return audits
+}
+
+// allowsEverything checks if a permission allows any action on any resource,
+// whatever the request
+func (p Permission) allowsEverything() bool {
+	if (p.Type != "" && p.Type != "allow") || p.Resource != "*" || (p.Method != "" && p.Method != "*") {
+		return false
+	}
+	if p.Record != "" || p.Tenant != "" || p.Host != "" || p.BodyMatch != nil || p.ContentType != "" || p.When != nil || p.Query != nil {
+		return false
+	}
+	if p.Action.Multiple != nil {
+		return slices.Contains(p.Action.Multiple, "*") && !slices.ContainsFunc(p.Action.Multiple, func(action string) bool {
+			return strings.HasPrefix(action, "!")
+		})
+	}
+	return p.Action.Single != nil && *p.Action.Single == "*"
+}
+
+// UnmarshalJSON implements json.Unmarshaler for RoleDefinitions. Besides the
+// object mapping role names to their permissions, it accepts a flat policy:
+// an array of statements, each carrying the roles it applies to.
 func (rd *RoleDefinitions) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return rd.unmarshalPolicy(data)
+	}
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return fmt.Errorf("roles must be a JSON object mapping role names to their permissions, such as {\"role\": [permissions...]}, got %s", excerpt(trimmed))
+	}
+
 	var raw map[string][]map[string]interface{}
 	if err := json.Unmarshal(data, &raw); err != nil {
-		return err
+		return fmt.Errorf("roles must map role names to arrays of permission objects, such as {\"role\": [{\"action\": \"list\", \"resource\": \"posts\"}]}: %v", err)
 	}
-	
+
 	*rd = make(RoleDefinitions)
 	for roleName, permissions := range raw {
 		var roleDef RoleDefinition
 		for _, perm := range permissions {
-			permission := Permission{}
-			
-			// Handle type field
-			if t, ok := perm["type"].(string); ok {
-				permission.Type = t
+			roleDef = append(roleDef, parsePermission(perm))
+		}
+		(*rd)[roleName] = roleDef
+	}
+
+	return nil
+}
+
+// unmarshalPolicy compiles a flat policy, i.e. an array of statements such as
+// {"roles": ["user", "writer"], "action": "list", "resource": "posts"}, into
+// role definitions. The order of statements is kept within each role.
+func (rd *RoleDefinitions) unmarshalPolicy(data []byte) error {
+	var statements []map[string]interface{}
+	if err := json.Unmarshal(data, &statements); err != nil {
+		return fmt.Errorf("a flat policy must be an array of statement objects, such as [{\"roles\": [\"user\"], \"action\": \"list\", \"resource\": \"posts\"}]: %v", err)
+	}
+
+	*rd = make(RoleDefinitions)
+	for i, statement := range statements {
+		var roles []string
+		switch v := statement["roles"].(type) {
+		case string:
+			roles = []string{v}
+		case []interface{}:
+			roles = stringList(v)
+		}
+		if len(roles) == 0 {
+			return fmt.Errorf("policy statement %d has no roles", i)
+		}
+		permission := parsePermission(statement)
+		for _, role := range roles {
+			(*rd)[role] = append((*rd)[role], permission)
+		}
+	}
+
+	return nil
+}
+
+// excerpt returns the first bytes of a JSON document, for error messages
+func excerpt(data []byte) string {
+	const maxLength = 40
+	if len(data) == 0 {
+		return "nothing"
+	}
+	if len(data) > maxLength {
+		return fmt.Sprintf("%q...", data[:maxLength])
+	}
+	return fmt.Sprintf("%q", data)
+}
+
+// parsePermission builds a permission from its JSON object, ignoring the
+// fields which don't have the expected type
+func parsePermission(perm map[string]interface{}) Permission {
+	permission := Permission{}
+
+	// Handle type field
+	if t, ok := perm["type"].(string); ok {
+		permission.Type = t
+	}
+
+	// Handle method field
+	if m, ok := perm["method"].(string); ok {
+		permission.Method = m
+	}
+
+	// Handle resource field (string, or object mapping actions to resources)
+	switch r := perm["resource"].(type) {
+	case string:
+		permission.Resource = r
+	case map[string]interface{}:
+		permission.ResourceByAction = make(map[string]string, len(r))
+		for action, pattern := range r {
+			if pattern, ok := pattern.(string); ok {
+				permission.ResourceByAction[action] = pattern
 			}
-			
-			// Handle resource field
-			if r, ok := perm["resource"].(string); ok {
-				permission.Resource = r
+		}
+	}
+
+	// Handle record field
+	if r, ok := perm["record"].(string); ok {
+		permission.Record = r
+	}
+
+	// Handle tenant field
+	if t, ok := perm["tenant"].(string); ok {
+		permission.Tenant = t
+	}
+
+	// Handle host field
+	if h, ok := perm["host"].(string); ok {
+		permission.Host = h
+	}
+
+	// Handle reason field
+	if r, ok := perm["reason"].(string); ok {
+		permission.Reason = r
+	}
+
+	// Handle content_type field, also called accept
+	if ct, ok := perm["content_type"].(string); ok {
+		permission.ContentType = ct
+	} else if accept, ok := perm["accept"].(string); ok {
+		permission.ContentType = accept
+	}
+
+	// Handle when field
+	if w, ok := perm["when"].(map[string]interface{}); ok {
+		permission.When = make(map[string]string, len(w))
+		for header, pattern := range w {
+			if pattern, ok := pattern.(string); ok {
+				permission.When[header] = pattern
 			}
-			
-			// Handle action field (string or []string)
-			if action, ok := perm["action"]; ok {
-				switch v := action.(type) {
-				case string:
-					permission.Action.Single = &v
-				case []interface{}:
-					var actions []string
-					for _, item := range v {
-						if str, ok := item.(string); ok {
-							actions = append(actions, str)
-						}
-					}
-					permission.Action.Multiple = actions
-				}
+		}
+	}
+
+	// Handle query field
+	if q, ok := perm["query"].(map[string]interface{}); ok {
+		permission.Query = make(map[string]string, len(q))
+		for param, pattern := range q {
+			if pattern, ok := pattern.(string); ok {
+				permission.Query[param] = pattern
 			}
-			
-			roleDef = append(roleDef, permission)
 		}
-		(*rd)[roleName] = roleDef
 	}
-	
-	return nil
+
+	// Handle priority field
+	if p, ok := perm["priority"].(float64); ok {
+		permission.Priority = int(p)
+	}
+
+	// Handle status field
+	if s, ok := perm["status"].(float64); ok {
+		permission.Status = int(s)
+	}
+
+	// Handle for_each field, kept empty rather than nil when it has no
+	// items, so that it can be reported
+	if items, ok := perm["for_each"].([]interface{}); ok {
+		permission.ForEach = append([]string{}, stringList(items)...)
+	}
+
+	// Handle body_match field
+	if bm, ok := perm["body_match"].(map[string]interface{}); ok {
+		condition := &BodyMatch{}
+		if p, ok := bm["path"].(string); ok {
+			condition.Path = p
+		}
+		if v, ok := bm["value"].(string); ok {
+			condition.Value = v
+		}
+		permission.BodyMatch = condition
+	}
+
+	// Handle action field (string or []string)
+	if action, ok := perm["action"]; ok {
+		switch v := action.(type) {
+		case string:
+			permission.Action = parseAction(v)
+		case []interface{}:
+			permission.Action.Multiple = stringList(v)
+		}
+	}
+
+	// Permissions with resources by action apply to these actions by default
+	if permission.ResourceByAction != nil && permission.Action.Single == nil && permission.Action.Multiple == nil {
+		for action := range permission.ResourceByAction {
+			permission.Action.Multiple = append(permission.Action.Multiple, action)
+		}
+		slices.Sort(permission.Action.Multiple)
+	}
+
+	return permission
+}
+
+// stringList returns the strings of a JSON array, ignoring other values
+func stringList(items []interface{}) []string {
+	var list []string
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			list = append(list, str)
+		}
+	}
+	return list
 }
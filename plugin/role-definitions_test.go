@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSharedRole(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"*": [
+			{ "action": "list", "resource": "*" },
+			{ "type": "deny", "action": "list", "resource": "audit_logs" }
+		],
+		"reader": [],
+		"writer": [{ "action": ["create", "edit"], "resource": "posts" }],
+		"admin": [{ "action": "*", "resource": "*" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/comments", []string{"X-Role", "writer"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Role", "writer"}, http.StatusOK},
+		// Shared deny rules apply to every role
+		{"GET", "/audit_logs", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/audit_logs", []string{"X-Role", "admin"}, http.StatusForbidden},
+		{"DELETE", "/audit_logs/1", []string{"X-Role", "admin"}, http.StatusOK},
+		// The shared role is not a role itself
+		{"GET", "/posts", []string{"X-Role", "*"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "guest"}, http.StatusForbidden},
+	})
+}
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		action string
+		want   []string
+	}{
+		{"show", []string{"show"}},
+		{"list,show", []string{"list", "show"}},
+		{"list|show", []string{"list", "show"}},
+		{" list , show |edit ", []string{"list", "show", "edit"}},
+		{"list,,show,", []string{"list", "show"}},
+	}
+	for _, test := range tests {
+		parsed := parseAction(test.action)
+		got := parsed.Multiple
+		if parsed.Single != nil {
+			got = []string{*parsed.Single}
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("parseAction(%q) = %q, want %q", test.action, got, test.want)
+		}
+	}
+}
+
+func TestActionLists(t *testing.T) {
+	for _, action := range []string{`["list", "show"]`, `"list,show"`, `"list|show"`} {
+		m := provision(t, &Middleware{}, `{"reader": [{ "action": `+action+`, "resource": "posts" }]}`)
+		expectStatuses(t, m, []request{
+			{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+			{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+			{"DELETE", "/posts/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+		})
+	}
+}
+
+func TestFlatPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   map[string][]string
+		err    bool
+	}{
+		{
+			name: "roles",
+			policy: `[
+				{ "roles": ["guest", "user"], "action": "list", "resource": "posts" },
+				{ "roles": "user", "action": "show", "resource": "posts" },
+				{ "roles": ["user"], "type": "deny", "action": "show", "resource": "posts.views" }
+			]`,
+			want: map[string][]string{
+				"guest": {"posts"},
+				"user":  {"posts", "posts", "posts.views"},
+			},
+		},
+		{name: "empty", policy: `[]`, want: map[string][]string{}},
+		{name: "no roles", policy: `[{ "action": "list", "resource": "posts" }]`, err: true},
+		{name: "empty roles", policy: `[{ "roles": [], "action": "list", "resource": "posts" }]`, err: true},
+		{name: "not statements", policy: `["user"]`, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rd RoleDefinitions
+			err := rd.UnmarshalJSON([]byte(test.policy))
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rd) != len(test.want) {
+				t.Fatalf("got %d roles, want %d", len(rd), len(test.want))
+			}
+			for role, resources := range test.want {
+				var got []string
+				for _, permission := range rd[role] {
+					got = append(got, permission.Resource)
+				}
+				if !slices.Equal(got, resources) {
+					t.Errorf("role %s: got resources %q, want %q", role, got, resources)
+				}
+			}
+		})
+	}
+}
+
+func TestFlatPolicyIsEquivalentToRoles(t *testing.T) {
+	m := provision(t, &Middleware{}, `[
+		{ "roles": ["guest"], "action": "list", "resource": "posts" },
+		{ "roles": ["user"], "action": ["list", "show"], "resource": "posts" },
+		{ "roles": ["guest", "user"], "type": "deny", "action": "list", "resource": "posts" }
+	]`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "guest"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "user"}, http.StatusForbidden},
+		{"GET", "/posts/1", []string{"X-Role", "user"}, http.StatusOK},
+		{"GET", "/posts/1", []string{"X-Role", "guest"}, http.StatusForbidden},
+	})
+}
+
+func TestPermissiveRoles(t *testing.T) {
+	rd := parseRoles(t, `{
+		"admin": [{ "action": "*", "resource": "*" }],
+		"admins": [{ "action": ["list", "*"], "resource": "*" }, { "action": "*", "resource": "*" }],
+		"denied": [{ "action": "*", "resource": "*" }, { "type": "deny", "action": "delete", "resource": "users" }],
+		"methods": [{ "action": "*", "method": "GET", "resource": "*" }],
+		"records": [{ "action": "*", "resource": "*", "record": "1" }],
+		"tenants": [{ "action": "*", "resource": "*", "tenant": "acme" }],
+		"posts": [{ "action": "*", "resource": "posts" }],
+		"lists": [{ "action": "list", "resource": "*" }],
+		"empty": []
+	}`)
+	permissive := rd.permissiveRoles()
+	for _, role := range []string{"admin", "admins"} {
+		if permissive[role] == nil {
+			t.Errorf("expected %s to be permissive", role)
+		}
+	}
+	for _, role := range []string{"denied", "methods", "records", "tenants", "posts", "lists", "empty"} {
+		if permissive[role] != nil {
+			t.Errorf("expected %s not to be permissive", role)
+		}
+	}
+
+	rd = parseRoles(t, `{
+		"*": [{ "type": "deny", "action": "*", "resource": "secrets" }],
+		"admin": [{ "action": "*", "resource": "*" }]
+	}`)
+	if rd.permissiveRoles()["admin"] != nil {
+		t.Error("expected shared deny rules to disable the fast path")
+	}
+}
+
+// BenchmarkPermissiveRole compares the decisions of a role allowed to do
+// anything, with and without evaluating its permissions
+func BenchmarkPermissiveRole(b *testing.B) {
+	m := &Middleware{}
+	m.setRoles(parseRoles(b, `{"admin": [{ "action": "*", "resource": "*" }]}`))
+	policy := m.getPolicy()
+	t := target{action: "edit", resource: "posts", record: "1", path: "/posts/1"}
+
+	b.Run("fast path", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			policy.decide("admin", t)
+		}
+	})
+	b.Run("evaluated", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			permissions, _ := policy.roles.permissionsFor("admin")
+			evaluatePermissions(permissions, t, DenyWins)
+		}
+	})
+}
+
+func TestInvalidRolesErrors(t *testing.T) {
+	tests := []struct {
+		roles, want string
+	}{
+		{``, "got nothing"},
+		{`"reader"`, `got "\"reader\""`},
+		{`42`, `got "42"`},
+		{`{"reader": {"action": "list"}}`, "roles must map role names to arrays of permission objects"},
+		{`[["reader"]]`, "a flat policy must be an array of statement objects"},
+		{`"` + strings.Repeat("x", 50) + `"`, `xxx"...`},
+	}
+	for _, test := range tests {
+		var rd RoleDefinitions
+		err := rd.UnmarshalJSON([]byte(test.roles))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want it to contain %q", test.roles, err, test.want)
+		}
+	}
+}
+
+func TestResourceByAction(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"author": [{ "resource": { "list": "*", "show": "*", "create": "drafts" } }],
+		"editor": [{ "action": ["list", "edit"], "resource": { "edit": "posts", "*": "*" } }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "author"}, http.StatusOK},
+		{"GET", "/comments/1", []string{"X-Role", "author"}, http.StatusOK},
+		{"POST", "/drafts", []string{"X-Role", "author"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Role", "author"}, http.StatusForbidden},
+		{"DELETE", "/drafts/1", []string{"X-Role", "author"}, http.StatusForbidden},
+		{"GET", "/comments", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PUT", "/comments/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+		// The action restricts the actions of the object
+		{"GET", "/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+	})
+
+	tests := []struct {
+		action, pattern string
+		ok              bool
+	}{
+		{"edit", "posts", true},
+		{"list", "*", true},
+		{"delete", "*", true},
+	}
+	permission := m.getRoles()["editor"][0]
+	for _, test := range tests {
+		if pattern, ok := permission.resourcePattern(test.action); pattern != test.pattern || ok != test.ok {
+			t.Errorf("resourcePattern(%s) = %q, %v, want %q, %v", test.action, pattern, ok, test.pattern, test.ok)
+		}
+	}
+	if _, ok := m.getRoles()["author"][0].resourcePattern("delete"); ok {
+		t.Error("expected no resource pattern for an action missing from the object")
+	}
+}
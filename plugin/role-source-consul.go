@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// consulWait is the longest time a blocking query waits for the key to
+// change, before being sent again
+const consulWait = 5 * time.Minute
+
+// consulRetryDelay is the delay before watching the key again after an error
+const consulRetryDelay = 5 * time.Second
+
+// consulRoleSource loads role definitions from a key of the Consul KV store,
+// whose value is a JSON roles file. The key is watched with blocking
+// queries, so that changes apply without polling. It uses the Consul HTTP
+// API, so as not to depend on the Consul client.
+type consulRoleSource struct {
+	// address is the URL of the Consul agent, e.g. "http://127.0.0.1:8500"
+	address string
+	key     string
+	// token is the ACL token sent with the queries, if any
+	token string
+	// maxBytes is the maximum size of the value, unlimited if 0
+	maxBytes int64
+	// timeout bounds the time taken to load the roles, unlimited if 0
+	timeout time.Duration
+	client  *http.Client
+	// ctx stops watching the key when done
+	ctx context.Context
+	// onError is called when watching the key fails, the current roles
+	// being kept
+	onError func(error)
+	// index is the index of the key when the roles were last loaded, from
+	// which changes are watched
+	index atomic.Uint64
+}
+
+// newConsulRoleSource returns a role source for a Consul key given as an
+// URL, e.g. "http://127.0.0.1:8500/config/rbac/roles"
+func newConsulRoleSource(ctx context.Context, rawURL string) (*consulRoleSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid roles_consul %q, expected http(s)://<address>/<key>", rawURL)
+	}
+	key := strings.Trim(u.Path, "/")
+	if key == "" {
+		return nil, fmt.Errorf("roles_consul %q has no key", rawURL)
+	}
+	return &consulRoleSource{
+		address: u.Scheme + "://" + u.Host,
+		key:     key,
+		client:  &http.Client{},
+		ctx:     ctx,
+	}, nil
+}
+
+// Load implements RoleSource.
+func (s *consulRoleSource) Load() (RoleDefinitions, error) {
+	ctx := s.ctx
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	rd, index, err := s.get(ctx, 0)
+	if err == nil {
+		s.index.Store(index)
+	}
+	return rd, err
+}
+
+// Watch implements RoleSource, calling onChange whenever the index of the
+// key changes, starting from the index of the roles last loaded so that no
+// change is missed in between.
+func (s *consulRoleSource) Watch(onChange func(RoleDefinitions)) {
+	go func() {
+		index := s.index.Load()
+		for s.ctx.Err() == nil {
+			rd, newIndex, err := s.get(s.ctx, index)
+			if err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+				s.onError(err)
+				select {
+				case <-s.ctx.Done():
+				case <-time.After(consulRetryDelay):
+				}
+				continue
+			}
+			// Without an index in the response, queries don't block: wait
+			// before the next one rather than hammering Consul
+			unindexed := newIndex == 0
+			// Without an index, the query only gets the current one, the
+			// roles being loaded already
+			changed := index != 0 && !unindexed && newIndex != index
+			// Indexes going backwards must reset the watch, see
+			// https://developer.hashicorp.com/consul/api-docs/features/blocking
+			if newIndex < index {
+				newIndex = 0
+			}
+			index = newIndex
+			if changed {
+				onChange(rd)
+			}
+			if unindexed {
+				select {
+				case <-s.ctx.Done():
+				case <-time.After(consulRetryDelay):
+				}
+			}
+		}
+	}()
+}
+
+// get reads the roles of the key, along with its index. If index is not 0,
+// the query blocks until the index of the key changes or the wait expires.
+func (s *consulRoleSource) get(ctx context.Context, index uint64) (RoleDefinitions, uint64, error) {
+	query := url.Values{"raw": {""}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.address+"/v1/kv/"+s.key+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying Consul key %s: %w", s.key, err)
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying Consul key %s: %w", s.key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, fmt.Errorf("Consul key %s not found", s.key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("querying Consul key %s: %s", s.key, resp.Status)
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	var reader io.Reader = resp.Body
+	if s.maxBytes > 0 {
+		reader = io.LimitReader(reader, s.maxBytes+1)
+	}
+	value, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading Consul key %s: %w", s.key, err)
+	}
+	if s.maxBytes > 0 && int64(len(value)) > s.maxBytes {
+		return nil, 0, fmt.Errorf("Consul key %s is larger than max_roles_bytes (%d bytes)", s.key, s.maxBytes)
+	}
+	var rd RoleDefinitions
+	if err := rd.UnmarshalJSON(value); err != nil {
+		return nil, 0, fmt.Errorf("parsing Consul key %s: %w", s.key, err)
+	}
+	return rd, newIndex, nil
+}
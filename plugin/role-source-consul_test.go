@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves a Consul key whose value and index can be changed,
+// answering blocking queries as soon as the index differs
+type fakeConsul struct {
+	mu      sync.Mutex
+	value   string
+	index   uint64
+	noIndex bool
+	queries atomic.Int32
+}
+
+func (c *fakeConsul) set(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value, c.index = value, c.index+1
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.queries.Add(1)
+	for {
+		c.mu.Lock()
+		value, index := c.value, c.index
+		c.mu.Unlock()
+		if wait := r.URL.Query().Get("index"); wait == "" || wait != strconv.FormatUint(index, 10) {
+			if !c.noIndex {
+				w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+			}
+			w.Write([]byte(value))
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// newTestConsulSource returns a role source watching a fake Consul key
+func newTestConsulSource(t *testing.T, consul *fakeConsul) *consulRoleSource {
+	t.Helper()
+	server := httptest.NewServer(consul)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+	})
+	source, err := newConsulRoleSource(ctx, server.URL+"/config/rbac/roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.onError = func(err error) { t.Log(err) }
+	return source
+}
+
+func TestConsulWatchesChangesSinceLoad(t *testing.T) {
+	consul := &fakeConsul{}
+	consul.set(`{"reader": []}`)
+	source := newTestConsulSource(t, consul)
+	if _, err := source.Load(); err != nil {
+		t.Fatalf("loading roles: %v", err)
+	}
+
+	// The key changes between the load and the first watch query
+	consul.set(`{"editor": []}`)
+	changes := make(chan RoleDefinitions, 1)
+	source.Watch(func(rd RoleDefinitions) { changes <- rd })
+	select {
+	case rd := <-changes:
+		if _, ok := rd["editor"]; !ok {
+			t.Errorf("got roles %v, want the editor role", rd)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the change made before watching was missed")
+	}
+}
+
+func TestConsulWatchBacksOffWithoutIndex(t *testing.T) {
+	consul := &fakeConsul{noIndex: true}
+	consul.set(`{"reader": []}`)
+	source := newTestConsulSource(t, consul)
+	if _, err := source.Load(); err != nil {
+		t.Fatalf("loading roles: %v", err)
+	}
+	source.Watch(func(rd RoleDefinitions) { t.Errorf("unexpected change %v", rd) })
+	time.Sleep(200 * time.Millisecond)
+	// The load, and a single watch query waiting for the retry delay
+	if got := consul.queries.Load(); got > 2 {
+		t.Errorf("got %d queries without an index, want at most 2", got)
+	}
+}
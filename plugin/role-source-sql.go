@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// rolesQuery selects the permissions stored in the database, in order
+const rolesQuery = `SELECT role, type, action, resource FROM rbac_permissions ORDER BY id`
+
+// sqlRoleSource loads role definitions from a database/sql database, such as
+// SQLite. The database driver must be registered under the configured name,
+// e.g. by building Caddy with modernc.org/sqlite for the "sqlite" driver.
+//
+// Permissions are read from the rbac_permissions table, with one action (or
+// a delimited list of actions) per row:
+//
+//	CREATE TABLE rbac_permissions (
+//		id       INTEGER PRIMARY KEY,
+//		role     TEXT NOT NULL,
+//		type     TEXT,          -- "allow" (default), "deny" or "audit"
+//		action   TEXT NOT NULL,
+//		resource TEXT NOT NULL
+//	);
+type sqlRoleSource struct {
+	driver string
+	dsn    string
+	// maxBytes is the maximum total size of the rows, unlimited if 0
+	maxBytes int64
+	// timeout bounds the time taken to load the roles, unlimited if 0
+	timeout time.Duration
+}
+
+// checkSQLDriver checks that a roles_db driver is built into Caddy, as
+// database/sql drivers register themselves when their package is imported
+func checkSQLDriver(driver string) error {
+	if !slices.Contains(sql.Drivers(), driver) {
+		return fmt.Errorf("roles_db driver %q is not registered, build Caddy with a database/sql driver registering it (e.g. xcaddy build --with modernc.org/sqlite for sqlite)", driver)
+	}
+	return nil
+}
+
+// Watch implements RoleSource, databases being polled with roles_refresh.
+func (s sqlRoleSource) Watch(onChange func(RoleDefinitions)) {}
+
+// Load implements RoleSource.
+func (s sqlRoleSource) Load() (RoleDefinitions, error) {
+	db, err := sql.Open(s.driver, s.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening roles database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	rows, err := db.QueryContext(ctx, rolesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("querying roles database: %v", err)
+	}
+	defer rows.Close()
+
+	rd := make(RoleDefinitions)
+	var size int64
+	for rows.Next() {
+		var role, action, resource string
+		var permissionType sql.NullString
+		if err := rows.Scan(&role, &permissionType, &action, &resource); err != nil {
+			return nil, fmt.Errorf("reading roles database: %v", err)
+		}
+		size += int64(len(role) + len(permissionType.String) + len(action) + len(resource))
+		if s.maxBytes > 0 && size > s.maxBytes {
+			return nil, fmt.Errorf("roles database is larger than max_roles_bytes (%d bytes)", s.maxBytes)
+		}
+		permission := Permission{Type: permissionType.String, Action: parseAction(action), Resource: resource}
+		rd[role] = append(rd[role], permission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading roles database: %v", err)
+	}
+	return rd, nil
+}
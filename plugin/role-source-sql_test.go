@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// openRolesDB creates an in-memory SQLite database with the rbac_permissions
+// table and the given rows, returning its data source name. The database is
+// shared by the connections opened with this name, and removed at the end of
+// the test.
+func openRolesDB(t *testing.T, rows ...string) string {
+	t.Helper()
+	dsn := "file:" + strings.ReplaceAll(t.Name(), "/", "_") + "?mode=memory&cache=shared"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	statements := append([]string{`CREATE TABLE rbac_permissions (
+		id       INTEGER PRIMARY KEY,
+		role     TEXT NOT NULL,
+		type     TEXT,
+		action   TEXT NOT NULL,
+		resource TEXT NOT NULL
+	)`}, rows...)
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return dsn
+}
+
+// rolesRows are the rows of the rbac_permissions table used by the tests,
+// inserted out of order to check that permissions are read in id order
+var rolesRows = []string{
+	`INSERT INTO rbac_permissions VALUES (3, 'writer', 'deny', 'delete', 'posts')`,
+	`INSERT INTO rbac_permissions VALUES (1, 'reader', NULL, 'list,show', 'posts')`,
+	`INSERT INTO rbac_permissions VALUES (2, 'writer', 'allow', 'edit', 'posts')`,
+}
+
+func TestSQLRoleSource(t *testing.T) {
+	dsn := openRolesDB(t, rolesRows...)
+	rd, err := sqlRoleSource{driver: "sqlite", dsn: dsn}.Load()
+	if err != nil {
+		t.Fatalf("loading roles: %v", err)
+	}
+	if len(rd["reader"]) != 1 || len(rd["writer"]) != 2 {
+		t.Fatalf("got roles %+v, want 1 reader and 2 writer permissions", rd)
+	}
+	if actions := rd["reader"][0].Action.Multiple; len(actions) != 2 || actions[0] != "list" || actions[1] != "show" {
+		t.Errorf("got reader actions %+v, want list and show", rd["reader"][0].Action)
+	}
+	if rd["reader"][0].Type != "" {
+		t.Errorf("got reader permission %+v, want the default type", rd["reader"][0])
+	}
+	if rd["writer"][0].Type != "allow" || rd["writer"][1].Type != "deny" {
+		t.Errorf("got writer permissions %+v, want an allow then a deny rule", rd["writer"])
+	}
+}
+
+func TestSQLRoleSourceErrors(t *testing.T) {
+	dsn := openRolesDB(t, rolesRows...)
+	tests := []struct {
+		name   string
+		source sqlRoleSource
+		want   string
+	}{
+		{"too large", sqlRoleSource{driver: "sqlite", dsn: dsn, maxBytes: 10}, "larger than max_roles_bytes"},
+		{"missing table", sqlRoleSource{driver: "sqlite", dsn: "file:empty?mode=memory&cache=shared"}, "querying roles database"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.source.Load()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRolesDB(t *testing.T) {
+	m := provision(t, &Middleware{RolesDB: "sqlite:" + openRolesDB(t, rolesRows...)}, "")
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "writer"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "writer"}, http.StatusForbidden},
+	})
+}
+
+func TestRolesDBDriver(t *testing.T) {
+	err := tryProvision(t, &Middleware{RolesDB: "postgres:host=localhost"}, "")
+	if want := `roles_db driver "postgres" is not registered`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+
+	// Validate catches roles provisioned without loading them from the database
+	err = tryProvision(t, &Middleware{RolesDB: "postgres:host=localhost"}, `{"reader": []}`)
+	if want := `roles_db driver "postgres" is not registered`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+// countingRoleSource returns a role with the number of loads as its name
+type countingRoleSource struct {
+	loads *atomic.Int32
+}
+
+func (s countingRoleSource) Load() (RoleDefinitions, error) {
+	return RoleDefinitions{strconv.Itoa(int(s.loads.Add(1))): {}}, nil
+}
+
+func (countingRoleSource) Watch(onChange func(RoleDefinitions)) {}
+
+func TestPollingRoleSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := pollingRoleSource{
+		RoleSource: countingRoleSource{new(atomic.Int32)},
+		ctx:        ctx,
+		interval:   time.Millisecond,
+		onError:    func(err error) { t.Error(err) },
+	}
+	changes := make(chan RoleDefinitions)
+	source.Watch(func(rd RoleDefinitions) {
+		select {
+		case changes <- rd:
+		case <-ctx.Done():
+		}
+	})
+	for _, want := range []string{"1", "2"} {
+		select {
+		case rd := <-changes:
+			if _, ok := rd[want]; !ok {
+				t.Errorf("got roles %v, want %s", rd, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the roles were not reloaded")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// storageLoader is the part of the Caddy storage (certmagic.Storage) used to
+// read the roles
+type storageLoader interface {
+	Load(ctx context.Context, key string) ([]byte, error)
+}
+
+// storageRoleSource loads role definitions from a key of the storage module
+// configured in Caddy, so that clustered instances share the same roles
+type storageRoleSource struct {
+	storage storageLoader
+	key     string
+	// maxBytes is the maximum size of the value, unlimited if 0
+	maxBytes int64
+	// timeout bounds the time taken to load the roles, unlimited if 0
+	timeout time.Duration
+}
+
+// Watch implements RoleSource. Storages don't notify changes, so the key is
+// only reloaded when roles_refresh polls it.
+func (s storageRoleSource) Watch(onChange func(RoleDefinitions)) {}
+
+// Load implements RoleSource.
+func (s storageRoleSource) Load() (RoleDefinitions, error) {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	value, err := s.storage.Load(ctx, s.key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("roles_storage key %q not found in the Caddy storage", s.key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading roles_storage key %q: %w", s.key, err)
+	}
+	if s.maxBytes > 0 && int64(len(value)) > s.maxBytes {
+		return nil, fmt.Errorf("roles_storage key %q is larger than max_roles_bytes (%d bytes)", s.key, s.maxBytes)
+	}
+	var rd RoleDefinitions
+	if err := rd.UnmarshalJSON(value); err != nil {
+		return nil, fmt.Errorf("parsing roles_storage key %q: %w", s.key, err)
+	}
+	return rd, nil
+}
@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// memoryStorage is a certmagic.Storage keeping its values in memory, or
+// failing every operation if err is set
+type memoryStorage struct {
+	values map[string]string
+	err    error
+}
+
+var _ certmagic.Storage = (*memoryStorage)(nil)
+
+func (s *memoryStorage) fail() error {
+	return s.err
+}
+
+func (s *memoryStorage) Lock(ctx context.Context, name string) error   { return s.fail() }
+func (s *memoryStorage) Unlock(ctx context.Context, name string) error { return s.fail() }
+
+func (s *memoryStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	s.values[key] = string(value)
+	return nil
+}
+
+func (s *memoryStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	value, ok := s.values[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return []byte(value), nil
+}
+
+func (s *memoryStorage) Delete(ctx context.Context, key string) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	delete(s.values, key)
+	return nil
+}
+
+func (s *memoryStorage) Exists(ctx context.Context, key string) bool {
+	_, ok := s.values[key]
+	return s.err == nil && ok
+}
+
+func (s *memoryStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, path) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	value, err := s.Load(ctx, key)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	return certmagic.KeyInfo{Key: key, Size: int64(len(value)), IsTerminal: true}, nil
+}
+
+// provisionWithStorage provisions a middleware loading the roles_storage
+// key from a memory storage, as roleSource does with the Caddy storage
+func provisionWithStorage(t *testing.T, m *Middleware, storage *memoryStorage) error {
+	t.Helper()
+	m.source = storageRoleSource{storage: storage, key: m.RolesStorage, maxBytes: m.MaxRolesBytes}
+	return tryProvision(t, m, "")
+}
+
+func TestStorageRoleSource(t *testing.T) {
+	m := &Middleware{RolesStorage: "rbac/roles.json"}
+	err := provisionWithStorage(t, m, &memoryStorage{values: map[string]string{
+		"rbac/roles.json": `{"reader": [{ "action": ["list", "show"], "resource": "posts" }]}`,
+	}})
+	if err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/comments", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+}
+
+func TestStorageRoleSourceErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       *Middleware
+		storage *memoryStorage
+		want    string
+	}{
+		{
+			"missing key",
+			&Middleware{RolesStorage: "rbac/roles.json"},
+			&memoryStorage{values: map[string]string{"rbac/other.json": "{}"}},
+			`roles_storage key "rbac/roles.json" not found in the Caddy storage`,
+		},
+		{
+			"broken storage",
+			&Middleware{RolesStorage: "rbac/roles.json"},
+			&memoryStorage{err: errors.New("connection refused")},
+			`reading roles_storage key "rbac/roles.json": connection refused`,
+		},
+		{
+			"invalid JSON",
+			&Middleware{RolesStorage: "rbac/roles.json"},
+			&memoryStorage{values: map[string]string{"rbac/roles.json": "{"}},
+			`parsing roles_storage key "rbac/roles.json"`,
+		},
+		{
+			"too large",
+			&Middleware{RolesStorage: "rbac/roles.json", MaxRolesBytes: 8},
+			&memoryStorage{values: map[string]string{"rbac/roles.json": `{"reader": []}`}},
+			"larger than max_roles_bytes (8 bytes)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := provisionWithStorage(t, test.m, test.storage)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
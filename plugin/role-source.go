@@ -0,0 +1,254 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// RoleSource loads role definitions from a storage
+type RoleSource interface {
+	// Load returns the current role definitions
+	Load() (RoleDefinitions, error)
+	// Watch calls onChange with the new role definitions whenever they
+	// change, until the source is stopped. It must not block, and static
+	// sources never call onChange.
+	Watch(onChange func(RoleDefinitions))
+}
+
+// fileRoleSource loads role definitions from a JSON file
+type fileRoleSource struct {
+	path string
+	// maxBytes is the maximum size of the file, unlimited if 0
+	maxBytes int64
+	// schema is the JSON Schema the file must conform to, if any
+	schema *rolesSchema
+}
+
+// Watch implements RoleSource, files being static sources.
+func (s fileRoleSource) Watch(onChange func(RoleDefinitions)) {}
+
+// Load implements RoleSource.
+func (s fileRoleSource) Load() (RoleDefinitions, error) {
+	file, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if s.schema != nil {
+		if err := s.schema.validate(file); err != nil {
+			return nil, fmt.Errorf("roles file %s does not match roles_schema: %w", s.path, err)
+		}
+	}
+	var rd RoleDefinitions
+	if err := rd.UnmarshalJSON(file); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// read returns the content of the file, failing if it exceeds the maximum
+// size before reading it entirely
+func (s fileRoleSource) read() ([]byte, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roles_file %q: %w", s.path, err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("roles_file %q is a directory, it should be the path of the roles JSON file, such as %q", s.path, filepath.Join(s.path, "roles.json"))
+	}
+
+	// Gzipped files are detected by their extension or magic number
+	var reader io.Reader = bufio.NewReader(f)
+	if magic, _ := reader.(*bufio.Reader).Peek(2); strings.HasSuffix(s.path, ".gz") || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress roles_file %q: %w", s.path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	// The maximum size applies to the decompressed content
+	if s.maxBytes > 0 {
+		reader = io.LimitReader(reader, s.maxBytes+1)
+	}
+	file, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roles_file %q: %w", s.path, err)
+	}
+	if s.maxBytes > 0 && int64(len(file)) > s.maxBytes {
+		return nil, fmt.Errorf("roles file %s is larger than max_roles_bytes (%d bytes)", s.path, s.maxBytes)
+	}
+	if len(bytes.TrimSpace(file)) == 0 {
+		return nil, fmt.Errorf("roles file %q is empty", s.path)
+	}
+	return file, nil
+}
+
+// staticRoleSource provides in-memory role definitions
+type staticRoleSource struct {
+	roles RoleDefinitions
+}
+
+// Load implements RoleSource, returning copies of the permission lists, as
+// they are reordered when the roles are prepared.
+func (s staticRoleSource) Load() (RoleDefinitions, error) {
+	rd := make(RoleDefinitions, len(s.roles))
+	for role, permissions := range s.roles {
+		rd[role] = slices.Clone(permissions)
+	}
+	return rd, nil
+}
+
+// Watch implements RoleSource, in-memory roles never changing.
+func (s staticRoleSource) Watch(onChange func(RoleDefinitions)) {}
+
+// pollingRoleSource turns a role source into a live one, by reloading it at
+// a regular interval until its context is done
+type pollingRoleSource struct {
+	RoleSource
+	ctx      context.Context
+	interval time.Duration
+	// onError is called when a reload fails, the current roles being kept
+	onError func(error)
+}
+
+// Watch implements RoleSource.
+func (s pollingRoleSource) Watch(onChange func(RoleDefinitions)) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				rd, err := s.Load()
+				if err != nil {
+					s.onError(err)
+					continue
+				}
+				onChange(rd)
+			}
+		}
+	}()
+}
+
+// roleSource returns the role source selected by the configuration, which
+// is stopped when the context is done
+func (m *Middleware) roleSource(ctx caddy.Context) (RoleSource, error) {
+	var source RoleSource
+	switch {
+	case m.RolesDB != "":
+		if m.RolesFilePath != "" {
+			return nil, fmt.Errorf("roles_file and roles_db cannot be used together")
+		}
+		if m.RolesConsul != "" {
+			return nil, fmt.Errorf("roles_db and roles_consul cannot be used together")
+		}
+		if m.RolesStorage != "" {
+			return nil, fmt.Errorf("roles_storage cannot be used with roles_file or roles_db")
+		}
+		if m.RolesSchema != "" {
+			return nil, fmt.Errorf("roles_schema only applies to roles_file")
+		}
+		driver, dsn, ok := strings.Cut(m.RolesDB, ":")
+		if !ok || driver == "" || dsn == "" {
+			return nil, fmt.Errorf("invalid roles_db %q, expected <driver>:<dsn>", m.RolesDB)
+		}
+		if err := checkSQLDriver(driver); err != nil {
+			return nil, err
+		}
+		source = sqlRoleSource{driver: driver, dsn: dsn, maxBytes: m.MaxRolesBytes, timeout: time.Duration(m.RolesLoadTimeout)}
+	case m.RolesConsul != "":
+		if m.RolesFilePath != "" {
+			return nil, fmt.Errorf("roles_file and roles_consul cannot be used together")
+		}
+		if m.RolesSchema != "" {
+			return nil, fmt.Errorf("roles_schema only applies to roles_file")
+		}
+		if m.RolesRefresh > 0 {
+			return nil, fmt.Errorf("roles_refresh does not apply to roles_consul, whose key is watched")
+		}
+		if m.RolesStorage != "" {
+			return nil, fmt.Errorf("roles_consul and roles_storage cannot be used together")
+		}
+		consulSource, err := newConsulRoleSource(ctx, m.RolesConsul)
+		if err != nil {
+			return nil, err
+		}
+		consulSource.token = caddy.NewReplacer().ReplaceAll(m.RolesConsulToken, "")
+		consulSource.maxBytes = m.MaxRolesBytes
+		consulSource.timeout = time.Duration(m.RolesLoadTimeout)
+		consulSource.onError = func(err error) {
+			m.logger.Error("Failed to watch roles", zap.Error(err))
+			m.status.failed(err)
+		}
+		source = consulSource
+	case m.RolesStorage != "":
+		if m.RolesFilePath != "" || m.RolesDB != "" {
+			return nil, fmt.Errorf("roles_storage cannot be used with roles_file or roles_db")
+		}
+		if m.RolesSchema != "" {
+			return nil, fmt.Errorf("roles_schema only applies to roles_file")
+		}
+		storage := ctx.Storage()
+		if storage == nil {
+			return nil, fmt.Errorf("roles_storage requires a Caddy storage module")
+		}
+		source = storageRoleSource{storage: storage, key: m.RolesStorage, maxBytes: m.MaxRolesBytes, timeout: time.Duration(m.RolesLoadTimeout)}
+	default:
+		fileSource := fileRoleSource{path: m.RolesFilePath, maxBytes: m.MaxRolesBytes}
+		if m.RolesSchema != "" {
+			schema, err := loadRolesSchema(m.RolesSchema)
+			if err != nil {
+				return nil, err
+			}
+			fileSource.schema = schema
+		}
+		source = fileSource
+	}
+
+	if m.RolesRefresh > 0 {
+		source = pollingRoleSource{
+			RoleSource: source,
+			ctx:        ctx,
+			interval:   time.Duration(m.RolesRefresh),
+			onError: func(err error) {
+				m.logger.Error("Failed to reload roles", zap.Error(err))
+				m.status.failed(err)
+			},
+		}
+	}
+	return source, nil
+}
+
+// watchRoles swaps the role definitions whenever the source changes
+func (m *Middleware) watchRoles() {
+	m.source.Watch(func(rd RoleDefinitions) {
+		rd, err := m.prepareRoles(rd)
+		if err == nil {
+			err = m.validateRoles(rd)
+		}
+		if err != nil {
+			m.logger.Error("Ignoring invalid roles", zap.Error(err))
+			m.status.failed(err)
+			return
+		}
+		m.setRoles(rd)
+		m.logger.Debug("Roles reloaded", zap.Int("roles", len(rd)))
+	})
+}
@@ -0,0 +1,179 @@
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestRoleSourceConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Middleware
+		want string
+	}{
+		{"file and db", &Middleware{RolesFilePath: "roles.json", RolesDB: "postgres:dsn"}, "roles_file and roles_db"},
+		{"db and consul", &Middleware{RolesDB: "postgres:dsn", RolesConsul: "http://127.0.0.1:8500/roles"}, "roles_db and roles_consul"},
+		{"db and storage", &Middleware{RolesDB: "postgres:dsn", RolesStorage: "rbac/roles.json"}, "roles_storage"},
+		{"file and consul", &Middleware{RolesFilePath: "roles.json", RolesConsul: "http://127.0.0.1:8500/roles"}, "roles_file and roles_consul"},
+		{"consul and storage", &Middleware{RolesConsul: "http://127.0.0.1:8500/roles", RolesStorage: "rbac/roles.json"}, "roles_consul and roles_storage"},
+		{"file and storage", &Middleware{RolesFilePath: "roles.json", RolesStorage: "rbac/roles.json"}, "roles_storage"},
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.m.roleSource(ctx)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+// manualRoleSource is a role source whose changes are triggered by tests
+type manualRoleSource struct {
+	roles    RoleDefinitions
+	onChange func(RoleDefinitions)
+}
+
+func (s *manualRoleSource) Load() (RoleDefinitions, error) { return s.roles, nil }
+
+func (s *manualRoleSource) Watch(onChange func(RoleDefinitions)) { s.onChange = onChange }
+
+func TestRoleSourceChanges(t *testing.T) {
+	source := &manualRoleSource{roles: parseRoles(t, `{
+		"reader": [{ "action": "list", "resource": "posts" }]
+	}`)}
+	m := provision(t, &Middleware{source: source}, "")
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/comments", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+
+	source.onChange(parseRoles(t, `{
+		"reader": [{ "action": "list", "resource": "comments" }]
+	}`))
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/comments", []string{"X-Role", "reader"}, http.StatusOK},
+	})
+
+	// Invalid roles are ignored, the current ones being kept
+	source.onChange(parseRoles(t, `{
+		"reader": [{ "action": "unknown", "resource": "posts" }]
+	}`))
+	expectStatuses(t, m, []request{
+		{"GET", "/comments", []string{"X-Role", "reader"}, http.StatusOK},
+	})
+}
+
+// writeRolesFile writes a roles file in a temporary directory, returning its
+// path
+func writeRolesFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMaxRolesBytes(t *testing.T) {
+	roles := []byte(`{"reader": [{ "action": "list", "resource": "posts" }]}`)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(roles)
+	gz.Close()
+
+	size := int64(len(roles))
+	tests := []struct {
+		name     string
+		file     string
+		content  []byte
+		maxBytes int64
+		err      bool
+	}{
+		{"unlimited", "roles.json", roles, 0, false},
+		{"exact size", "roles.json", roles, size, false},
+		{"too large", "roles.json", roles, size - 1, true},
+		{"gzipped", "roles.json.gz", gzipped.Bytes(), size, false},
+		// The limit applies to the decompressed content
+		{"gzipped too large", "roles.json.gz", gzipped.Bytes(), size - 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := fileRoleSource{path: writeRolesFile(t, test.file, test.content), maxBytes: test.maxBytes}
+			_, err := source.Load()
+			if test.err && (err == nil || !strings.Contains(err.Error(), "max_roles_bytes")) {
+				t.Errorf("got error %v, want the file to be too large", err)
+			} else if !test.err && err != nil {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestRolesLoadLimitsConfig(t *testing.T) {
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tmax_roles_bytes 1024\n\troles_load_timeout 5s\n}")
+	if m.MaxRolesBytes != 1024 || time.Duration(m.RolesLoadTimeout) != 5*time.Second {
+		t.Errorf("got max_roles_bytes %d and roles_load_timeout %v", m.MaxRolesBytes, time.Duration(m.RolesLoadTimeout))
+	}
+	for _, input := range []string{"max_roles_bytes 1KB", "roles_load_timeout soon"} {
+		if err := (&Middleware{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("simple_rest_rbac {\n\t" + input + "\n}")); err == nil {
+			t.Errorf("expected %q to be rejected", input)
+		}
+	}
+
+	if _, err := (sqlRoleSource{driver: "sqlite", dsn: openRolesDB(t, rolesRows...), timeout: time.Nanosecond}).Load(); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("got error %v, want the load to time out", err)
+	}
+}
+
+func TestRolesFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, path, want string
+	}{
+		{"directory", dir, "is a directory, it should be the path of the roles JSON file, such as \"" + filepath.Join(dir, "roles.json") + "\""},
+		{"missing", filepath.Join(dir, "missing.json"), "failed to read roles_file"},
+		{"empty", writeRolesFile(t, "empty.json", []byte(" \n")), "is empty"},
+		{"invalid gzip", writeRolesFile(t, "roles.json.gz", []byte("{}")), "failed to decompress"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := fileRoleSource{path: test.path}.Load()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestGzippedRolesFile(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(`{"reader": [{ "action": "list", "resource": "posts" }]}`))
+	gz.Close()
+
+	// Gzipped files are detected by their extension or their content
+	for _, name := range []string{"roles.json.gz", "roles.json"} {
+		rd, err := fileRoleSource{path: writeRolesFile(t, name, gzipped.Bytes())}.Load()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(rd["reader"]) != 1 || rd["reader"][0].Resource != "posts" {
+			t.Errorf("%s: got roles %+v", name, rd)
+		}
+	}
+}
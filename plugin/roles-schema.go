@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// rolesSchema is a JSON Schema which raw roles must conform to. All the
+// keywords of the JSON Schema drafts are supported, the draft being the one
+// of the $schema keyword (2020-12 by default), and $ref can point to other
+// schema files, relative to the schema.
+type rolesSchema struct {
+	schema *jsonschema.Schema
+}
+
+// loadRolesSchema reads and compiles a JSON Schema file
+func loadRolesSchema(path string) (*rolesSchema, error) {
+	schema, err := jsonschema.NewCompiler().Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("parsing roles schema %s: %v", path, err)
+	}
+	return &rolesSchema{schema: schema}, nil
+}
+
+// validate checks raw roles against the schema. The returned error lists
+// every violation, along with the JSON pointer of the offending value.
+func (s *rolesSchema) validate(data []byte) error {
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	err = s.schema.Validate(value)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+	var errs []error
+	schemaViolations(validationErr, &errs)
+	return errors.Join(errs...)
+}
+
+// schemaViolations appends the violations causing a validation error to
+// errs, skipping the errors which only wrap them, such as the ones of $ref or
+// allOf
+func schemaViolations(err *jsonschema.ValidationError, errs *[]error) {
+	if len(err.Causes) > 0 {
+		for _, cause := range err.Causes {
+			schemaViolations(cause, errs)
+		}
+		return
+	}
+	var location strings.Builder
+	for _, token := range err.InstanceLocation {
+		location.WriteString("/" + pointerEscaper.Replace(token))
+	}
+	if location.Len() == 0 {
+		location.WriteString("/")
+	}
+	*errs = append(*errs, fmt.Errorf("%s: %s", location.String(), err.ErrorKind.LocalizedString(schemaMessages)))
+}
+
+// pointerEscaper escapes the tokens of JSON pointers
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// schemaMessages prints the violations of roles schemas
+var schemaMessages = message.NewPrinter(language.English)
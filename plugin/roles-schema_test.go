@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSchema writes a roles schema to a temporary file and returns its path
+func writeSchema(t *testing.T, schema string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "roles.schema.json")
+	if err := os.WriteFile(path, []byte(schema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRolesSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name, schema, want string
+	}{
+		{"invalid JSON", `{ "type": `, "parsing roles schema"},
+		{"unresolved reference", `{ "$ref": "#/$defs/role" }`, "#/$defs/role"},
+		{"invalid pattern", `{ "additionalProperties": { "items": { "properties": { "resource": { "pattern": "[" } } } } }`, "pattern"},
+		{"invalid keyword value", `{ "minItems": "one" }`, "minItems"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadRolesSchema(writeSchema(t, test.schema))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRolesSchemaValidation(t *testing.T) {
+	schema, err := loadRolesSchema(writeSchema(t, `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "Roles",
+		"type": "object",
+		"additionalProperties": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"required": ["action", "resource"],
+				"properties": {
+					"type": { "enum": ["allow", "deny"] },
+					"resource": { "type": "string", "pattern": "^[a-z_*]+$" }
+				}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("loading schema: %v", err)
+	}
+	if err := schema.validate([]byte(`{"editor": [{ "action": "edit", "resource": "posts" }]}`)); err != nil {
+		t.Errorf("valid roles: got error %v", err)
+	}
+	err = schema.validate([]byte(`{"editor": [{ "type": "maybe", "resource": "Posts" }]}`))
+	for _, violation := range []string{
+		`/editor/0: missing property 'action'`,
+		`/editor/0/type: value must be one of 'allow', 'deny'`,
+		`/editor/0/resource: 'Posts' does not match pattern`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), violation) {
+			t.Errorf("invalid roles: got error %v, want %s", err, violation)
+		}
+	}
+}
+
+func TestRolesSchemaKeywords(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "permission.schema.json"), []byte(`{
+		"type": "object",
+		"required": ["action", "resource"],
+		"properties": {
+			"action": { "oneOf": [{ "type": "string" }, { "type": "array", "items": { "type": "string" }, "minItems": 1 }] },
+			"priority": { "type": "integer", "minimum": 0 }
+		}
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "roles.schema.json")
+	if err := os.WriteFile(path, []byte(`{
+		"$defs": {
+			"permissions": { "type": "array", "items": { "$ref": "permission.schema.json" } }
+		},
+		"patternProperties": { "^[a-z_]+$": { "$ref": "#/$defs/permissions" } },
+		"additionalProperties": false
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := loadRolesSchema(path)
+	if err != nil {
+		t.Fatalf("loading schema: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		roles string
+		want  string
+	}{
+		{"valid", `{"editor": [{ "action": ["list", "edit"], "resource": "posts", "priority": 1 }]}`, ""},
+		{"unexpected role", `{"Editor": []}`, "/: additional properties 'Editor' not allowed"},
+		{"referenced file", `{"editor": [{ "resource": "posts" }]}`, "/editor/0: missing property 'action'"},
+		{"oneOf", `{"editor": [{ "action": [], "resource": "posts" }]}`, "/editor/0/action"},
+		{"minimum", `{"editor": [{ "action": "list", "resource": "posts", "priority": -1 }]}`, "/editor/0/priority: minimum: got -1, want 0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := schema.validate([]byte(test.roles))
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
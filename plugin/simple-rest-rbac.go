@@ -1,184 +1,1988 @@
 package plugin
 
 import (
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"net"
 	"net/http"
-	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func init() {
-	caddy.RegisterModule(Middleware{})
+	caddy.RegisterModule(new(Middleware))
 	httpcaddyfile.RegisterHandlerDirective("simple_rest_rbac", parseCaddyfile)
 }
 
+// splitPath splits the URL path into its non-empty segments, so that repeated
+// and trailing slashes are ignored
+// E.g. "/foo//bar/" returns ["foo", "bar"]
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// defaultMaxPathSegments is the maximum number of segments of a request path,
+// unless configured otherwise
+const defaultMaxPathSegments = 32
+
+// countSegments counts the non-empty segments of a URL path, like splitPath
+// but without allocating them
+func countSegments(path string) int {
+	count := 0
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' && (i == 0 || path[i-1] == '/') {
+			count++
+		}
+	}
+	return count
+}
+
+// requestHost returns the host of a request, without its port
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host
+	}
+	return host
+}
+
+// normalizePath returns the URL path without repeated nor trailing slashes
+// E.g. "/foo//bar/" returns "/foo/bar"
+func normalizePath(path string) string {
+	return "/" + strings.Join(splitPath(path), "/")
+}
+
+// resourceSegments returns the path segments starting at the resource,
+// skipping the tenant segments and the API version segment if any
+// E.g. "/v1/foo/bar" returns ["foo", "bar"] when versions are skipped.
+// With the leaf resource position, nested resources are skipped too
+// E.g. "/posts/5/comments/7" returns ["comments", "7"]
+func (m *Middleware) resourceSegments(path string) []string {
+	parts := splitPath(path)
+	if m.StripFormat && len(parts) > 0 {
+		parts[len(parts)-1] = stripFormat(parts[len(parts)-1])
+	}
+	if m.TenantSegment != nil {
+		if len(parts) <= *m.TenantSegment {
+			return nil
+		}
+		parts = parts[*m.TenantSegment+1:]
+	}
+	if m.versionPrefix != nil && len(parts) > 0 && m.versionPrefix.MatchString(parts[0]) {
+		parts = parts[1:]
+	}
+	if m.ResourcePosition == "leaf" && len(parts) > 2 {
+		// Resources and records alternate, the last resource being
+		// followed by a record or nothing
+		parts = parts[(len(parts)-1)/2*2:]
+	}
+	return parts
+}
+
+// stripFormat removes the format extension of a path segment
+// E.g. "1.json" returns "1"
+func stripFormat(segment string) string {
+	if i := strings.LastIndexByte(segment, '.'); i > 0 {
+		return segment[:i]
+	}
+	return segment
+}
+
 // extractResource extracts the resource name from the URL path
 // E.g. "/foo/bar/baz" returns "foo"
-func extractResource(path string) string {
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	if len(parts) > 0 && parts[0] != "" {
+func (m *Middleware) extractResource(path string) string {
+	parts := m.resourceSegments(path)
+	if len(parts) > 0 {
 		return parts[0]
 	}
 	return ""
 }
 
+// resolveAlias returns the resource a resource alias stands for, or the
+// resource itself if it is not an alias
+func (m *Middleware) resolveAlias(resource string) string {
+	if m.CaseInsensitive {
+		if target, ok := m.aliases[strings.ToLower(resource)]; ok {
+			return target
+		}
+		return resource
+	}
+	if target, ok := m.ResourceAliases[resource]; ok {
+		return target
+	}
+	return resource
+}
+
+// extractTenant extracts the tenant ID from the URL path, if configured
+// E.g. "/t/acme/foo" returns "acme" when the tenant segment is 1
+func (m *Middleware) extractTenant(path string) string {
+	if m.TenantSegment == nil {
+		return ""
+	}
+	parts := splitPath(path)
+	if len(parts) > *m.TenantSegment {
+		return parts[*m.TenantSegment]
+	}
+	return ""
+}
+
 // extractRecordID extracts the record ID from the URL path
 // E.g. "/foo/bar/baz" returns "bar"
-func extractRecordID(path string) string {
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	if len(parts) > 1 && parts[1] != "" {
+func (m *Middleware) extractRecordID(path string) string {
+	parts := m.resourceSegments(path)
+	if len(parts) > 1 {
 		return parts[1]
 	}
 	return ""
 }
 
+// builtinActions are the actions returned by getActionFromRequest, before
+// being renamed by the action vocabulary
+var builtinActions = []string{"list", "get_many_reference", "show", "create", "edit", "replace", "patch", "delete", "invoke", "edit_collection", "delete_collection"}
+
+// enabledActions returns the built-in actions getActionFromRequest can
+// return with the current configuration, before being renamed
+func (m *Middleware) enabledActions() []string {
+	actions := []string{"list", "show", "create", "delete"}
+	put, patch := m.putPatchActions()
+	actions = append(actions, put)
+	if patch != put {
+		actions = append(actions, patch)
+	}
+	if m.DetectReferences {
+		actions = append(actions, "get_many_reference")
+	}
+	if m.DetectInvocations {
+		actions = append(actions, "invoke")
+	}
+	if m.DetectCollectionWrites {
+		actions = append(actions, "edit_collection", "delete_collection")
+	}
+	return actions
+}
+
+// mergePutPatch tells whether PUT and PATCH requests are both edit actions,
+// which is the default
+func (m *Middleware) mergePutPatch() bool {
+	return m.MergePutPatch == nil || *m.MergePutPatch
+}
+
+// putPatchActions returns the built-in actions of PUT and PATCH requests:
+// edit for both (default), edit and patch with SplitPatch, or replace and
+// patch when they are not merged
+func (m *Middleware) putPatchActions() (string, string) {
+	switch {
+	case m.SplitPatch:
+		return "edit", "patch"
+	case m.mergePutPatch():
+		return "edit", "edit"
+	default:
+		return "replace", "patch"
+	}
+}
+
 // getActionFromRequest determines the action based on the HTTP request
-func getActionFromRequest(r *http.Request) string {
-	recordID := extractRecordID(r.URL.Path)
+func (m *Middleware) getActionFromRequest(r *http.Request) string {
+	recordID := m.extractRecordID(r.URL.Path)
 	hasRecordID := recordID != ""
-	
-	switch r.Method {
+
+	method := m.effectiveMethod(r)
+	if action, ok := m.MethodActions[method]; ok {
+		return action
+	}
+	// Writes to a whole collection, without any id filter, are told apart
+	// from the writes to some of its records
+	if m.DetectCollectionWrites && !hasRecordID && !hasIDFilter(r) {
+		switch method {
+		case "PUT", "PATCH":
+			return m.actionName("edit_collection")
+		case "DELETE":
+			return m.actionName("delete_collection")
+		}
+	}
+	switch method {
 	case "GET":
 		if hasRecordID {
-			return "show"
+			return m.actionName("show")
 		}
-		return "list"
+		if m.DetectReferences && referenceField(r) != "" {
+			return m.actionName("get_many_reference")
+		}
+		return m.actionName("list")
 	case "POST":
-		return "create"
-	case "PUT", "PATCH":
-		return "edit"
+		if m.DetectInvocations && m.invocationVerb(r.URL.Path) != "" {
+			return m.actionName("invoke")
+		}
+		return m.actionName("create")
+	case "PUT":
+		put, _ := m.putPatchActions()
+		return m.actionName(put)
+	case "PATCH":
+		_, patch := m.putPatchActions()
+		return m.actionName(patch)
 	case "DELETE":
-		return "delete"
+		return m.actionName("delete")
+	case "PROPFIND":
+		if hasRecordID {
+			return m.actionName("show")
+		}
+		return m.actionName("list")
 	default:
-		return ""
+		if action, ok := webdavActions[method]; ok {
+			if action == "edit" {
+				// WebDAV edits are partial updates
+				_, action = m.putPatchActions()
+			}
+			return m.actionName(action)
+		}
+		return m.DefaultAction
+	}
+}
+
+// webdavActions are the built-in actions of the WebDAV methods besides
+// PROPFIND, which reads collections and records like GET
+var webdavActions = map[string]string{
+	"MKCOL":     "create",
+	"COPY":      "create",
+	"MOVE":      "edit",
+	"PROPPATCH": "edit",
+	"LOCK":      "edit",
+	"UNLOCK":    "edit",
+}
+
+// invocationVerb returns the verb of a POST request invoking an action on a
+// record, or an empty string if the path has no segment after the record
+// E.g. "/orders/5/refund" returns "refund"
+func (m *Middleware) invocationVerb(path string) string {
+	parts := m.resourceSegments(path)
+	if len(parts) == 3 {
+		return parts[2]
+	}
+	return ""
+}
+
+// defaultMethodOverrides are the methods a POST request can be overridden
+// with when honor_method_override is set without any method
+var defaultMethodOverrides = []string{"PUT", "PATCH", "DELETE"}
+
+// effectiveMethod returns the method of a request, or the method of its
+// X-HTTP-Method-Override header for POST requests when it is allowed
+func (m *Middleware) effectiveMethod(r *http.Request) string {
+	if r.Method != http.MethodPost || len(m.MethodOverrides) == 0 {
+		return r.Method
+	}
+	override := strings.ToUpper(strings.TrimSpace(r.Header.Get("X-HTTP-Method-Override")))
+	if override != "" && slices.ContainsFunc(m.MethodOverrides, func(method string) bool {
+		return strings.EqualFold(method, override)
+	}) {
+		return override
+	}
+	return r.Method
+}
+
+// actionName returns the name of a built-in action in the configured
+// action vocabulary
+func (m *Middleware) actionName(action string) string {
+	if name, ok := m.ActionVocabulary[action]; ok {
+		return name
 	}
+	return action
+}
+
+// ResourceStatus is the status of some responses for the resources matching
+// a pattern
+type ResourceStatus struct {
+	Resource string `json:"resource"`
+	Status   int    `json:"status"`
 }
 
 // Middleware implements an HTTP handler that writes the
 // visitor's IP address to a file or stream.
 type Middleware struct {
-	Role          string          `json:"role,omitempty"`
-	RolesFilePath string          `json:"roles_file,omitempty"`
-	roles         RoleDefinitions
-	logger        *zap.Logger
+	Role string `json:"role,omitempty"`
+	// RoleFallbacks are tried in order when Role resolves to an empty value
+	RoleFallbacks []string `json:"role_fallbacks,omitempty"`
+	// SkipUnknown keeps trying the role fallbacks (and the role cookie) when
+	// a role resolves to a value which is not a defined role
+	SkipUnknown bool `json:"skip_unknown,omitempty"`
+	// RoleCookie is the name of a cookie holding the role, used when Role
+	// resolves to an empty value
+	RoleCookie string `json:"role_cookie,omitempty"`
+	// RoleCookieField is the path of the role in the role cookie, when its
+	// value is a JSON object
+	RoleCookieField string `json:"role_cookie_field,omitempty"`
+	// RoleCookieSecret is the secret the role cookie must be signed with,
+	// using HMAC-SHA256, if set. Supports global placeholders, e.g.
+	// "{env.ROLE_COOKIE_SECRET}".
+	RoleCookieSecret string `json:"role_cookie_secret,omitempty"`
+	RolesFilePath    string `json:"roles_file,omitempty"`
+	// RolesDB loads the roles from a database rather than a file, given as
+	// <driver>:<dsn>, e.g. "sqlite:/etc/caddy/roles.db". The driver must be
+	// built into Caddy.
+	RolesDB string `json:"roles_db,omitempty"`
+	// RolesConsul loads the roles from a key of the Consul KV store, given
+	// as an URL, e.g. "http://127.0.0.1:8500/config/rbac/roles", and
+	// watches it for changes
+	RolesConsul string `json:"roles_consul,omitempty"`
+	// RolesStorage loads the roles from a key of the Caddy storage, e.g.
+	// "rbac/roles.json", shared by the instances of a cluster
+	RolesStorage string `json:"roles_storage,omitempty"`
+	// RolesConsulToken is the Consul ACL token, if any. Supports global
+	// placeholders, e.g. "{env.CONSUL_HTTP_TOKEN}".
+	RolesConsulToken string `json:"roles_consul_token,omitempty"`
+	// RolesSchema is the path of a JSON Schema the roles file must conform
+	// to, if any
+	RolesSchema string `json:"roles_schema,omitempty"`
+	// RolesRefresh is the interval at which roles are reloaded, if set
+	RolesRefresh caddy.Duration `json:"roles_refresh,omitempty"`
+	// MaxRolesBytes is the maximum size of the roles file (or of the roles
+	// database rows), unlimited if 0
+	MaxRolesBytes int64 `json:"max_roles_bytes,omitempty"`
+	// RolesLoadTimeout bounds the time taken to load roles from a database,
+	// unlimited if 0
+	RolesLoadTimeout caddy.Duration `json:"roles_load_timeout,omitempty"`
+	// GlobalDeny lists permissions denied to every role, whatever their type
+	GlobalDeny []Permission `json:"global_deny,omitempty"`
+	// ExposeReason writes the reason of the deny rule which blocked a
+	// request in the response body
+	ExposeReason bool `json:"expose_reason,omitempty"`
+	// DenyMessages are the messages written in the body of 403 responses,
+	// by locale (e.g. "fr"), the "*" locale being the default one
+	DenyMessages map[string]string `json:"deny_messages,omitempty"`
+	// ErrorFormat is the format of the body of 403 responses: "text"
+	// (default), "json", "ra" (the JSON error objects react-admin displays,
+	// same as "json"), "html", or "auto" to negotiate it from the Accept
+	// header of the request
+	ErrorFormat string `json:"error_format,omitempty"`
+	// ErrorTemplate is the path of the HTML template of the body of 403
+	// responses with the "html" format, a minimal page if empty
+	ErrorTemplate string `json:"error_template,omitempty"`
+	// ForbiddenStatus is the status of denied requests, either 403 (default)
+	// or 404 to avoid revealing which resources exist
+	ForbiddenStatus int `json:"forbidden_status,omitempty"`
+	// MaxBodyBytes is the maximum size of a request body read to evaluate
+	// body conditions. Defaults to 1MiB.
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// MaxPathSegments is the maximum number of segments of a request path,
+	// longer paths being rejected. Defaults to 32, unlimited if 0.
+	MaxPathSegments *int `json:"max_path_segments,omitempty"`
+	// PublicResources are resource patterns reachable without any role
+	PublicResources []string `json:"public_resources,omitempty"`
+	// SkipPaths are path patterns (e.g. "/health" or "/metrics*") bypassing
+	// the middleware entirely, whatever the role
+	SkipPaths []string `json:"skip_paths,omitempty"`
+	// KnownResources are the resource patterns reachable at all, if set.
+	// Requests to other resources are denied before any role is considered.
+	KnownResources []string `json:"known_resources,omitempty"`
+	// UnknownResourceStatus is the status of requests to resources missing
+	// from KnownResources. Defaults to 404.
+	UnknownResourceStatus int `json:"unknown_resource_status,omitempty"`
+	// RootResource is the resource of requests without one, such as "/",
+	// so that permissions can govern them. They pass through if empty.
+	RootResource string `json:"root_resource,omitempty"`
+	// RateLimits throttle actions of some roles
+	RateLimits []RateLimit `json:"rate_limits,omitempty"`
+	// VersionPrefixPattern is a regular expression matching API version path
+	// segments (e.g. "^v\d+$"), skipped when they come first in the path
+	VersionPrefixPattern string `json:"version_prefix_pattern,omitempty"`
+	// StripFormat ignores the format extension of the last path segment,
+	// e.g. "/posts/1.json" targets the record "1" of "posts"
+	StripFormat bool `json:"strip_format,omitempty"`
+	// ResourcePosition tells which resource of nested paths is the resource
+	// of the request: "root" (default) for "posts" in "/posts/5/comments",
+	// or "leaf" for "comments"
+	ResourcePosition string `json:"resource_position,omitempty"`
+	// ResourceAliases maps resource names to the resource whose permissions
+	// apply to them, e.g. "articles" to "posts"
+	ResourceAliases map[string]string `json:"resource_aliases,omitempty"`
+	// CaseInsensitive makes resource aliases case-insensitive
+	CaseInsensitive bool `json:"case_insensitive,omitempty"`
+	// TenantSegment is the index of the path segment holding the tenant ID
+	// (e.g. 1 for "/t/acme/posts"), the resource being taken after it
+	TenantSegment *int `json:"tenant_segment,omitempty"`
+	// ActionVocabulary renames the built-in actions (list, show, create, edit
+	// and delete), e.g. to use "update" rather than "edit"
+	ActionVocabulary map[string]string `json:"action_vocabulary,omitempty"`
+	// CustomActions are additional actions permissions can refer to, besides
+	// the built-in ones
+	CustomActions []string `json:"custom_actions,omitempty"`
+	// MergePutPatch maps both PUT and PATCH requests to the edit action when
+	// true (default), or to the replace and patch actions respectively
+	MergePutPatch *bool `json:"merge_put_patch,omitempty"`
+	// SplitPatch keeps mapping PUT requests to the edit action, but maps
+	// PATCH requests to the patch action, so that partial updates can be
+	// told apart
+	SplitPatch bool `json:"split_patch,omitempty"`
+	// DetectReferences maps GET requests for the records of a collection
+	// referencing a parent record (e.g. /comments?post_id=1) to the
+	// get_many_reference action, rather than to list
+	DetectReferences bool `json:"detect_references,omitempty"`
+	// DetectInvocations maps POST requests to a verb following a record
+	// (e.g. /orders/5/refund) to the invoke action, scoped to the verb,
+	// rather than to create
+	DetectInvocations bool `json:"detect_invocations,omitempty"`
+	// DetectCollectionWrites maps PUT, PATCH and DELETE requests to a
+	// collection without any id filter (e.g. DELETE /posts) to the
+	// edit_collection and delete_collection actions, rather than to edit
+	// and delete
+	DetectCollectionWrites bool `json:"detect_collection_writes,omitempty"`
+	// MethodOverrides are the methods POST requests can be overridden with
+	// using the X-HTTP-Method-Override header. Overrides are ignored if empty.
+	MethodOverrides []string `json:"method_overrides,omitempty"`
+	// MethodActions maps HTTP methods to the actions of their requests,
+	// overriding the built-in mapping, e.g. "PROPFIND" to "browse". Methods
+	// mapped to an empty action are rejected with 405.
+	MethodActions map[string]string `json:"method_actions,omitempty"`
+	// DefaultAction is the action of requests whose method is neither
+	// built-in nor in MethodActions, e.g. "other". Such requests are
+	// rejected (with 405 by default) if empty.
+	DefaultAction string `json:"default_action,omitempty"`
+	// UnmappedMethodStatus is the status of requests whose method maps to
+	// no action. Defaults to 405.
+	UnmappedMethodStatus int `json:"unmapped_method_status,omitempty"`
+	// UnmappedMethodStatuses override UnmappedMethodStatus for some
+	// resources, the first matching resource pattern winning
+	UnmappedMethodStatuses []ResourceStatus `json:"unmapped_method_statuses,omitempty"`
+	// ActionHeader is the name of a request header supplying the action,
+	// e.g. "X-Action" set upstream to "archive", used rather than the action
+	// of the method when present
+	ActionHeader string `json:"action_header,omitempty"`
+	// TraceHeader is the name of a request header holding a correlation ID,
+	// e.g. "X-Request-Id", added to the log entries and the denial events
+	// of the request. Caddy's request ID is used when the header is absent.
+	TraceHeader string `json:"trace_header,omitempty"`
+	// ResourceSource is where the resource comes from: "path" (default), or
+	// "body:<path>" to take it from the JSON request body of requests to the
+	// ResourceSourceEndpoints, e.g. "body:resource", falling back to the
+	// path when the body has none
+	ResourceSource string `json:"resource_source,omitempty"`
+	// ResourceSourceEndpoints are the resource patterns of the generic
+	// endpoints taking their resource from the body, e.g. "batch"
+	ResourceSourceEndpoints []string `json:"resource_source_endpoints,omitempty"`
+	// ResourceQueryParam is the query parameter holding the resource of
+	// requests to the ResourceQueryEndpoints, e.g. "type" for
+	// /search?type=posts
+	ResourceQueryParam string `json:"resource_query_param,omitempty"`
+	// ResourceQueryEndpoints are the resource patterns of the generic
+	// endpoints taking their resource from the ResourceQueryParam
+	ResourceQueryEndpoints []string `json:"resource_query_endpoints,omitempty"`
+	// LogGranted is the level of the logs of granted requests, e.g. "debug".
+	// Defaults to "info".
+	LogGranted string `json:"log_granted,omitempty"`
+	// LogDenied is the level of the logs of denied requests, e.g. "warn".
+	// Defaults to "info".
+	LogDenied string `json:"log_denied,omitempty"`
+	// DecisionCacheSize is the maximum number of decisions cached by role,
+	// action and resource, for roles without request conditions. Disabled
+	// if 0.
+	DecisionCacheSize int `json:"decision_cache_size,omitempty"`
+	// EvaluationOrder is how conflicts between matching allow and deny
+	// permissions are resolved, "deny_wins" (default), "most_specific_wins"
+	// or "ordered" (also called "sequential")
+	EvaluationOrder EvaluationOrder `json:"evaluation_order,omitempty"`
+	// ActionGroups map action names to the actions they stand for in
+	// permissions, e.g. "crud" to ["list", "show", "create", "edit",
+	// "delete"], replacing the built-in groups of the same name
+	ActionGroups map[string][]string `json:"action_groups,omitempty"`
+	// RequiredHeaders maps actions (or "*" for any action) to the headers
+	// their requests must have, e.g. "create" to ["Idempotency-Key"].
+	// Requests missing one are rejected with 400.
+	RequiredHeaders map[string][]string `json:"required_headers,omitempty"`
+	// EmitEvents emits a rbac_denied event through the Caddy events app for
+	// each denied request
+	EmitEvents bool `json:"emit_events,omitempty"`
+	// DenyWebhook is a URL receiving a JSON event for each denied request,
+	// in the background
+	DenyWebhook string `json:"deny_webhook,omitempty"`
+	// ReadOnly blocks all writes whatever the role when it resolves to true,
+	// e.g. "true" or "{env.READ_ONLY}", for maintenance
+	ReadOnly string `json:"read_only,omitempty"`
+	// ReadOnlyRetryAfter is the Retry-After delay of writes blocked by the
+	// read-only mode. Defaults to 1 minute.
+	ReadOnlyRetryAfter caddy.Duration `json:"read_only_retry_after,omitempty"`
+	// SoftDenyDelay delays the denied requests of the soft deny roles,
+	// to slow down noisy clients. Disabled if 0.
+	SoftDenyDelay caddy.Duration `json:"soft_deny_delay,omitempty"`
+	// SoftDenyRoles are the roles whose denied requests are delayed
+	SoftDenyRoles []string `json:"soft_deny_roles,omitempty"`
+	// SoftDenyAllow allows the delayed requests with a warning rather than
+	// denying them
+	SoftDenyAllow bool `json:"soft_deny_allow,omitempty"`
+	// DecisionTrace is the token of the requests which get the trace of
+	// their decision rather than being served, in the X-RBAC-Trace-Token
+	// header. Supports global placeholders, e.g. "{env.RBAC_TRACE_TOKEN}".
+	// Disabled if empty.
+	DecisionTrace string `json:"decision_trace,omitempty"`
+	// DecisionHeader is the name of a response header receiving the
+	// decision, the role and the action, for debugging. Disabled if empty.
+	DecisionHeader string `json:"decision_header,omitempty"`
+	// ActionResolverRaw is an optional module deriving the action and the
+	// resource from the request, replacing the built-in resolution
+	ActionResolverRaw json.RawMessage `json:"action_resolver,omitempty" caddy:"namespace=http.handlers.simple_rest_rbac.action_resolvers inline_key=resolver"`
+	source            RoleSource
+	// roles holds the current role definitions, which are never modified
+	// once published, so that requests can read them without locking
+	roles         atomic.Pointer[rolePolicy]
+	resolver      ActionResolver
+	limiter       *rateLimiter
+	versionPrefix *regexp.Regexp
+	aliases       map[string]string
+	// errorTemplate is the template of the body of 403 responses with the
+	// "html" error format
+	errorTemplate *template.Template
+	// status tracks the loading of the roles, for the admin API
+	status rolesStatus
+	// traceToken is the resolved decision trace token, nil if disabled
+	traceToken []byte
+	// cookieSecret is the resolved role cookie secret, nil if unsigned
+	cookieSecret []byte
+	// denyMessages are the deny messages by lowercase locale
+	denyMessages map[string]string
+	webhook      *denyWebhook
+	events       *caddyevents.App
+	ctx          caddy.Context
+	logger       *zap.Logger
+	grantedLevel zapcore.Level
+	deniedLevel  zapcore.Level
 }
 
 // CaddyModule returns the Caddy module information.
-func (Middleware) CaddyModule() caddy.ModuleInfo {
+func (*Middleware) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.handlers.simple_rest_rbac",
 		New: func() caddy.Module { return new(Middleware) },
 	}
 }
 
+// ProvisionWithRoles provisions the middleware like Provision, but with the
+// given role definitions rather than those of the roles file or database.
+// It is meant for tests, see the plugintest package.
+func (m *Middleware) ProvisionWithRoles(ctx caddy.Context, roles RoleDefinitions) error {
+	m.source = staticRoleSource{roles: roles}
+	return m.Provision(ctx)
+}
+
 // Provision implements caddy.Provisioner.
 func (m *Middleware) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger()
 
-	file, err := os.ReadFile(m.RolesFilePath)
+	var err error
+
+	m.grantedLevel, err = parseLogLevel(m.LogGranted)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid log_granted: %v", err)
+	}
+	m.deniedLevel, err = parseLogLevel(m.LogDenied)
+	if err != nil {
+		return fmt.Errorf("invalid log_denied: %v", err)
 	}
-  var rd RoleDefinitions
-	if err := rd.UnmarshalJSON(file); err != nil {
+
+	if m.source == nil {
+		m.source, err = m.roleSource(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	rd, err := m.source.Load()
+	if err != nil {
 		return err
 	}
-	m.roles = rd
+	rd, err = m.prepareRoles(rd)
+	if err != nil {
+		return fmt.Errorf("invalid roles: %w", err)
+	}
+	m.setRoles(rd)
+	m.watchRoles()
+	for i := range m.GlobalDeny {
+		m.GlobalDeny[i].Action = m.expandActionGroups(m.GlobalDeny[i].Action)
+	}
+	registerInstance(m)
+
+	if m.DecisionTrace != "" {
+		m.traceToken = []byte(caddy.NewReplacer().ReplaceAll(m.DecisionTrace, ""))
+		if len(m.traceToken) == 0 {
+			return fmt.Errorf("decision_trace resolves to an empty token")
+		}
+	}
+	if m.RoleCookieSecret != "" {
+		m.cookieSecret = []byte(caddy.NewReplacer().ReplaceAll(m.RoleCookieSecret, ""))
+		if len(m.cookieSecret) == 0 {
+			return fmt.Errorf("role_cookie_secret resolves to an empty secret")
+		}
+	}
+
+	m.errorTemplate = defaultErrorTemplate
+	if m.ErrorTemplate != "" {
+		m.errorTemplate, err = template.ParseFiles(m.ErrorTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid error_template: %v", err)
+		}
+	}
+
+	m.denyMessages = make(map[string]string, len(m.DenyMessages))
+	for locale, message := range m.DenyMessages {
+		m.denyMessages[strings.ToLower(locale)] = message
+	}
+
+	if m.CaseInsensitive {
+		m.aliases = make(map[string]string, len(m.ResourceAliases))
+		for alias, target := range m.ResourceAliases {
+			m.aliases[strings.ToLower(alias)] = target
+		}
+	}
+
+	if m.VersionPrefixPattern != "" {
+		m.versionPrefix, err = regexp.Compile(m.VersionPrefixPattern)
+		if err != nil {
+			return fmt.Errorf("invalid version_prefix_pattern: %v", err)
+		}
+	}
+
+	for i, rl := range m.RateLimits {
+		if len(rl.Actions) == 0 {
+			for _, action := range defaultRateLimitedActions {
+				if slices.Contains(m.enabledActions(), action) {
+					m.RateLimits[i].Actions = append(m.RateLimits[i].Actions, m.actionName(action))
+				}
+			}
+		}
+	}
+	m.limiter = newRateLimiter(time.Now)
+
+	m.resolver = defaultActionResolver{m}
+	if m.ActionResolverRaw != nil {
+		mod, err := ctx.LoadModule(m, "ActionResolverRaw")
+		if err != nil {
+			return fmt.Errorf("loading action resolver: %v", err)
+		}
+		resolver, ok := mod.(ActionResolver)
+		if !ok {
+			return fmt.Errorf("loading action resolver: module %T is not an ActionResolver", mod)
+		}
+		m.resolver = resolver
+	}
+
+	if m.EmitEvents {
+		eventsApp, err := ctx.App("events")
+		if err != nil {
+			return fmt.Errorf("getting events app: %v", err)
+		}
+		m.events = eventsApp.(*caddyevents.App)
+		m.ctx = ctx
+	}
+
+	if m.DenyWebhook != "" {
+		m.webhook = newDenyWebhook(m.DenyWebhook, m.logger)
+	}
+
+	return nil
+}
+
+// parseLogLevel parses a log level name, defaulting to info
+func parseLogLevel(level string) (zapcore.Level, error) {
+	if level == "" {
+		return zapcore.InfoLevel, nil
+	}
+	return zapcore.ParseLevel(level)
+}
 
+// Cleanup implements caddy.CleanerUpper.
+func (m *Middleware) Cleanup() error {
+	unregisterInstance(m)
+	if m.webhook != nil {
+		m.webhook.stop()
+	}
 	return nil
 }
 
+// notifyDenied emits a rbac_denied event when events are enabled, and sends
+// the denial to the deny webhook, if any
+func (m *Middleware) notifyDenied(r *http.Request, role, action, resource, reason string) {
+	if m.events != nil {
+		m.events.Emit(m.ctx, "rbac_denied", map[string]any{
+			"role":     role,
+			"action":   action,
+			"resource": resource,
+			"reason":   reason,
+			"ip":       clientIP(r),
+			"trace_id": m.traceID(r),
+		})
+	}
+	if m.webhook == nil {
+		return
+	}
+	m.webhook.notify(denyEvent{
+		Role:     role,
+		Action:   action,
+		Resource: resource,
+		Reason:   reason,
+		IP:       clientIP(r),
+		TraceID:  m.traceID(r),
+		Time:     time.Now(),
+	})
+}
+
+// traceID returns the correlation ID of the request: the value of the trace
+// header, or Caddy's request ID ({http.request.uuid}) if it is absent. It is
+// empty if no trace header is configured.
+func (m *Middleware) traceID(r *http.Request) string {
+	if m.TraceHeader == "" {
+		return ""
+	}
+	if id := r.Header.Get(m.TraceHeader); id != "" {
+		return id
+	}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		return repl.ReplaceAll("{http.request.uuid}", "")
+	}
+	return ""
+}
+
+// sourceName describes where the roles come from
+func (m *Middleware) sourceName() string {
+	if m.RolesDB != "" {
+		return m.RolesDB
+	}
+	if m.RolesConsul != "" {
+		return m.RolesConsul
+	}
+	if m.RolesStorage != "" {
+		return "storage:" + m.RolesStorage
+	}
+	return m.RolesFilePath
+}
+
+// check decides whether a role can perform an action on a resource,
+// applying the global deny rules first
+func (m *Middleware) check(role, action, resource string) Decision {
+	t := target{action: action, resource: resource, path: "/" + resource}
+	for i, permission := range m.GlobalDeny {
+		if matchTarget(permission, t) {
+			decision := newDecision(&m.GlobalDeny[i])
+			decision.Allowed = false
+			return decision
+		}
+	}
+	decision, exists := m.getPolicy().decide(role, t)
+	if !exists {
+		return Decision{Allowed: false, Reason: "role not found"}
+	}
+	return decision
+}
+
+// rolePolicy holds role definitions, along with what is derived from them
+// once when they are loaded
+type rolePolicy struct {
+	roles RoleDefinitions
+	// permissive maps the roles allowed to do anything to the permission
+	// allowing it, so that their requests skip the permission evaluation
+	permissive map[string]*Permission
+	// cache holds the decisions of roles whose permissions don't depend on
+	// the request, nil if disabled. It is dropped along with the policy when
+	// roles are reloaded.
+	cache *decisionCache
+	// static tells which roles have no permission with a request condition,
+	// so that their decisions can be cached
+	static map[string]bool
+	// order is how conflicts between allow and deny permissions are resolved
+	order EvaluationOrder
+	// audits holds the audit permissions of the roles having any
+	audits map[string]RoleDefinition
+}
+
+// decide evaluates the permissions of a role against a target, and returns
+// false if the role is not defined
+func (p *rolePolicy) decide(role string, t target) (Decision, bool) {
+	role = p.roles.roleName(role)
+	if permission, ok := p.permissive[role]; ok {
+		return newDecision(permission), true
+	}
+	permissions, exists := p.roles.permissionsFor(role)
+	if !exists {
+		return Decision{}, false
+	}
+	if p.cache == nil || !p.static[role] {
+		return evaluatePermissions(permissions, t, p.order), true
+	}
+	key := decisionKey(role, t.scopedAction(), t.resource)
+	if decision, ok := p.cache.get(key); ok {
+		return decision, true
+	}
+	decision := evaluatePermissions(permissions, t, p.order)
+	p.cache.add(key, decision)
+	return decision, true
+}
+
+// decideRoles evaluates the combined permissions of several roles against a
+// target, and returns false if none of the roles is defined
+func (p *rolePolicy) decideRoles(roles []string, t target) (Decision, bool) {
+	if len(roles) == 1 {
+		return p.decide(roles[0], t)
+	}
+	permissions, exists := p.roles.permissionsForRoles(roles)
+	if !exists {
+		return Decision{}, false
+	}
+	return evaluatePermissions(permissions, t, p.order), true
+}
+
+// defines checks if any of the roles is defined
+func (p *rolePolicy) defines(roles []string) bool {
+	_, exists := p.roles.permissionsForRoles(roles)
+	return exists
+}
+
+// audited returns the audit permissions of several roles, including the
+// shared ones, matching a target
+func (p *rolePolicy) audited(roles []string, t target) []*Permission {
+	if len(p.audits) == 0 {
+		return nil
+	}
+	var matched []*Permission
+	for _, role := range append(roles, SharedRole) {
+		permissions := p.audits[p.roles.roleName(role)]
+		for i := range permissions {
+			if matchTarget(permissions[i], t) {
+				matched = append(matched, &permissions[i])
+			}
+		}
+	}
+	return matched
+}
+
+// getRoles returns the current role definitions, safe for concurrent use.
+// The returned definitions must not be modified.
+func (m *Middleware) getRoles() RoleDefinitions {
+	if p := m.roles.Load(); p != nil {
+		return p.roles
+	}
+	return nil
+}
+
+// getPolicy returns the current role policy, safe for concurrent use
+func (m *Middleware) getPolicy() *rolePolicy {
+	if p := m.roles.Load(); p != nil {
+		return p
+	}
+	return &rolePolicy{}
+}
+
+// setRoles publishes new role definitions, safe for concurrent use. The
+// definitions must not be modified afterwards.
+func (m *Middleware) setRoles(rd RoleDefinitions) {
+	policy := &rolePolicy{roles: rd, permissive: rd.permissiveRoles(), order: m.EvaluationOrder, audits: rd.auditPermissions()}
+	if m.DecisionCacheSize > 0 {
+		policy.cache = newDecisionCache(m.DecisionCacheSize)
+		policy.static = rd.staticRoles()
+	}
+	m.roles.Store(policy)
+	m.status.loaded()
+}
+
 // Validate implements caddy.Validator.
 func (m *Middleware) Validate() error {
-	if m.roles == nil {
+	if m.getRoles() == nil {
 		return fmt.Errorf("no role permissions defined")
 	}
-	if m.Role == "" {
+	if m.Role == "" && m.RoleCookie == "" {
 		return fmt.Errorf("no role defined")
 	}
+	if driver, _, ok := strings.Cut(m.RolesDB, ":"); ok {
+		if err := checkSQLDriver(driver); err != nil {
+			return err
+		}
+	}
+	for action := range m.ActionVocabulary {
+		if !slices.Contains(builtinActions, action) {
+			return fmt.Errorf("unknown action in action_vocabulary: %s", action)
+		}
+	}
+	if m.ResourceSource != "" && m.ResourceSource != "path" && !strings.HasPrefix(m.ResourceSource, "body:") {
+		return fmt.Errorf("resource_source must be path or body:<path>, got %s", m.ResourceSource)
+	}
+	if strings.HasPrefix(m.ResourceSource, "body:") && len(m.ResourceSourceEndpoints) == 0 {
+		return fmt.Errorf("resource_source %s requires the endpoints taking their resource from the body", m.ResourceSource)
+	}
+	if m.TenantSegment != nil && *m.TenantSegment < 0 {
+		return fmt.Errorf("tenant_segment must not be negative")
+	}
+	if !slices.Contains(errorFormats, m.ErrorFormat) {
+		return fmt.Errorf("error_format must be one of text, json, ra, html or auto, got %s", m.ErrorFormat)
+	}
+	if m.ForbiddenStatus != 0 && m.ForbiddenStatus != http.StatusForbidden && m.ForbiddenStatus != http.StatusNotFound {
+		return fmt.Errorf("forbidden_status must be 403 or 404, got %d", m.ForbiddenStatus)
+	}
+	if !m.EvaluationOrder.valid() {
+		return fmt.Errorf("unknown evaluation_order: %s", m.EvaluationOrder)
+	}
+	if m.DecisionCacheSize < 0 {
+		return fmt.Errorf("decision_cache_size must not be negative")
+	}
+	if m.SoftDenyDelay < 0 {
+		return fmt.Errorf("soft_deny_delay must not be negative")
+	}
+	if m.SoftDenyDelay > 0 && len(m.SoftDenyRoles) == 0 {
+		return fmt.Errorf("soft_deny_delay requires soft_deny_roles")
+	}
+	if m.UnmappedMethodStatus != 0 && (m.UnmappedMethodStatus < 400 || m.UnmappedMethodStatus > 599) {
+		return fmt.Errorf("unmapped_method_status must be an error status, got %d", m.UnmappedMethodStatus)
+	}
+	for _, override := range m.UnmappedMethodStatuses {
+		if override.Status < 400 || override.Status > 599 {
+			return fmt.Errorf("unmapped_method_status of %s must be an error status, got %d", override.Resource, override.Status)
+		}
+	}
+	if m.SplitPatch && m.MergePutPatch != nil {
+		return fmt.Errorf("split_patch cannot be used with merge_put_patch")
+	}
+	if m.ResourcePosition != "" && m.ResourcePosition != "root" && m.ResourcePosition != "leaf" {
+		return fmt.Errorf("resource_position must be root or leaf, got %s", m.ResourcePosition)
+	}
+	if m.ResourcePosition == "leaf" && m.DetectInvocations {
+		return fmt.Errorf("detect_invocations cannot be used with resource_position leaf")
+	}
+	if m.MaxPathSegments != nil && *m.MaxPathSegments < 0 {
+		return fmt.Errorf("max_path_segments must not be negative")
+	}
+	if m.UnknownResourceStatus != 0 && (m.UnknownResourceStatus < 400 || m.UnknownResourceStatus > 599) {
+		return fmt.Errorf("unknown_resource_status must be an error status, got %d", m.UnknownResourceStatus)
+	}
+	for _, permission := range m.GlobalDeny {
+		if err := permission.validateStatus(); err != nil {
+			return fmt.Errorf("global_deny: %w", err)
+		}
+	}
+	for _, rl := range m.RateLimits {
+		if rl.Limit <= 0 || rl.Window <= 0 {
+			return fmt.Errorf("rate limit of role %s must have a positive limit and window", rl.Role)
+		}
+	}
+	if err := m.validateRoles(m.getRoles()); err != nil {
+		return fmt.Errorf("invalid roles: %w", err)
+	}
 	return nil
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
-func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-  // Retrieve the replacer from the request context
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// Retrieve the replacer from the request context
 	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 	if !ok {
 		return caddyhttp.Error(http.StatusInternalServerError, nil)
 	}
 
-	// Extract resource from URL path
-	resource := extractResource(r.URL.Path)
+	// Skipped paths, such as health checks, bypass the middleware entirely
+	if len(m.SkipPaths) > 0 {
+		path := normalizePath(r.URL.Path)
+		for _, pattern := range m.SkipPaths {
+			if matchWildcard(pattern, path) {
+				return next.ServeHTTP(w, r)
+			}
+		}
+	}
+
+	maxPathSegments := defaultMaxPathSegments
+	if m.MaxPathSegments != nil {
+		maxPathSegments = *m.MaxPathSegments
+	}
+	if maxPathSegments > 0 && countSegments(r.URL.Path) > maxPathSegments {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("path has more than %d segments", maxPathSegments))
+	}
+
+	logger := m.logger
+	if traceID := m.traceID(r); traceID != "" {
+		logger = logger.With(zap.String("trace_id", traceID))
+	}
+
+	maxBodyBytes := m.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	body := newRequestBody(r, maxBodyBytes)
+
+	// Determine action and resource from HTTP request
+	action, resource := m.resolver.Resolve(r)
+	if headerAction := m.headerAction(r); headerAction != "" {
+		if !slices.Contains(m.knownActions(), headerAction) || headerAction == "*" {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("unknown action in %s header: %s", m.ActionHeader, headerAction))
+		}
+		action = headerAction
+	}
+	// Generic endpoints may name another resource, in the query or the body
+	pathResource := m.resolveAlias(resource)
+	resource = m.queryResource(r, resource)
+	if bodyResource := m.bodyResource(body, pathResource); bodyResource != "" {
+		resource = bodyResource
+	}
+	resource = m.resolveAlias(resource)
+	if resource == "" {
+		resource = m.RootResource
+	}
 	if resource == "" {
 		// No resource in path, allow request to continue
 		return next.ServeHTTP(w, r)
 	}
-	
-	// Determine action from HTTP request
-	action := getActionFromRequest(r)
+
+	// Public resources don't require any permission. Only the resource of
+	// the path counts, so that a resource named by the client can't make a
+	// request public.
+	for _, pattern := range m.PublicResources {
+		if matchWildcard(pattern, pathResource) {
+			return next.ServeHTTP(w, r)
+		}
+	}
+
+	// Unknown resources are denied whatever the role, if resources are known
+	if len(m.KnownResources) > 0 && !slices.ContainsFunc(m.KnownResources, func(pattern string) bool {
+		return matchWildcard(pattern, resource)
+	}) {
+		logger.Log(m.deniedLevel, "Unknown resource", zap.String("resource", resource))
+		status := m.UnknownResourceStatus
+		if status == 0 {
+			status = http.StatusNotFound
+		}
+		return caddyhttp.Error(status, fmt.Errorf("unknown resource: %s", resource))
+	}
+
 	if action == "" {
 		// Unknown method, deny access
-		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return caddyhttp.Error(m.unmappedMethodStatus(resource), fmt.Errorf("method not allowed"))
+	}
+
+	// Writes are blocked for everyone during maintenance
+	if m.isReadOnly(repl) && !safeMethods[m.effectiveMethod(r)] {
+		logger.Log(m.deniedLevel, "Write blocked by read-only mode",
+			zap.String("action", action),
+			zap.String("resource", resource),
+		)
+		retryAfter := time.Duration(m.ReadOnlyRetryAfter)
+		if retryAfter <= 0 {
+			retryAfter = defaultReadOnlyRetryAfter
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("read-only mode"))
+	}
+
+	if header := m.missingHeader(r, action); header != "" {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing required header %s for action %s", header, action))
+	}
+
+	t := target{
+		action:   action,
+		method:   m.effectiveMethod(r),
+		resource: resource,
+		record:   m.extractRecordID(r.URL.Path),
+		tenant:   m.extractTenant(r.URL.Path),
+		host:     requestHost(r),
+		path:     normalizePath(r.URL.Path),
+		request:  r,
+		body:     body,
+		repl:     repl,
+	}
+
+	if m.DetectReferences && action == m.actionName("get_many_reference") {
+		t.scope = referenceField(r)
+	}
+	if m.DetectInvocations && action == m.actionName("invoke") {
+		t.scope = m.invocationVerb(r.URL.Path)
+	}
+
+	// Permissions can refer to the resource and the record of the request
+	repl.Set("http.rbac.resource", t.resource)
+	repl.Set("http.rbac.record", t.record)
+	if m.TenantSegment != nil {
+		repl.Set("http.rbac.tenant", t.tenant)
+	}
+
+	// Traced requests get their decision trace rather than being served
+	if m.traced(r) {
+		resolvedRole := m.resolveRole(r, repl)
+		roles := splitRoles(resolvedRole)
+		return m.writeTrace(w, strings.Join(roles, ","), roles, t)
+	}
+
+	// Global deny rules apply before any role is considered
+	for i, permission := range m.GlobalDeny {
+		if matchTarget(permission, t) {
+			decision := newDecision(&m.GlobalDeny[i])
+			decision.Allowed = false
+			setDecisionPlaceholders(repl, decision)
+			m.setDecisionHeader(w, decision, "", action)
+			logger.Log(m.deniedLevel, "Access denied globally",
+				zap.String("action", action),
+				zap.String("resource", resource),
+				zap.String("reason", decision.Reason),
+			)
+			m.notifyDenied(r, "", action, resource, decision.Reason)
+			return m.deny(w, r, decision)
+		}
 	}
 
-	// Resolve placeholders in the role
-	resolvedRole := repl.ReplaceAll(m.Role, "")
-	resolvedRole = strings.TrimSpace(resolvedRole)
+	resolvedRole := m.resolveRole(r, repl)
 
 	if resolvedRole == "" {
 		// No role defined, deny access
 		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("role not defined"))
 	}
-	
-	// Get permissions for the current role
-	permissions, exists := m.roles[resolvedRole]
+
+	// Check if access is allowed
+	// The role may be a JSON array of roles, whose permissions are combined
+	roles := splitRoles(resolvedRole)
+	resolvedRole = strings.Join(roles, ",")
+	policy := m.getPolicy()
+	decision, exists := policy.decideRoles(roles, t)
 	if !exists {
-		m.logger.Warn("Role not found", zap.String("role", resolvedRole))
+		logger.Warn("Role not found", zap.String("role", resolvedRole))
 		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("role not found: %s", resolvedRole))
 	}
-	
-	// Check if access is allowed
-	if !canAccessWithPermissions(permissions, action, resource) {
-		m.logger.Info("Access denied", 
+	for _, permission := range policy.audited(roles, t) {
+		logger.Info("Access audited",
+			zap.String("role", resolvedRole),
+			zap.String("action", action),
+			zap.String("resource", resource),
+			zap.Bool("allowed", decision.Allowed),
+			zap.String("reason", permission.Reason),
+		)
+	}
+	setDecisionPlaceholders(repl, decision)
+	m.setDecisionHeader(w, decision, resolvedRole, action)
+	if !decision.Allowed && m.softDenied(policy.roles, roles) {
+		if err := sleep(r.Context(), time.Duration(m.SoftDenyDelay)); err != nil {
+			return err
+		}
+		if m.SoftDenyAllow {
+			logger.Warn("Access soft denied",
+				zap.String("role", resolvedRole),
+				zap.String("action", action),
+				zap.String("resource", resource),
+				zap.String("reason", decision.Reason),
+				zap.Any("permission", decision.MatchedPermission),
+			)
+			return next.ServeHTTP(w, r)
+		}
+	}
+	if !decision.Allowed {
+		logger.Log(m.deniedLevel, "Access denied",
 			zap.String("role", resolvedRole),
 			zap.String("action", action),
 			zap.String("resource", resource),
+			zap.String("reason", decision.Reason),
+			zap.Any("permission", decision.MatchedPermission),
 		)
-		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("access denied"))
+		m.notifyDenied(r, resolvedRole, action, resource, decision.Reason)
+		return m.deny(w, r, decision)
+	}
+
+	// Throttle the role if it exceeds a rate limit
+	for _, rl := range m.RateLimits {
+		i := slices.IndexFunc(roles, func(role string) bool { return rl.appliesTo(policy.roles, role, action) })
+		if i >= 0 && !m.limiter.allow(rl.key(r, roles[i]), rl.Limit, time.Duration(rl.Window)) {
+			logger.Log(m.deniedLevel, "Rate limit exceeded",
+				zap.String("role", resolvedRole),
+				zap.String("action", action),
+				zap.String("resource", resource),
+			)
+			return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded"))
+		}
 	}
-	
+
 	// Access allowed, continue to next handler
-	m.logger.Info("Access granted", 
+	logger.Log(m.grantedLevel, "Access granted",
 		zap.String("role", resolvedRole),
 		zap.String("action", action),
 		zap.String("resource", resource),
+		zap.Any("permission", decision.MatchedPermission),
 	)
 	return next.ServeHTTP(w, r)
 }
 
+// unmappedMethodStatus returns the status of requests to a resource whose
+// method maps to no action: the one of the first resource pattern matching
+// it, or the default one, 405 unless configured
+func (m *Middleware) unmappedMethodStatus(resource string) int {
+	for _, override := range m.UnmappedMethodStatuses {
+		if matchWildcard(override.Resource, resource) {
+			return override.Status
+		}
+	}
+	if m.UnmappedMethodStatus != 0 {
+		return m.UnmappedMethodStatus
+	}
+	return http.StatusMethodNotAllowed
+}
+
+// headerAction returns the action supplied by the action header, if any
+func (m *Middleware) headerAction(r *http.Request) string {
+	if m.ActionHeader == "" {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(m.ActionHeader))
+}
+
+// queryResource returns the resource named in the resource query parameter
+// for requests to a generic endpoint (e.g. "posts" for /search?type=posts),
+// an empty string if the parameter is missing, and the path resource for
+// other requests
+func (m *Middleware) queryResource(r *http.Request, resource string) string {
+	if m.ResourceQueryParam == "" || !slices.ContainsFunc(m.ResourceQueryEndpoints, func(pattern string) bool {
+		return matchWildcard(pattern, resource)
+	}) {
+		return resource
+	}
+	return strings.TrimSpace(r.URL.Query().Get(m.ResourceQueryParam))
+}
+
+// bodyResource returns the resource named in the request body when the
+// resource source is "body:<path>" and the path resource is a generic
+// endpoint, or an empty string if there is none
+func (m *Middleware) bodyResource(body *requestBody, pathResource string) string {
+	path, ok := strings.CutPrefix(m.ResourceSource, "body:")
+	if !ok || !slices.ContainsFunc(m.ResourceSourceEndpoints, func(pattern string) bool {
+		return matchWildcard(pattern, pathResource)
+	}) {
+		return ""
+	}
+	value, ok := body.get()
+	if !ok {
+		return ""
+	}
+	resource, _ := lookupJSONPath(value, path)
+	return resource
+}
+
+// splitRoles returns the roles of a resolved role value, which is either a
+// single role or a JSON array of roles, e.g. ["editor","reviewer"]
+func splitRoles(value string) []string {
+	if !strings.HasPrefix(value, "[") {
+		return []string{value}
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return []string{value}
+	}
+	roles := make([]string, 0, len(list))
+	for _, role := range list {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		return []string{value}
+	}
+	return roles
+}
+
+// defaultReadOnlyRetryAfter is the delay after which clients are told to
+// retry writes blocked by the read-only mode, unless configured otherwise
+const defaultReadOnlyRetryAfter = time.Minute
+
+// missingHeader returns the first header required by an action which the
+// request doesn't have, or an empty string if it has them all
+func (m *Middleware) missingHeader(r *http.Request, action string) string {
+	for _, key := range []string{action, "*"} {
+		for _, header := range m.RequiredHeaders[key] {
+			if strings.TrimSpace(r.Header.Get(header)) == "" {
+				return header
+			}
+		}
+	}
+	return ""
+}
+
+// safeMethods are the HTTP methods which don't modify anything, let through
+// by the read-only mode whatever their action
+var safeMethods = map[string]bool{
+	"GET":      true,
+	"HEAD":     true,
+	"OPTIONS":  true,
+	"PROPFIND": true,
+}
+
+// isReadOnly tells whether writes are blocked, resolving the placeholders
+// of the read-only setting, e.g. "{env.READ_ONLY}"
+func (m *Middleware) isReadOnly(repl *caddy.Replacer) bool {
+	if m.ReadOnly == "" {
+		return false
+	}
+	readOnly, err := strconv.ParseBool(strings.TrimSpace(repl.ReplaceAll(m.ReadOnly, "")))
+	return err == nil && readOnly
+}
+
+// resolveRole returns the role of the request, resolving the placeholders
+// of the role and of its fallbacks in order until one is not empty, then
+// falling back to the role cookie. With SkipUnknown, values which are not
+// defined roles are skipped as well, and the first of them is returned if
+// no source resolves to a defined role, so that the request is denied.
+func (m *Middleware) resolveRole(r *http.Request, repl *caddy.Replacer) string {
+	first := ""
+	for _, source := range append([]string{m.Role}, m.RoleFallbacks...) {
+		role := strings.TrimSpace(repl.ReplaceAll(source, ""))
+		if role == "" {
+			continue
+		}
+		if !m.SkipUnknown || m.getPolicy().defines(splitRoles(role)) {
+			return role
+		}
+		if first == "" {
+			first = role
+		}
+	}
+	if m.RoleCookie != "" {
+		if role := m.roleFromCookie(r); role != "" && (!m.SkipUnknown || m.getPolicy().defines(splitRoles(role))) {
+			return role
+		} else if first == "" {
+			first = role
+		}
+	}
+	return first
+}
+
+// setDecisionPlaceholders exposes the decision as {http.rbac.decision}
+// ("allow" or "deny") and {http.rbac.reason} placeholders
+func setDecisionPlaceholders(repl *caddy.Replacer, decision Decision) {
+	if decision.Allowed {
+		repl.Set("http.rbac.decision", "allow")
+	} else {
+		repl.Set("http.rbac.decision", "deny")
+	}
+	repl.Set("http.rbac.reason", decision.Reason)
+}
+
+// setDecisionHeader writes the decision, the role and the action in the
+// decision header, if any, e.g. "deny; role=reader; action=delete"
+func (m *Middleware) setDecisionHeader(w http.ResponseWriter, decision Decision, role, action string) {
+	if m.DecisionHeader == "" {
+		return
+	}
+	value := "deny"
+	if decision.Allowed {
+		value = "allow"
+	}
+	if role != "" {
+		value += "; role=" + role
+	}
+	value += "; action=" + action
+	w.Header().Set(m.DecisionHeader, value)
+}
+
+// deny rejects the request with the forbidden status, or the status of the
+// permission which denied it, writing the reason in the response body if the
+// reason is to be exposed. Requests rejected as not found never get a body,
+// so as not to reveal that the resource exists.
+func (m *Middleware) deny(w http.ResponseWriter, r *http.Request, decision Decision) error {
+	reason, status := decision.Reason, http.StatusForbidden
+	if decision.MatchedPermission != nil && decision.MatchedPermission.Status != 0 {
+		status = decision.MatchedPermission.Status
+	} else if m.ForbiddenStatus == http.StatusNotFound {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("access denied: %s", reason))
+	}
+	message, locale := m.denyMessage(r)
+	if m.ExposeReason && reason != "" {
+		if message != "" {
+			message += ": "
+		}
+		message += reason
+	}
+	if message != "" || (m.ErrorFormat != "" && m.ErrorFormat != "text") {
+		if message == "" {
+			message = "access denied"
+		}
+		if locale != "" {
+			w.Header().Set("Content-Language", locale)
+		}
+		return m.writeDenial(w, m.errorFormat(r), status, message)
+	}
+	if reason != "" {
+		return caddyhttp.Error(status, fmt.Errorf("access denied: %s", reason))
+	}
+	return caddyhttp.Error(status, fmt.Errorf("access denied"))
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume directive name
 
 	for d.NextBlock(0) {
 		param := d.Val()
-		var arg string
-		if !d.Args(&arg) {
-			return d.ArgErr()
-		}
 		switch param {
-			case "roles_file":
-				m.RolesFilePath = arg
-			case "role":
-				m.Role = arg
-			default:
-				return d.Errf("unknown subdirective: %s", param)
+		case "roles_file":
+			if !d.Args(&m.RolesFilePath) {
+				return d.ArgErr()
+			}
+			// Relative paths are relative to the Caddyfile
+			if !filepath.IsAbs(m.RolesFilePath) && d.File() != "" {
+				m.RolesFilePath = filepath.Join(filepath.Dir(d.File()), m.RolesFilePath)
+			}
+		case "roles_schema":
+			if !d.Args(&m.RolesSchema) {
+				return d.ArgErr()
+			}
+			if !filepath.IsAbs(m.RolesSchema) && d.File() != "" {
+				m.RolesSchema = filepath.Join(filepath.Dir(d.File()), m.RolesSchema)
+			}
+		case "roles_db":
+			if !d.Args(&m.RolesDB) {
+				return d.ArgErr()
+			}
+		case "roles_consul":
+			if !d.Args(&m.RolesConsul) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "decision_trace":
+			if !d.Args(&m.DecisionTrace) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "default_action":
+			if !d.Args(&m.DefaultAction) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "unmapped_method_status":
+			// unmapped_method_status <status> [<resource>...]
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid unmapped_method_status: %s", args[0])
+			}
+			if len(args) == 1 {
+				m.UnmappedMethodStatus = status
+			}
+			for _, resource := range args[1:] {
+				m.UnmappedMethodStatuses = append(m.UnmappedMethodStatuses, ResourceStatus{Resource: resource, Status: status})
+			}
+		case "resource_position":
+			if !d.Args(&m.ResourcePosition) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "trace_header":
+			if !d.Args(&m.TraceHeader) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "action_header":
+			if !d.Args(&m.ActionHeader) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "roles_storage":
+			if !d.Args(&m.RolesStorage) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "roles_consul_token":
+			if !d.Args(&m.RolesConsulToken) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_roles_bytes":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			size, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return d.Errf("invalid max_roles_bytes: %s", arg)
+			}
+			m.MaxRolesBytes = size
+		case "roles_load_timeout":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(arg)
+			if err != nil {
+				return d.Errf("invalid roles_load_timeout: %v", err)
+			}
+			m.RolesLoadTimeout = caddy.Duration(timeout)
+		case "roles_refresh":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(arg)
+			if err != nil {
+				return d.Errf("invalid roles_refresh: %v", err)
+			}
+			m.RolesRefresh = caddy.Duration(dur)
+		case "role":
+			// role <role> [<fallback>...], repeated lines adding fallbacks
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			if m.Role == "" {
+				m.Role, args = args[0], args[1:]
+			}
+			m.RoleFallbacks = append(m.RoleFallbacks, args...)
+		case "skip_unknown":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SkipUnknown = true
+		case "public_resources":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.PublicResources = append(m.PublicResources, args...)
+		case "skip_paths":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.SkipPaths = append(m.SkipPaths, args...)
+		case "known_resources":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.KnownResources = append(m.KnownResources, args...)
+		case "unknown_resource_status":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(arg)
+			if err != nil {
+				return d.Errf("invalid unknown_resource_status: %s", arg)
+			}
+			m.UnknownResourceStatus = status
+		case "root_resource":
+			if !d.Args(&m.RootResource) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "role_cookie":
+			// role_cookie <name> [<field>]
+			if !d.Args(&m.RoleCookie) {
+				return d.ArgErr()
+			}
+			d.Args(&m.RoleCookieField)
+		case "role_cookie_secret":
+			if !d.Args(&m.RoleCookieSecret) {
+				return d.ArgErr()
+			}
+		case "custom_actions":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.CustomActions = append(m.CustomActions, args...)
+		case "global_deny":
+			// global_deny <resource> [<action>...]
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			permission := Permission{Type: "deny", Resource: args[0]}
+			if len(args) > 1 {
+				permission.Action.Multiple = args[1:]
+			} else {
+				all := "*"
+				permission.Action.Single = &all
+			}
+			m.GlobalDeny = append(m.GlobalDeny, permission)
+		case "expose_reason":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ExposeReason = true
+		case "error_format":
+			if !d.Args(&m.ErrorFormat) {
+				return d.ArgErr()
+			}
+		case "error_template":
+			if !d.Args(&m.ErrorTemplate) {
+				return d.ArgErr()
+			}
+			if !filepath.IsAbs(m.ErrorTemplate) && d.File() != "" {
+				m.ErrorTemplate = filepath.Join(filepath.Dir(d.File()), m.ErrorTemplate)
+			}
+		case "deny_messages":
+			// deny_messages {
+			//     <locale> <message>
+			// }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if m.DenyMessages == nil {
+				m.DenyMessages = make(map[string]string)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				locale := d.Val()
+				var message string
+				if !d.Args(&message) {
+					return d.ArgErr()
+				}
+				m.DenyMessages[locale] = message
+			}
+		case "forbidden_status":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(arg)
+			if err != nil {
+				return d.Errf("invalid forbidden_status: %s", arg)
+			}
+			m.ForbiddenStatus = status
+		case "max_body_bytes":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			size, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || size <= 0 {
+				return d.Errf("invalid max_body_bytes: %s", arg)
+			}
+			m.MaxBodyBytes = size
+		case "max_path_segments":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			segments, err := strconv.Atoi(arg)
+			if err != nil || segments < 0 {
+				return d.Errf("invalid max_path_segments: %s", arg)
+			}
+			m.MaxPathSegments = &segments
+		case "rate_limit":
+			// rate_limit <role> <limit> <window> {
+			//     actions <action>...
+			//     per_ip
+			// }
+			var role, limit, window string
+			if !d.Args(&role, &limit, &window) {
+				return d.ArgErr()
+			}
+			rl := RateLimit{Role: role}
+			var err error
+			if rl.Limit, err = strconv.Atoi(limit); err != nil {
+				return d.Errf("invalid rate limit: %s", limit)
+			}
+			dur, err := caddy.ParseDuration(window)
+			if err != nil {
+				return d.Errf("invalid rate limit window: %v", err)
+			}
+			rl.Window = caddy.Duration(dur)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "actions":
+					rl.Actions = d.RemainingArgs()
+					if len(rl.Actions) == 0 {
+						return d.ArgErr()
+					}
+				case "per_ip":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					rl.PerIP = true
+				default:
+					return d.Errf("unknown rate_limit subdirective: %s", d.Val())
+				}
+			}
+			m.RateLimits = append(m.RateLimits, rl)
+		case "resource_aliases":
+			// resource_aliases {
+			//     <alias> <resource>
+			// }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if m.ResourceAliases == nil {
+				m.ResourceAliases = make(map[string]string)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				alias := d.Val()
+				var resource string
+				if !d.Args(&resource) {
+					return d.ArgErr()
+				}
+				m.ResourceAliases[alias] = resource
+			}
+		case "case_insensitive":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CaseInsensitive = true
+		case "tenant_segment":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			index, err := strconv.Atoi(arg)
+			if err != nil {
+				return d.Errf("invalid tenant_segment: %s", arg)
+			}
+			m.TenantSegment = &index
+		case "version_prefix_pattern":
+			if !d.Args(&m.VersionPrefixPattern) {
+				return d.ArgErr()
+			}
+		case "strip_format":
+			// strip_format [on|off]
+			m.StripFormat = true
+			if d.NextArg() {
+				switch d.Val() {
+				case "on":
+				case "off":
+					m.StripFormat = false
+				default:
+					return d.Errf("invalid strip_format: %s", d.Val())
+				}
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "action_vocabulary":
+			// action_vocabulary {
+			//     <builtin action> <name>
+			// }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if m.ActionVocabulary == nil {
+				m.ActionVocabulary = make(map[string]string)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				action := d.Val()
+				var name string
+				if !d.Args(&name) {
+					return d.ArgErr()
+				}
+				m.ActionVocabulary[action] = name
+			}
+		case "detect_references":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DetectReferences = true
+		case "detect_invocations":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DetectInvocations = true
+		case "detect_collection_writes":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DetectCollectionWrites = true
+		case "honor_method_override":
+			// honor_method_override [<method>...]
+			methods := d.RemainingArgs()
+			if len(methods) == 0 {
+				methods = defaultMethodOverrides
+			}
+			for _, method := range methods {
+				m.MethodOverrides = append(m.MethodOverrides, strings.ToUpper(method))
+			}
+		case "resource_source":
+			// resource_source path|body:<path> [<endpoint>...]
+			if !d.Args(&m.ResourceSource) {
+				return d.ArgErr()
+			}
+			m.ResourceSourceEndpoints = d.RemainingArgs()
+		case "resource_query_param":
+			// resource_query_param <param> <endpoint>...
+			if !d.Args(&m.ResourceQueryParam) {
+				return d.ArgErr()
+			}
+			m.ResourceQueryEndpoints = d.RemainingArgs()
+			if len(m.ResourceQueryEndpoints) == 0 {
+				return d.ArgErr()
+			}
+		case "log_granted":
+			if !d.Args(&m.LogGranted) {
+				return d.ArgErr()
+			}
+		case "log_denied":
+			if !d.Args(&m.LogDenied) {
+				return d.ArgErr()
+			}
+		case "decision_cache_size":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(arg)
+			if err != nil {
+				return d.Errf("invalid decision_cache_size: %s", arg)
+			}
+			m.DecisionCacheSize = size
+		case "evaluation_order":
+			var order string
+			if !d.Args(&order) {
+				return d.ArgErr()
+			}
+			m.EvaluationOrder = EvaluationOrder(order)
+		case "action_group":
+			// action_group <name> <action>...
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if m.ActionGroups == nil {
+				m.ActionGroups = make(map[string][]string)
+			}
+			m.ActionGroups[args[0]] = args[1:]
+		case "method_action":
+			// method_action <method> <action>
+			var method, action string
+			if !d.Args(&method, &action) {
+				return d.ArgErr()
+			}
+			if m.MethodActions == nil {
+				m.MethodActions = make(map[string]string)
+			}
+			m.MethodActions[strings.ToUpper(method)] = action
+		case "require_headers":
+			// require_headers <action> <header>...
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if m.RequiredHeaders == nil {
+				m.RequiredHeaders = make(map[string][]string)
+			}
+			m.RequiredHeaders[args[0]] = append(m.RequiredHeaders[args[0]], args[1:]...)
+		case "emit_events":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.EmitEvents = true
+		case "deny_webhook":
+			if !d.Args(&m.DenyWebhook) {
+				return d.ArgErr()
+			}
+		case "read_only":
+			// read_only [<value>]
+			m.ReadOnly = "true"
+			d.Args(&m.ReadOnly)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "read_only_retry_after":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(arg)
+			if err != nil {
+				return d.Errf("invalid read_only_retry_after: %v", err)
+			}
+			m.ReadOnlyRetryAfter = caddy.Duration(dur)
+		case "soft_deny_delay":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(arg)
+			if err != nil {
+				return d.Errf("invalid soft_deny_delay: %v", err)
+			}
+			m.SoftDenyDelay = caddy.Duration(dur)
+		case "soft_deny_roles":
+			roles := d.RemainingArgs()
+			if len(roles) == 0 {
+				return d.ArgErr()
+			}
+			m.SoftDenyRoles = append(m.SoftDenyRoles, roles...)
+		case "soft_deny_allow":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SoftDenyAllow = true
+		case "decision_header":
+			if !d.Args(&m.DecisionHeader) {
+				return d.ArgErr()
+			}
+		case "ordered_evaluation":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.EvaluationOrder = Ordered
+		case "merge_put_patch":
+			var arg string
+			if !d.Args(&arg) {
+				return d.ArgErr()
+			}
+			merge, err := strconv.ParseBool(arg)
+			if err != nil {
+				return d.Errf("invalid merge_put_patch: %s", arg)
+			}
+			m.MergePutPatch = &merge
+		case "split_patch":
+			// split_patch [on|off]
+			m.SplitPatch = true
+			if d.NextArg() {
+				switch d.Val() {
+				case "on":
+				case "off":
+					m.SplitPatch = false
+				default:
+					return d.Errf("invalid split_patch: %s", d.Val())
+				}
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "action_resolver":
+			// action_resolver <module> { ... }
+			var name string
+			if !d.Args(&name) {
+				return d.ArgErr()
+			}
+			modID := "http.handlers.simple_rest_rbac.action_resolvers." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return err
+			}
+			resolver, ok := unm.(ActionResolver)
+			if !ok {
+				return d.Errf("module %s is not an ActionResolver; is %T", modID, unm)
+			}
+			m.ActionResolverRaw = caddyconfig.JSONModuleObject(resolver, "resolver", name, nil)
+		default:
+			return d.Errf("unknown subdirective: %s", param)
 		}
 	}
 
@@ -187,7 +1991,7 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 // parseCaddyfile unmarshals tokens from h into a new Middleware.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var m Middleware
+	m := new(Middleware)
 	err := m.UnmarshalCaddyfile(h.Dispenser)
 	return m, err
 }
@@ -196,6 +2000,7 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 var (
 	_ caddy.Provisioner           = (*Middleware)(nil)
 	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
-)
\ No newline at end of file
+)
@@ -0,0 +1,1217 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// parseRoles parses a roles file, failing the test if it is invalid
+func parseRoles(t testing.TB, rolesJSON string) RoleDefinitions {
+	t.Helper()
+	var rd RoleDefinitions
+	if err := rd.UnmarshalJSON([]byte(rolesJSON)); err != nil {
+		t.Fatalf("parsing roles: %v", err)
+	}
+	return rd
+}
+
+// tryProvision provisions and validates a middleware with the given roles,
+// or with the roles of its configured source if rolesJSON is empty, taking
+// the role from the X-Role header unless configured otherwise
+func tryProvision(t testing.TB, m *Middleware, rolesJSON string) error {
+	t.Helper()
+	if m.Role == "" && m.RoleCookie == "" {
+		m.Role = "{http.request.header.X-Role}"
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(func() {
+		m.Cleanup()
+		cancel()
+	})
+	if rolesJSON == "" {
+		if err := m.Provision(ctx); err != nil {
+			return err
+		}
+	} else if err := m.ProvisionWithRoles(ctx, parseRoles(t, rolesJSON)); err != nil {
+		return err
+	}
+	return m.Validate()
+}
+
+// provision provisions and validates a middleware with the given roles,
+// failing the test if the configuration is invalid
+func provision(t testing.TB, m *Middleware, rolesJSON string) *Middleware {
+	t.Helper()
+	if err := tryProvision(t, m, rolesJSON); err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+	return m
+}
+
+// unmarshalCaddyfile parses the Caddyfile block of the directive, failing
+// the test if it is invalid
+func unmarshalCaddyfile(t testing.TB, input string) *Middleware {
+	t.Helper()
+	m := &Middleware{}
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("parsing Caddyfile: %v", err)
+	}
+	return m
+}
+
+// newRequest builds a request with headers given as name and value pairs
+func newRequest(method, target string, headers ...string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Add(headers[i], headers[i+1])
+	}
+	return r
+}
+
+// result is the outcome of a request served by the middleware
+type result struct {
+	status int
+	// next tells whether the request reached the next handler
+	next bool
+	rec  *httptest.ResponseRecorder
+	err  error
+}
+
+// serve runs a request through the middleware, with a next handler
+// responding with 200 OK
+func serve(m *Middleware, r *http.Request) result {
+	caddyhttp.NewTestReplacer(r)
+	res := result{rec: httptest.NewRecorder()}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		res.next = true
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	res.err = m.ServeHTTP(res.rec, r, next)
+	res.status = res.rec.Code
+	if handlerErr, ok := res.err.(caddyhttp.HandlerError); ok {
+		res.status = handlerErr.StatusCode
+	} else if res.err != nil {
+		res.status = http.StatusInternalServerError
+	}
+	return res
+}
+
+// request describes a request and its expected status, for table-driven
+// tests
+type request struct {
+	method  string
+	target  string
+	headers []string
+	status  int
+}
+
+// expectStatuses serves requests and checks their statuses
+func expectStatuses(t *testing.T, m *Middleware, requests []request) {
+	t.Helper()
+	for _, req := range requests {
+		res := serve(m, newRequest(req.method, req.target, req.headers...))
+		if res.status != req.status {
+			t.Errorf("%s %s %v: got status %d, want %d (%v)", req.method, req.target, req.headers, res.status, req.status, res.err)
+		}
+		if res.next != (res.status == http.StatusOK) {
+			t.Errorf("%s %s %v: next handler called = %v with status %d", req.method, req.target, req.headers, res.next, res.status)
+		}
+	}
+}
+
+func TestReadOnlyLetsReadsThrough(t *testing.T) {
+	m := provision(t, &Middleware{
+		ReadOnly:         "true",
+		DetectReferences: true,
+		MethodActions:    map[string]string{"PROPFIND": "browse", "REPORT": "browse"},
+		DefaultAction:    "other",
+	}, `{
+		"admin": [{ "action": "*", "resource": "*" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/comments", []string{"X-Role", "admin"}, http.StatusOK},
+		{"GET", "/comments/1", []string{"X-Role", "admin"}, http.StatusOK},
+		{"GET", "/comments?post_id=1", []string{"X-Role", "admin"}, http.StatusOK},
+		{"HEAD", "/comments", []string{"X-Role", "admin"}, http.StatusOK},
+		{"PROPFIND", "/files", []string{"X-Role", "admin"}, http.StatusOK},
+		{"POST", "/comments", []string{"X-Role", "admin"}, http.StatusServiceUnavailable},
+		{"PUT", "/comments/1", []string{"X-Role", "admin"}, http.StatusServiceUnavailable},
+		{"DELETE", "/comments/1", []string{"X-Role", "admin"}, http.StatusServiceUnavailable},
+		{"REPORT", "/files", []string{"X-Role", "admin"}, http.StatusServiceUnavailable},
+	})
+}
+
+func TestSplitPatch(t *testing.T) {
+	m := provision(t, &Middleware{SplitPatch: true}, `{
+		"editor": [{ "action": ["show", "edit"], "resource": "posts" }],
+		"patcher": [{ "action": ["show", "patch"], "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"PUT", "/posts/1", []string{"X-Role", "editor"}, http.StatusOK},
+		{"PATCH", "/posts/1", []string{"X-Role", "editor"}, http.StatusForbidden},
+		{"PUT", "/posts/1", []string{"X-Role", "patcher"}, http.StatusForbidden},
+		{"PATCH", "/posts/1", []string{"X-Role", "patcher"}, http.StatusOK},
+		{"PROPPATCH", "/posts/1", []string{"X-Role", "patcher"}, http.StatusOK},
+	})
+}
+
+func TestSplitPatchConflictsWithMergePutPatch(t *testing.T) {
+	merge := true
+	if err := tryProvision(t, &Middleware{SplitPatch: true, MergePutPatch: &merge}, `{"editor": []}`); err == nil {
+		t.Error("expected split_patch and merge_put_patch to conflict")
+	}
+}
+
+func TestExtractResourceAndRecordIgnoreSlashes(t *testing.T) {
+	m := &Middleware{}
+	tests := []struct {
+		path, resource, record string
+	}{
+		{"/posts", "posts", ""},
+		{"/posts/", "posts", ""},
+		{"//posts", "posts", ""},
+		{"/posts/1", "posts", "1"},
+		{"/posts//1/", "posts", "1"},
+		{"///posts///1///", "posts", "1"},
+		{"/", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		if resource, record := m.extractResource(test.path), m.extractRecordID(test.path); resource != test.resource || record != test.record {
+			t.Errorf("%q: got %q and %q, want %q and %q", test.path, resource, record, test.resource, test.record)
+		}
+	}
+	if got := normalizePath("/posts//1/"); got != "/posts/1" {
+		t.Errorf("normalizePath: got %q, want /posts/1", got)
+	}
+}
+
+func TestRepeatedSlashesAreAuthorizedLikeSingleOnes(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"reader": [{ "action": ["list", "show"], "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts//1/", []string{"X-Role", "reader"}, http.StatusOK},
+		{"DELETE", "/posts//1/", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "//comments/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+}
+
+func TestGlobalDeny(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		global_deny internal_metrics
+		global_deny users delete edit
+	}`)
+	provision(t, m, `{
+		"admin": [{ "action": "*", "resource": "*" }],
+		"reader": [{ "action": ["list", "show"], "resource": "*" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/internal_metrics", []string{"X-Role", "admin"}, http.StatusForbidden},
+		{"GET", "/internal_metrics", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"DELETE", "/users/1", []string{"X-Role", "admin"}, http.StatusForbidden},
+		{"PUT", "/users/1", []string{"X-Role", "admin"}, http.StatusForbidden},
+		{"GET", "/users/1", []string{"X-Role", "admin"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "admin"}, http.StatusOK},
+	})
+}
+
+func TestReloadedRolesAreVisible(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"reader": [{ "action": "list", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/comments", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+
+	rd, err := m.prepareRoles(parseRoles(t, `{
+		"reader": [{ "action": "list", "resource": "comments" }]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setRoles(rd)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/comments", []string{"X-Role", "reader"}, http.StatusOK},
+	})
+}
+
+func TestConcurrentReloads(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"reader": [{ "action": "list", "resource": "posts" }]
+	}`)
+	rd := m.getRoles()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if res := serve(m, newRequest("GET", "/posts", "X-Role", "reader")); res.status != http.StatusOK {
+					t.Errorf("got status %d during reloads, want 200", res.status)
+					return
+				}
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		m.setRoles(rd)
+	}
+	wg.Wait()
+}
+
+// BenchmarkConcurrentReads measures the read path of parallel requests, with
+// and without roles being reloaded meanwhile
+func BenchmarkConcurrentReads(b *testing.B) {
+	for _, reloading := range []bool{false, true} {
+		name := "idle"
+		if reloading {
+			name = "reloading"
+		}
+		b.Run(name, func(b *testing.B) {
+			m := provision(b, &Middleware{LogGranted: "debug"}, `{
+				"reader": [{ "action": "list", "resource": "posts" }]
+			}`)
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			if reloading {
+				rd := m.getRoles()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+							m.setRoles(rd)
+						}
+					}
+				}()
+			}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if res := serve(m, newRequest("GET", "/posts", "X-Role", "reader")); res.status != http.StatusOK {
+						b.Errorf("got status %d, want 200", res.status)
+						return
+					}
+				}
+			})
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func TestVersionPrefixPattern(t *testing.T) {
+	m := provision(t, &Middleware{VersionPrefixPattern: `^v\d+$`}, `{
+		"reader": [{ "action": ["list", "show"], "resource": "posts" }]
+	}`)
+	tests := []struct {
+		path, resource, record string
+	}{
+		{"/v1/posts/1", "posts", "1"},
+		{"/v2/posts", "posts", ""},
+		{"/posts/1", "posts", "1"},
+		{"/version/posts", "version", "posts"},
+		{"/v1", "", ""},
+	}
+	for _, test := range tests {
+		if resource, record := m.extractResource(test.path), m.extractRecordID(test.path); resource != test.resource || record != test.record {
+			t.Errorf("%q: got %q and %q, want %q and %q", test.path, resource, record, test.resource, test.record)
+		}
+	}
+	expectStatuses(t, m, []request{
+		{"GET", "/v1/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/v2/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"DELETE", "/v1/posts/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+}
+
+func TestPublicResources(t *testing.T) {
+	m := provision(t, &Middleware{PublicResources: []string{"health", "docs*"}}, `{
+		"reader": [{ "action": "list", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/health", nil, http.StatusOK},
+		{"POST", "/health", nil, http.StatusOK},
+		{"GET", "/docs_v2/intro", []string{"X-Role", "reader"}, http.StatusOK},
+		{"DELETE", "/docs/1", []string{"X-Role", "unknown"}, http.StatusOK},
+		{"GET", "/posts", nil, http.StatusMethodNotAllowed},
+		{"GET", "/healthz", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+}
+
+func TestRoleFallbacks(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		role {http.request.header.X-Role} {http.request.header.X-Default-Role} guest
+	}`)
+	provision(t, m, `{
+		"reader": [{ "action": "list", "resource": "posts" }],
+		"writer": [{ "action": ["list", "create"], "resource": "posts" }],
+		"guest": [{ "action": "list", "resource": "public" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/posts", []string{"X-Role", "writer", "X-Default-Role", "reader"}, http.StatusOK},
+		{"POST", "/posts", []string{"X-Default-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Default-Role", "reader"}, http.StatusOK},
+		{"GET", "/public", nil, http.StatusOK},
+		{"GET", "/posts", nil, http.StatusForbidden},
+	})
+}
+
+func TestSkipUnknownRoles(t *testing.T) {
+	roles := `{
+		"reader": [{ "action": "list", "resource": "posts" }],
+		"guest": [{ "action": "list", "resource": "public" }]
+	}`
+	tests := []struct {
+		skipUnknown bool
+		requests    []request
+	}{
+		{false, []request{
+			{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+			{"GET", "/posts", []string{"X-Role", "admin", "X-Default-Role", "reader"}, http.StatusForbidden},
+			{"GET", "/public", nil, http.StatusOK},
+		}},
+		{true, []request{
+			{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+			{"GET", "/posts", []string{"X-Role", "admin", "X-Default-Role", "reader"}, http.StatusOK},
+			{"GET", "/public", []string{"X-Role", "admin", "X-Default-Role", "root"}, http.StatusOK},
+			{"GET", "/posts", []string{"X-Role", "admin", "X-Default-Role", "root"}, http.StatusForbidden},
+		}},
+	}
+	for _, test := range tests {
+		config := "simple_rest_rbac {\n\trole {http.request.header.X-Role}\n\trole {http.request.header.X-Default-Role}\n\trole guest\n"
+		if test.skipUnknown {
+			config += "\tskip_unknown\n"
+		}
+		m := unmarshalCaddyfile(t, config+"}")
+		if len(m.RoleFallbacks) != 2 {
+			t.Fatalf("got role fallbacks %q, want the 2 last role lines", m.RoleFallbacks)
+		}
+		provision(t, m, roles)
+		t.Run(fmt.Sprintf("skip_unknown %v", test.skipUnknown), func(t *testing.T) {
+			expectStatuses(t, m, test.requests)
+		})
+	}
+}
+
+func TestExtractTenant(t *testing.T) {
+	tests := []struct {
+		segment          *int
+		path             string
+		tenant, resource string
+	}{
+		{nil, "/t/acme/posts/5", "", "t"},
+		{intPtr(0), "/acme/posts/5", "acme", "posts"},
+		{intPtr(1), "/t/acme/posts/5", "acme", "posts"},
+		{intPtr(1), "//t//acme/posts", "acme", "posts"},
+		{intPtr(1), "/t/acme", "acme", ""},
+		{intPtr(1), "/t", "", ""},
+	}
+	for _, test := range tests {
+		m := &Middleware{TenantSegment: test.segment}
+		if tenant := m.extractTenant(test.path); tenant != test.tenant {
+			t.Errorf("%s: got tenant %q, want %q", test.path, tenant, test.tenant)
+		}
+		if resource := m.extractResource(test.path); resource != test.resource {
+			t.Errorf("%s: got resource %q, want %q", test.path, resource, test.resource)
+		}
+	}
+}
+
+func TestTenantScopedPermissions(t *testing.T) {
+	m := provision(t, &Middleware{TenantSegment: intPtr(1)}, `{
+		"tenant_admin": [
+			{ "action": "*", "resource": "*", "tenant": "{http.request.header.X-Tenant}" }
+		],
+		"reporter": [
+			{ "action": "list", "resource": "{tenant}_reports" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"DELETE", "/t/acme/posts/5", []string{"X-Role", "tenant_admin", "X-Tenant", "acme"}, http.StatusOK},
+		{"DELETE", "/t/globex/posts/5", []string{"X-Role", "tenant_admin", "X-Tenant", "acme"}, http.StatusForbidden},
+		{"GET", "/t/acme/posts", []string{"X-Role", "tenant_admin"}, http.StatusForbidden},
+		{"GET", "/t/acme/acme_reports", []string{"X-Role", "reporter"}, http.StatusOK},
+		{"GET", "/t/acme/globex_reports", []string{"X-Role", "reporter"}, http.StatusForbidden},
+	})
+
+	r := newRequest("GET", "/t/acme/acme_reports", "X-Role", "reporter")
+	serve(m, r)
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if tenant, _ := repl.GetString("http.rbac.tenant"); tenant != "acme" {
+		t.Errorf("got tenant placeholder %q, want %q", tenant, "acme")
+	}
+}
+
+func TestTenantSegmentConfig(t *testing.T) {
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\ttenant_segment 1\n}")
+	if m.TenantSegment == nil || *m.TenantSegment != 1 {
+		t.Errorf("got tenant segment %v, want 1", m.TenantSegment)
+	}
+	if err := tryProvision(t, &Middleware{TenantSegment: intPtr(-1)}, `{}`); err == nil {
+		t.Error("expected a negative tenant segment to be rejected")
+	}
+}
+
+func TestResourceAliases(t *testing.T) {
+	for _, caseInsensitive := range []bool{false, true} {
+		m := unmarshalCaddyfile(t, `simple_rest_rbac {
+			resource_aliases {
+				articles posts
+				Notes comments
+			}
+		}`)
+		m.CaseInsensitive = caseInsensitive
+		provision(t, m, `{
+			"reader": [{ "action": ["list", "show"], "resource": "posts" }],
+			"commenter": [{ "action": "*", "resource": "comments" }]
+		}`)
+		mixedCase := http.StatusForbidden
+		if caseInsensitive {
+			mixedCase = http.StatusOK
+		}
+		tests := []request{
+			{"GET", "/posts/1", []string{"X-Role", "reader"}, http.StatusOK},
+			{"GET", "/articles/1", []string{"X-Role", "reader"}, http.StatusOK},
+			{"DELETE", "/articles/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+			{"GET", "/Articles", []string{"X-Role", "reader"}, mixedCase},
+			{"POST", "/Notes", []string{"X-Role", "commenter"}, http.StatusOK},
+			{"POST", "/notes", []string{"X-Role", "commenter"}, mixedCase},
+			{"GET", "/articles", []string{"X-Role", "commenter"}, http.StatusForbidden},
+		}
+		t.Run(fmt.Sprintf("case insensitive %v", caseInsensitive), func(t *testing.T) {
+			expectStatuses(t, m, tests)
+		})
+	}
+}
+
+func TestAliasesAreReportedAsTheirResource(t *testing.T) {
+	m := &Middleware{ResourceAliases: map[string]string{"articles": "posts"}}
+	r := newRequest("GET", "/articles/1", "X-Role", "reader")
+	provision(t, m, `{"reader": [{ "action": "show", "resource": "posts" }]}`)
+	serve(m, r)
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if resource, _ := repl.GetString("http.rbac.resource"); resource != "posts" {
+		t.Errorf("got resource placeholder %q, want posts", resource)
+	}
+}
+
+func TestMergePutPatch(t *testing.T) {
+	merge, split := true, false
+	tests := []struct {
+		merge      *bool
+		put, patch string
+	}{
+		{nil, "edit", "edit"},
+		{&merge, "edit", "edit"},
+		{&split, "replace", "patch"},
+	}
+	for _, test := range tests {
+		m := &Middleware{MergePutPatch: test.merge}
+		if action := m.getActionFromRequest(newRequest("PUT", "/posts/1")); action != test.put {
+			t.Errorf("merge %v: got PUT action %q, want %q", m.mergePutPatch(), action, test.put)
+		}
+		if action := m.getActionFromRequest(newRequest("PATCH", "/posts/1")); action != test.patch {
+			t.Errorf("merge %v: got PATCH action %q, want %q", m.mergePutPatch(), action, test.patch)
+		}
+	}
+}
+
+func TestReplaceAndPatchPermissions(t *testing.T) {
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tmerge_put_patch false\n}")
+	provision(t, m, `{
+		"patcher": [{ "action": "patch", "resource": "posts" }],
+		"replacer": [{ "action": "replace", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"PATCH", "/posts/1", []string{"X-Role", "patcher"}, http.StatusOK},
+		{"PUT", "/posts/1", []string{"X-Role", "patcher"}, http.StatusForbidden},
+		{"PUT", "/posts/1", []string{"X-Role", "replacer"}, http.StatusOK},
+		{"PATCH", "/posts/1", []string{"X-Role", "replacer"}, http.StatusForbidden},
+	})
+}
+
+func TestMethodOverride(t *testing.T) {
+	tests := []struct {
+		config   string
+		override string
+		method   string
+	}{
+		{"", "DELETE", "POST"},
+		{"honor_method_override", "DELETE", "DELETE"},
+		{"honor_method_override", "patch", "PATCH"},
+		{"honor_method_override", "GET", "POST"},
+		{"honor_method_override", "", "POST"},
+		{"honor_method_override DELETE", "PUT", "POST"},
+		{"honor_method_override delete", "DELETE", "DELETE"},
+	}
+	for _, test := range tests {
+		m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\t"+test.config+"\n}")
+		r := newRequest("POST", "/posts/1", "X-HTTP-Method-Override", test.override)
+		if method := m.effectiveMethod(r); method != test.method {
+			t.Errorf("%q with override %q: got method %q, want %q", test.config, test.override, method, test.method)
+		}
+		if method := m.effectiveMethod(newRequest("GET", "/posts/1", "X-HTTP-Method-Override", "DELETE")); method != "GET" {
+			t.Errorf("%q: overrode the method of a GET request with %q", test.config, method)
+		}
+	}
+}
+
+func TestMethodOverrideActions(t *testing.T) {
+	m := provision(t, &Middleware{MethodOverrides: defaultMethodOverrides}, `{
+		"author": [{ "action": ["create", "edit"], "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/posts", []string{"X-Role", "author"}, http.StatusOK},
+		{"POST", "/posts/1", []string{"X-Role", "author", "X-HTTP-Method-Override", "PUT"}, http.StatusOK},
+		{"POST", "/posts/1", []string{"X-Role", "author", "X-HTTP-Method-Override", "DELETE"}, http.StatusForbidden},
+	})
+}
+
+func TestKnownResources(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		status int
+	}{
+		{"default status", "known_resources posts comment*\n\tpublic_resources health", http.StatusNotFound},
+		{"custom status", "known_resources posts\n\tknown_resources comment*\n\tpublic_resources health\n\tunknown_resource_status 403", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\t"+test.config+"\n}")
+			provision(t, m, `{"admin": [{ "action": "*", "resource": "*" }]}`)
+			expectStatuses(t, m, []request{
+				{"GET", "/posts", []string{"X-Role", "admin"}, http.StatusOK},
+				{"DELETE", "/comments/1", []string{"X-Role", "admin"}, http.StatusOK},
+				{"GET", "/health", nil, http.StatusOK},
+				{"GET", "/post", []string{"X-Role", "admin"}, test.status},
+				// Unknown resources are denied before the role is checked
+				{"GET", "/users", nil, test.status},
+			})
+		})
+	}
+	if err := tryProvision(t, &Middleware{KnownResources: []string{"posts"}, UnknownResourceStatus: 200}, `{"admin": []}`); err == nil {
+		t.Error("expected a non-error unknown_resource_status to be rejected")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	tests := []struct {
+		logGranted, logDenied string
+		granted, denied       zapcore.Level
+	}{
+		{"", "", zapcore.InfoLevel, zapcore.InfoLevel},
+		{"debug", "warn", zapcore.DebugLevel, zapcore.WarnLevel},
+		{"ERROR", "error", zapcore.ErrorLevel, zapcore.ErrorLevel},
+	}
+	for _, test := range tests {
+		m := provision(t, &Middleware{LogGranted: test.logGranted, LogDenied: test.logDenied}, `{
+			"reader": [{ "action": "list", "resource": "posts" }]
+		}`)
+		core, logs := observer.New(zapcore.DebugLevel)
+		m.logger = zap.New(core)
+		serve(m, newRequest("GET", "/posts", "X-Role", "reader"))
+		serve(m, newRequest("GET", "/users", "X-Role", "reader"))
+		for message, level := range map[string]zapcore.Level{"Access granted": test.granted, "Access denied": test.denied} {
+			entries := logs.FilterMessage(message).All()
+			if len(entries) != 1 || entries[0].Level != level {
+				t.Errorf("log_granted %q, log_denied %q: got %s entries %v, want one at %s", test.logGranted, test.logDenied, message, entries, level)
+			}
+		}
+	}
+	if err := tryProvision(t, &Middleware{LogDenied: "loud"}, `{"reader": []}`); err == nil {
+		t.Error("expected an invalid log_denied to be rejected")
+	}
+}
+
+func TestRolesFileRelativeToCaddyfile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "roles.json"), []byte(`{"reader": [{ "action": "list", "resource": "posts" }]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file, rolesFile, want string
+	}{
+		{filepath.Join(dir, "Caddyfile"), "roles.json", filepath.Join(dir, "roles.json")},
+		{filepath.Join(dir, "Caddyfile"), "../roles.json", filepath.Join(filepath.Dir(dir), "roles.json")},
+		{filepath.Join(dir, "Caddyfile"), "/etc/caddy/roles.json", "/etc/caddy/roles.json"},
+		{"", "roles.json", "roles.json"},
+	}
+	for _, test := range tests {
+		tokens, err := caddyfile.Tokenize([]byte("simple_rest_rbac {\n\troles_file "+test.rolesFile+"\n}"), test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &Middleware{}
+		if err := m.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens)); err != nil {
+			t.Fatalf("%s in %q: %v", test.rolesFile, test.file, err)
+		}
+		if m.RolesFilePath != test.want {
+			t.Errorf("%s in %q: got %q, want %q", test.rolesFile, test.file, m.RolesFilePath, test.want)
+		}
+		if test.want == filepath.Join(dir, "roles.json") {
+			provision(t, m, "")
+			expectStatuses(t, m, []request{{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK}})
+		}
+	}
+}
+
+func TestSkipPaths(t *testing.T) {
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tskip_paths /health /metrics*\n\tskip_paths /status\n}")
+	provision(t, m, `{"reader": [{ "action": "list", "resource": "posts" }]}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/health", nil, http.StatusOK},
+		{"GET", "//health/", nil, http.StatusOK},
+		{"DELETE", "/health", nil, http.StatusOK},
+		{"GET", "/metrics", nil, http.StatusOK},
+		{"GET", "/metrics/go", nil, http.StatusOK},
+		{"GET", "/status/", nil, http.StatusOK},
+		{"GET", "/health/1", nil, http.StatusMethodNotAllowed},
+		{"GET", "/healthz", nil, http.StatusMethodNotAllowed},
+		{"GET", "/api/health", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+	})
+}
+
+func TestSplitRoles(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"editor", []string{"editor"}},
+		{`["editor","reviewer"]`, []string{"editor", "reviewer"}},
+		{`[" editor ", "", "reviewer"]`, []string{"editor", "reviewer"}},
+		{`[]`, []string{`[]`}},
+		{`[editor`, []string{"[editor"}},
+		{`[1, 2]`, []string{"[1, 2]"}},
+	}
+	for _, test := range tests {
+		if got := splitRoles(test.value); !slices.Equal(got, test.want) {
+			t.Errorf("splitRoles(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestMultipleRoles(t *testing.T) {
+	m := provision(t, &Middleware{}, `{
+		"editor": [{ "action": ["list", "edit"], "resource": "posts" }],
+		"reviewer": [
+			{ "action": ["list", "show"], "resource": "*" },
+			{ "type": "deny", "action": "list", "resource": "drafts" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"PUT", "/posts/1", []string{"X-Role", `["editor","reviewer"]`}, http.StatusOK},
+		{"GET", "/comments/1", []string{"X-Role", `["editor","reviewer"]`}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", `["editor","reviewer"]`}, http.StatusForbidden},
+		// A deny rule of one role denies the request
+		{"GET", "/drafts", []string{"X-Role", `["reviewer","editor"]`}, http.StatusForbidden},
+		// Undefined roles are ignored, as long as one is defined
+		{"PUT", "/posts/1", []string{"X-Role", `["guest","editor"]`}, http.StatusOK},
+		{"GET", "/posts", []string{"X-Role", `["guest"]`}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", `[]`}, http.StatusForbidden},
+	})
+}
+
+func TestStripFormat(t *testing.T) {
+	tests := []struct {
+		path, resource, record string
+	}{
+		{"/posts/1.json", "posts", "1"},
+		{"/posts.csv", "posts", ""},
+		{"/posts/1.tar.gz", "posts", "1.tar"},
+		{"/posts/.hidden", "posts", ".hidden"},
+		{"/posts/1", "posts", "1"},
+		{"/posts/1.json/", "posts", "1"},
+	}
+	for _, test := range tests {
+		m := &Middleware{StripFormat: true}
+		if resource, record := m.extractResource(test.path), m.extractRecordID(test.path); resource != test.resource || record != test.record {
+			t.Errorf("%q: got %q and %q, want %q and %q", test.path, resource, record, test.resource, test.record)
+		}
+	}
+
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tstrip_format on\n}")
+	provision(t, m, `{
+		"reader": [
+			{ "action": "list", "resource": "posts" },
+			{ "action": "show", "resource": "posts", "record": "<=10" }
+		]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/1.json", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/posts/11.json", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/posts.csv", []string{"X-Role", "reader"}, http.StatusOK},
+	})
+	if m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tstrip_format off\n}"); m.StripFormat {
+		t.Error("expected strip_format off to disable it")
+	}
+}
+
+func TestMaxPathSegments(t *testing.T) {
+	deep := strings.Repeat("/a", defaultMaxPathSegments)
+	tests := []struct {
+		name     string
+		segments *int
+		target   string
+		status   int
+	}{
+		{"default", nil, deep, http.StatusOK},
+		{"default exceeded", nil, deep + "/a", http.StatusBadRequest},
+		{"configured", intPtr(3), "/a/1/b", http.StatusOK},
+		{"configured exceeded", intPtr(3), "/a/1/b/2", http.StatusBadRequest},
+		{"repeated slashes", intPtr(3), "/a//1///b/", http.StatusOK},
+		{"unlimited", intPtr(0), deep + deep, http.StatusOK},
+		{"skipped path", intPtr(1), "/health/a/b", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := provision(t, &Middleware{MaxPathSegments: test.segments, SkipPaths: []string{"/health*"}}, `{
+				"admin": [{ "action": "*", "resource": "*" }]
+			}`)
+			expectStatuses(t, m, []request{{"GET", test.target, []string{"X-Role", "admin"}, test.status}})
+		})
+	}
+	if err := tryProvision(t, &Middleware{MaxPathSegments: intPtr(-1)}, `{"admin": []}`); err == nil {
+		t.Error("expected a negative max_path_segments to be rejected")
+	}
+}
+
+func TestAuditPermissions(t *testing.T) {
+	for _, cacheSize := range []int{0, 10} {
+		m := provision(t, &Middleware{DecisionCacheSize: cacheSize}, `{
+			"*": [{ "type": "audit", "action": "delete", "resource": "invoices", "reason": "invoice deletion" }],
+			"accountant": [
+				{ "action": ["list", "show", "delete"], "resource": "invoices" },
+				{ "type": "audit", "action": "show", "resource": "invoices", "record": "1", "reason": "first invoice" }
+			],
+			"clerk": [{ "type": "audit", "action": "list", "resource": "invoices" }]
+		}`)
+		core, logs := observer.New(zapcore.DebugLevel)
+		m.logger = zap.New(core)
+		tests := []struct {
+			request
+			audits []string
+		}{
+			{request{"DELETE", "/invoices/2", []string{"X-Role", "accountant"}, http.StatusOK}, []string{"invoice deletion"}},
+			{request{"DELETE", "/invoices/2", []string{"X-Role", "clerk"}, http.StatusForbidden}, []string{"invoice deletion"}},
+			{request{"GET", "/invoices/1", []string{"X-Role", "accountant"}, http.StatusOK}, []string{"first invoice"}},
+			{request{"GET", "/invoices/2", []string{"X-Role", "accountant"}, http.StatusOK}, nil},
+			// Audit permissions don't allow anything
+			{request{"GET", "/invoices", []string{"X-Role", "clerk"}, http.StatusForbidden}, []string{""}},
+			{request{"DELETE", "/invoices/2", []string{"X-Role", "guest"}, http.StatusForbidden}, nil},
+		}
+		for _, test := range tests {
+			for range 2 {
+				logs.TakeAll()
+				expectStatuses(t, m, []request{test.request})
+				var audits []string
+				for _, entry := range logs.FilterMessage("Access audited").All() {
+					audits = append(audits, entry.ContextMap()["reason"].(string))
+				}
+				if !slices.Equal(audits, test.audits) {
+					t.Errorf("cache size %d, %s %s %v: got audits %q, want %q", cacheSize, test.method, test.target, test.headers, audits, test.audits)
+				}
+			}
+		}
+	}
+}
+
+func TestInvocations(t *testing.T) {
+	m := &Middleware{DetectInvocations: true}
+	tests := []struct {
+		method, path string
+		action, verb string
+	}{
+		{"POST", "/orders", "create", ""},
+		{"POST", "/orders/5/refund", "invoke", "refund"},
+		{"POST", "/orders/5", "create", ""},
+		{"POST", "/orders/5/refund/now", "create", ""},
+		{"PUT", "/orders/5/refund", "edit", "refund"},
+	}
+	for _, test := range tests {
+		if action := m.getActionFromRequest(newRequest(test.method, test.path)); action != test.action {
+			t.Errorf("%s %s: got action %q, want %q", test.method, test.path, action, test.action)
+		}
+		if verb := m.invocationVerb(test.path); verb != test.verb {
+			t.Errorf("%s %s: got verb %q, want %q", test.method, test.path, verb, test.verb)
+		}
+	}
+	if action := (&Middleware{}).getActionFromRequest(newRequest("POST", "/orders/5/refund")); action != "create" {
+		t.Errorf("got action %q without detect_invocations, want create", action)
+	}
+
+	provision(t, m, `{
+		"cashier": [{ "action": "invoke:refund", "resource": "orders" }],
+		"manager": [{ "action": "invoke", "resource": "orders" }],
+		"clerk": [{ "action": "create", "resource": "orders" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"POST", "/orders/5/refund", []string{"X-Role", "cashier"}, http.StatusOK},
+		{"POST", "/orders/5/cancel", []string{"X-Role", "cashier"}, http.StatusForbidden},
+		{"POST", "/orders", []string{"X-Role", "cashier"}, http.StatusForbidden},
+		{"POST", "/orders/5/cancel", []string{"X-Role", "manager"}, http.StatusOK},
+		{"POST", "/orders", []string{"X-Role", "clerk"}, http.StatusOK},
+		{"POST", "/orders/5/refund", []string{"X-Role", "clerk"}, http.StatusForbidden},
+	})
+}
+
+func TestResourceQueryParam(t *testing.T) {
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\tresource_query_param type search find*\n}")
+	tests := []struct {
+		target, resource string
+	}{
+		{"/search?type=posts", "posts"},
+		{"/search?type=+posts+", "posts"},
+		{"/finder?type=posts", "posts"},
+		{"/search", ""},
+		{"/search?kind=posts", ""},
+		{"/posts?type=comments", "posts"},
+	}
+	for _, test := range tests {
+		r := newRequest("GET", test.target)
+		if resource := m.queryResource(r, m.extractResource(r.URL.Path)); resource != test.resource {
+			t.Errorf("%s: got resource %q, want %q", test.target, resource, test.resource)
+		}
+	}
+
+	provision(t, m, `{
+		"reader": [{ "action": "list", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"GET", "/search?type=posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/search?type=comments", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/search", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/comments?type=posts", []string{"X-Role", "reader"}, http.StatusForbidden},
+	})
+
+	if err := (&Middleware{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("simple_rest_rbac {\n\tresource_query_param type\n}")); err == nil {
+		t.Error("expected resource_query_param without endpoints to be rejected")
+	}
+}
+
+func TestRequiredHeaders(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		require_headers create Idempotency-Key
+		require_headers * X-Request-ID
+	}`)
+	provision(t, m, `{
+		"writer": [{ "action": ["list", "create"], "resource": "posts" }]
+	}`)
+	tests := []struct {
+		request
+		missing string
+	}{
+		{request{"POST", "/posts", []string{"X-Role", "writer", "X-Request-ID", "1"}, http.StatusBadRequest}, "Idempotency-Key"},
+		{request{"POST", "/posts", []string{"X-Role", "writer", "X-Request-ID", "1", "Idempotency-Key", " "}, http.StatusBadRequest}, "Idempotency-Key"},
+		{request{"POST", "/posts", []string{"X-Role", "writer", "Idempotency-Key", "abc"}, http.StatusBadRequest}, "X-Request-ID"},
+		{request{"POST", "/posts", []string{"X-Role", "writer", "X-Request-ID", "1", "Idempotency-Key", "abc"}, http.StatusOK}, ""},
+		{request{"GET", "/posts", []string{"X-Role", "writer", "X-Request-ID", "1"}, http.StatusOK}, ""},
+		// Requests with their headers are evaluated as usual
+		{request{"POST", "/comments", []string{"X-Role", "writer", "X-Request-ID", "1", "Idempotency-Key", "abc"}, http.StatusForbidden}, ""},
+	}
+	for _, test := range tests {
+		res := serve(m, newRequest(test.method, test.target, test.headers...))
+		if res.status != test.status {
+			t.Errorf("%s %s %v: got status %d, want %d (%v)", test.method, test.target, test.headers, res.status, test.status, res.err)
+		}
+		if test.missing != "" && (res.err == nil || !strings.Contains(res.err.Error(), "missing required header "+test.missing)) {
+			t.Errorf("%s %s %v: got error %v, want missing header %s", test.method, test.target, test.headers, res.err, test.missing)
+		}
+	}
+
+	if err := (&Middleware{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("simple_rest_rbac {\n\trequire_headers create\n}")); err == nil {
+		t.Error("expected require_headers without headers to be rejected")
+	}
+}
+
+func TestWebDAVActions(t *testing.T) {
+	split := false
+	tests := []struct {
+		m            *Middleware
+		method, path string
+		action       string
+	}{
+		{&Middleware{}, "PROPFIND", "/files", "list"},
+		{&Middleware{}, "PROPFIND", "/files/1", "show"},
+		{&Middleware{}, "MKCOL", "/files", "create"},
+		{&Middleware{}, "COPY", "/files/1", "create"},
+		{&Middleware{}, "MOVE", "/files/1", "edit"},
+		{&Middleware{}, "PROPPATCH", "/files/1", "edit"},
+		{&Middleware{}, "LOCK", "/files/1", "edit"},
+		{&Middleware{}, "UNLOCK", "/files/1", "edit"},
+		{&Middleware{MergePutPatch: &split}, "LOCK", "/files/1", "patch"},
+		{&Middleware{MethodActions: map[string]string{"LOCK": "lock"}}, "LOCK", "/files/1", "lock"},
+		{&Middleware{}, "REPORT", "/files", ""},
+	}
+	for _, test := range tests {
+		if action := test.m.getActionFromRequest(newRequest(test.method, test.path)); action != test.action {
+			t.Errorf("%s %s: got action %q, want %q", test.method, test.path, action, test.action)
+		}
+	}
+
+	m := provision(t, &Middleware{}, `{
+		"reader": [{ "action": ["list", "show"], "resource": "files" }],
+		"writer": [{ "action": ["list", "show", "create", "edit"], "resource": "files" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"PROPFIND", "/files", []string{"X-Role", "reader"}, http.StatusOK},
+		{"MKCOL", "/files", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"MOVE", "/files/1", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"MKCOL", "/files", []string{"X-Role", "writer"}, http.StatusOK},
+		{"MOVE", "/files/1", []string{"X-Role", "writer"}, http.StatusOK},
+		{"LOCK", "/files/1", []string{"X-Role", "writer"}, http.StatusOK},
+	})
+}
+
+func TestRootResource(t *testing.T) {
+	roles := `{
+		"admin": [{ "action": "*", "resource": "*" }],
+		"visitor": [{ "action": "list", "resource": "root" }],
+		"reader": [
+			{ "action": "list", "resource": "posts" },
+			{ "type": "deny", "action": "*", "resource": "root" }
+		]
+	}`
+	m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\troot_resource root\n}")
+	provision(t, m, roles)
+	expectStatuses(t, m, []request{
+		{"GET", "/", []string{"X-Role", "admin"}, http.StatusOK},
+		{"GET", "/", []string{"X-Role", "visitor"}, http.StatusOK},
+		{"POST", "/", []string{"X-Role", "visitor"}, http.StatusForbidden},
+		{"GET", "/", []string{"X-Role", "reader"}, http.StatusForbidden},
+		{"GET", "/posts", []string{"X-Role", "reader"}, http.StatusOK},
+		{"GET", "/", nil, http.StatusMethodNotAllowed},
+	})
+
+	// Without a root resource, requests without a resource pass through
+	m = provision(t, &Middleware{}, roles)
+	expectStatuses(t, m, []request{
+		{"GET", "/", []string{"X-Role", "reader"}, http.StatusOK},
+		{"POST", "/", []string{"X-Role", "visitor"}, http.StatusOK},
+		{"GET", "/", nil, http.StatusOK},
+	})
+}
+
+func TestActionHeader(t *testing.T) {
+	m := unmarshalCaddyfile(t, `simple_rest_rbac {
+		action_header X-Action
+		custom_actions archive
+	}`)
+	provision(t, m, `{
+		"archivist": [{ "action": ["archive", "list"], "resource": "posts" }]
+	}`)
+	tests := []struct {
+		request
+		err string
+	}{
+		{request{"POST", "/posts/1", []string{"X-Role", "archivist", "X-Action", "archive"}, http.StatusOK}, ""},
+		{request{"POST", "/posts/1", []string{"X-Role", "archivist", "X-Action", " archive "}, http.StatusOK}, ""},
+		{request{"POST", "/comments/1", []string{"X-Role", "archivist", "X-Action", "archive"}, http.StatusForbidden}, ""},
+		// Without the header, the action is the one of the method
+		{request{"POST", "/posts/1", []string{"X-Role", "archivist"}, http.StatusForbidden}, ""},
+		{request{"GET", "/posts", []string{"X-Role", "archivist"}, http.StatusOK}, ""},
+		{request{"GET", "/posts", []string{"X-Role", "archivist", "X-Action", ""}, http.StatusOK}, ""},
+		{request{"POST", "/posts/1", []string{"X-Role", "archivist", "X-Action", "publish"}, http.StatusBadRequest}, "unknown action in X-Action header: publish"},
+		{request{"POST", "/posts/1", []string{"X-Role", "archivist", "X-Action", "*"}, http.StatusBadRequest}, "unknown action in X-Action header"},
+	}
+	for _, test := range tests {
+		res := serve(m, newRequest(test.method, test.target, test.headers...))
+		if res.status != test.status {
+			t.Errorf("%s %s %v: got status %d, want %d (%v)", test.method, test.target, test.headers, res.status, test.status, res.err)
+		}
+		if test.err != "" && (res.err == nil || !strings.Contains(res.err.Error(), test.err)) {
+			t.Errorf("%s %s %v: got error %v, want %q", test.method, test.target, test.headers, res.err, test.err)
+		}
+	}
+}
+
+func TestTraceIDs(t *testing.T) {
+	roles := `{
+		"reader": [
+			{ "action": "list", "resource": "posts" },
+			{ "type": "audit", "action": "list", "resource": "posts" }
+		]
+	}`
+	tests := []struct {
+		name        string
+		traceHeader string
+		headers     []string
+		traceID     string
+	}{
+		{"trace header", "X-Request-Id", []string{"X-Request-Id", "abc-123"}, "abc-123"},
+		{"request ID", "X-Request-Id", nil, "{http.request.uuid}"},
+		{"no trace header", "", []string{"X-Request-Id", "abc-123"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := provision(t, &Middleware{TraceHeader: test.traceHeader}, roles)
+			core, logs := observer.New(zapcore.DebugLevel)
+			m.logger = zap.New(core)
+			for _, target := range []string{"/posts", "/users"} {
+				r := newRequest("GET", target, append([]string{"X-Role", "reader"}, test.headers...)...)
+				// Caddy's server gives each request the variables holding
+				// its ID, and its extra log fields
+				ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{})
+				r = r.WithContext(context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields)))
+				serve(m, r)
+				want := test.traceID
+				if want == "{http.request.uuid}" {
+					want = r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).ReplaceAll(want, "")
+					if want == "" {
+						t.Fatal("expected the request to have an ID")
+					}
+				}
+				entries := logs.TakeAll()
+				if len(entries) == 0 {
+					t.Fatalf("%s: got no log entries", target)
+				}
+				for _, entry := range entries {
+					traceID, ok := entry.ContextMap()["trace_id"]
+					if test.traceID == "" && ok {
+						t.Errorf("%s: got trace ID %v in %q without trace header", target, traceID, entry.Message)
+					} else if test.traceID != "" && traceID != want {
+						t.Errorf("%s: got trace ID %v in %q, want %q", target, traceID, entry.Message, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestResourcePosition(t *testing.T) {
+	tests := []struct {
+		position, path   string
+		resource, record string
+	}{
+		{"", "/posts/5/comments", "posts", "5"},
+		{"root", "/posts/5/comments", "posts", "5"},
+		{"leaf", "/posts/5/comments", "comments", ""},
+		{"leaf", "/posts/5/comments/7", "comments", "7"},
+		{"leaf", "/posts/5", "posts", "5"},
+		{"leaf", "/posts", "posts", ""},
+	}
+	for _, test := range tests {
+		m := &Middleware{ResourcePosition: test.position}
+		if resource := m.extractResource(test.path); resource != test.resource {
+			t.Errorf("%s %s: got resource %q, want %q", test.position, test.path, resource, test.resource)
+		}
+		if record := m.extractRecordID(test.path); record != test.record {
+			t.Errorf("%s %s: got record %q, want %q", test.position, test.path, record, test.record)
+		}
+	}
+
+	roles := `{
+		"moderator": [{ "action": ["list", "show"], "resource": "comments" }]
+	}`
+	m := provision(t, &Middleware{ResourcePosition: "leaf"}, roles)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/5/comments", []string{"X-Role", "moderator"}, http.StatusOK},
+		{"GET", "/users/1/comments/7", []string{"X-Role", "moderator"}, http.StatusOK},
+		{"GET", "/posts/5", []string{"X-Role", "moderator"}, http.StatusForbidden},
+	})
+	m = provision(t, &Middleware{ResourcePosition: "root"}, roles)
+	expectStatuses(t, m, []request{
+		{"GET", "/posts/5/comments", []string{"X-Role", "moderator"}, http.StatusForbidden},
+		{"GET", "/comments/7", []string{"X-Role", "moderator"}, http.StatusOK},
+	})
+
+	for _, m := range []*Middleware{{ResourcePosition: "middle"}, {ResourcePosition: "leaf", DetectInvocations: true}} {
+		if err := tryProvision(t, m, roles); err == nil {
+			t.Errorf("expected resource position %q (detect_invocations %v) to be rejected", m.ResourcePosition, m.DetectInvocations)
+		}
+	}
+}
+
+func TestUnmappedMethodStatus(t *testing.T) {
+	roles := `{
+		"admin": [{ "action": "*", "resource": "*" }]
+	}`
+	m := provision(t, &Middleware{}, roles)
+	expectStatuses(t, m, []request{
+		{"PURGE", "/posts", []string{"X-Role", "admin"}, http.StatusMethodNotAllowed},
+		{"PURGE", "/reports", []string{"X-Role", "admin"}, http.StatusMethodNotAllowed},
+	})
+
+	m = unmarshalCaddyfile(t, `simple_rest_rbac {
+		unmapped_method_status 403
+		unmapped_method_status 405 reports archive_*
+	}`)
+	provision(t, m, roles)
+	expectStatuses(t, m, []request{
+		{"PURGE", "/posts", []string{"X-Role", "admin"}, http.StatusForbidden},
+		{"PURGE", "/reports", []string{"X-Role", "admin"}, http.StatusMethodNotAllowed},
+		{"PURGE", "/archive_2020/1", []string{"X-Role", "admin"}, http.StatusMethodNotAllowed},
+		{"GET", "/posts", []string{"X-Role", "admin"}, http.StatusOK},
+	})
+
+	for _, m := range []*Middleware{
+		{UnmappedMethodStatus: 200},
+		{UnmappedMethodStatuses: []ResourceStatus{{Resource: "posts", Status: 302}}},
+	} {
+		if err := tryProvision(t, m, roles); err == nil {
+			t.Errorf("expected unmapped method statuses %d %v to be rejected", m.UnmappedMethodStatus, m.UnmappedMethodStatuses)
+		}
+	}
+	if err := (&Middleware{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("simple_rest_rbac {\n\tunmapped_method_status forbidden\n}")); err == nil {
+		t.Error("expected an invalid unmapped_method_status to be rejected")
+	}
+}
+
+func TestDefaultAction(t *testing.T) {
+	roles := `{
+		"admin": [{ "action": "*", "resource": "*" }],
+		"reader": [{ "action": "list", "resource": "*" }]
+	}`
+	tests := []struct {
+		name         string
+		config       string
+		method, role string
+		status       int
+	}{
+		{"mapped method", "method_action PURGE purge", "PURGE", "admin", http.StatusOK},
+		{"mapped method denied", "method_action PURGE purge", "PURGE", "reader", http.StatusForbidden},
+		{"strict", "method_action PURGE purge", "REPORT", "admin", http.StatusMethodNotAllowed},
+		{"default action", "method_action PURGE purge\n\tdefault_action other", "REPORT", "admin", http.StatusOK},
+		{"default action denied", "method_action PURGE purge\n\tdefault_action other", "REPORT", "reader", http.StatusForbidden},
+		{"built-in method", "default_action other", "GET", "reader", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := unmarshalCaddyfile(t, "simple_rest_rbac {\n\t"+test.config+"\n}")
+			provision(t, m, roles)
+			expectStatuses(t, m, []request{{test.method, "/posts", []string{"X-Role", test.role}, test.status}})
+		})
+	}
+
+	// Methods mapped to no action are rejected whatever the default action
+	m := provision(t, &Middleware{MethodActions: map[string]string{"TRACE": ""}, DefaultAction: "other"}, roles)
+	expectStatuses(t, m, []request{
+		{"TRACE", "/posts", []string{"X-Role", "admin"}, http.StatusMethodNotAllowed},
+		{"REPORT", "/posts", []string{"X-Role", "admin"}, http.StatusOK},
+	})
+}
@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// softDenied checks if denied requests of one of the roles are soft denied,
+// i.e. delayed before being denied (or allowed with soft_deny_allow). Soft
+// deny roles may be role name patterns, e.g. "tenant-*-editor".
+func (m *Middleware) softDenied(rd RoleDefinitions, roles []string) bool {
+	if m.SoftDenyDelay <= 0 {
+		return false
+	}
+	return slices.ContainsFunc(roles, func(role string) bool {
+		return slices.Contains(m.SoftDenyRoles, role) || slices.Contains(m.SoftDenyRoles, rd.roleName(role))
+	})
+}
+
+// sleep waits for a delay, returning early with the error of the context if
+// it is done first, e.g. when the client disconnects
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
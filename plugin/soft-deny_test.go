@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSoftDenyOfRoleNamePattern(t *testing.T) {
+	m := provision(t, &Middleware{
+		SoftDenyDelay: caddy.Duration(time.Millisecond),
+		SoftDenyRoles: []string{"tenant-*-bot"},
+		SoftDenyAllow: true,
+	}, `{
+		"tenant-*-bot": [{ "action": "list", "resource": "posts" }],
+		"tenant-*-editor": [{ "action": "list", "resource": "posts" }]
+	}`)
+	expectStatuses(t, m, []request{
+		{"DELETE", "/posts/1", []string{"X-Role", "tenant-1-bot"}, http.StatusOK},
+		{"DELETE", "/posts/1", []string{"X-Role", "tenant-1-editor"}, http.StatusForbidden},
+	})
+}
+
+func TestSoftDenyDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	roles := `{
+		"bot": [{ "action": "list", "resource": "posts" }],
+		"editor": [{ "action": "list", "resource": "posts" }]
+	}`
+	tests := []struct {
+		name           string
+		allow          bool
+		role           string
+		method, target string
+		status         int
+		delayed        bool
+	}{
+		{"denied soft deny role", false, "bot", "DELETE", "/posts/1", http.StatusForbidden, true},
+		{"allowed soft deny role", false, "bot", "GET", "/posts", http.StatusOK, false},
+		{"denied other role", false, "editor", "DELETE", "/posts/1", http.StatusForbidden, false},
+		{"soft deny allow", true, "bot", "DELETE", "/posts/1", http.StatusOK, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := provision(t, &Middleware{SoftDenyDelay: caddy.Duration(delay), SoftDenyRoles: []string{"bot"}, SoftDenyAllow: test.allow}, roles)
+			start := time.Now()
+			res := serve(m, newRequest(test.method, test.target, "X-Role", test.role))
+			elapsed := time.Since(start)
+			if res.status != test.status {
+				t.Errorf("got status %d, want %d (%v)", res.status, test.status, res.err)
+			}
+			if delayed := elapsed >= delay; delayed != test.delayed {
+				t.Errorf("got a response after %v, want delayed %v", elapsed, test.delayed)
+			}
+		})
+	}
+}
+
+func TestSoftDenyStopsWhenTheClientDisconnects(t *testing.T) {
+	m := provision(t, &Middleware{SoftDenyDelay: caddy.Duration(time.Hour), SoftDenyRoles: []string{"bot"}}, `{
+		"bot": [{ "action": "list", "resource": "posts" }]
+	}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	res := serve(m, newRequest("DELETE", "/posts/1", "X-Role", "bot").WithContext(ctx))
+	if !errors.Is(res.err, context.Canceled) || res.next {
+		t.Errorf("got error %v (next called %v), want the context error", res.err, res.next)
+	}
+
+	if err := sleep(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("got error %v after the delay", err)
+	}
+}
+
+func TestSoftDenyConfig(t *testing.T) {
+	for _, m := range []*Middleware{
+		{SoftDenyDelay: caddy.Duration(-time.Second), SoftDenyRoles: []string{"bot"}},
+		{SoftDenyDelay: caddy.Duration(time.Second)},
+	} {
+		if err := tryProvision(t, m, `{"bot": []}`); err == nil {
+			t.Errorf("expected soft deny delay %v with roles %v to be rejected", time.Duration(m.SoftDenyDelay), m.SoftDenyRoles)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// knownActions returns the actions which permissions can refer to
+func (m *Middleware) knownActions() []string {
+	known := []string{"*"}
+	for _, action := range m.enabledActions() {
+		known = append(known, m.actionName(action))
+	}
+	for _, action := range m.MethodActions {
+		if action != "" {
+			known = append(known, action)
+		}
+	}
+	if m.DefaultAction != "" {
+		known = append(known, m.DefaultAction)
+	}
+	return append(known, m.CustomActions...)
+}
+
+// customResolver checks if a custom action resolver is configured. Its raw
+// configuration is dropped once the module is loaded.
+func (m *Middleware) customResolver() bool {
+	if m.ActionResolverRaw != nil {
+		return true
+	}
+	_, builtin := m.resolver.(defaultActionResolver)
+	return m.resolver != nil && !builtin
+}
+
+// permissionActions returns the actions listed by a permission
+func permissionActions(permission Permission) []string {
+	if permission.Action.Single != nil {
+		return []string{*permission.Action.Single}
+	}
+	return permission.Action.Multiple
+}
+
+// validateRoles checks that the role definitions only use known actions, and
+// that the roles referenced by the configuration exist. The returned error
+// lists every dangling reference.
+func (m *Middleware) validateRoles(rd RoleDefinitions) error {
+	var errs []error
+	known := m.knownActions()
+	checkActions := func(where string, permission Permission) {
+		for _, action := range permissionActions(permission) {
+			// Scoped actions (e.g. "get_many_reference:post_id") are checked
+			// without their scope
+			base, _, _ := strings.Cut(strings.TrimPrefix(action, "!"), ":")
+			if !slices.Contains(known, base) {
+				errs = append(errs, fmt.Errorf("%s: unknown action %q", where, action))
+			}
+		}
+	}
+
+	// Custom resolvers may return any action
+	if !m.customResolver() {
+		roles := make([]string, 0, len(rd))
+		for role := range rd {
+			roles = append(roles, role)
+		}
+		sort.Strings(roles)
+		for _, role := range roles {
+			for _, permission := range rd[role] {
+				checkActions(fmt.Sprintf("role %s, resource %s", role, permission.Resource), permission)
+			}
+		}
+		for _, permission := range m.GlobalDeny {
+			checkActions(fmt.Sprintf("global_deny, resource %s", permission.Resource), permission)
+		}
+	}
+
+	for _, rl := range m.RateLimits {
+		if rd.roleName(rl.Role) == "" {
+			errs = append(errs, fmt.Errorf("rate_limit: unknown role %q", rl.Role))
+		}
+		if !m.customResolver() {
+			for _, action := range rl.Actions {
+				if !slices.Contains(known, action) {
+					errs = append(errs, fmt.Errorf("rate_limit of role %s: unknown action %q", rl.Role, action))
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestValidateRoles(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      *Middleware
+		roles  string
+		errors []string
+	}{
+		{
+			"known actions",
+			&Middleware{CustomActions: []string{"export"}},
+			`{"reader": [{ "action": ["list", "show", "export", "*"], "resource": "posts" }]}`,
+			nil,
+		},
+		{
+			"unknown actions",
+			&Middleware{},
+			`{"reader": [{ "action": ["list", "read"], "resource": "posts" }], "writer": [{ "action": "write", "resource": "posts" }]}`,
+			[]string{`role reader, resource posts: unknown action "read"`, `role writer, resource posts: unknown action "write"`},
+		},
+		{
+			"unknown global deny action",
+			&Middleware{GlobalDeny: []Permission{{Type: "deny", Action: parseAction("purge"), Resource: "posts"}}},
+			`{"reader": []}`,
+			[]string{`global_deny, resource posts: unknown action "purge"`},
+		},
+		{
+			"unknown rate limit role and action",
+			&Middleware{RateLimits: []RateLimit{{Role: "editor", Actions: []string{"publish"}, Limit: 1, Window: caddy.Duration(time.Minute)}}},
+			`{"reader": []}`,
+			[]string{`rate_limit: unknown role "editor"`, `rate_limit of role editor: unknown action "publish"`},
+		},
+		{
+			"scoped actions",
+			&Middleware{DetectReferences: true},
+			`{"reader": [{ "action": "get_many_reference:post_id", "resource": "comments" }]}`,
+			nil,
+		},
+		{
+			"custom resolver",
+			&Middleware{resolver: headerActionResolver{}},
+			`{"reader": [{ "action": "search", "resource": "posts" }]}`,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.m.validateRoles(parseRoles(t, test.roles))
+			if len(test.errors) == 0 && err != nil {
+				t.Errorf("got error %v, want none", err)
+			}
+			for _, want := range test.errors {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("got error %v, want %s", err, want)
+				}
+			}
+		})
+	}
+}